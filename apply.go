@@ -88,21 +88,19 @@ func BuildSimpleApply(apply interface{}, inShapes, outShapes [][]int64) *ServeRa
 
 	for i := 0; i < len(inputTensors); i++ {
 		name := "input" + strconv.Itoa(i)
-		t := TensorToNativeTensor(inputTensors[i])
 		io := NativeIOMetadata{}
 		io.Name = name
-		io.Type = t.Type
-		io.Shape = t.Shape
+		io.Type = inputTensors[i].Type()
+		io.Shape = tensorShape(inputTensors[i])
 		meta.Inputs = append(meta.Inputs, io)
 	}
 
 	for i := 0; i < len(outputTensors); i++ {
 		name := "output" + strconv.Itoa(i)
-		t := TensorToNativeTensor(outputTensors[i])
 		io := NativeIOMetadata{}
 		io.Name = name
-		io.Type = t.Type
-		io.Shape = t.Shape
+		io.Type = outputTensors[i].Type()
+		io.Shape = tensorShape(outputTensors[i])
 		meta.Outputs = append(meta.Outputs, io)
 	}
 	opts.Meta = meta
@@ -17,7 +17,10 @@ import (
 func TestSimpleApplyString(t *testing.T) {
 	v := []string{"foo", "bar", "baz"}
 	tmp, _ := nativeToTensor(v)
-	tensor := TensorToNativeTensor(tmp)
+	tensor, err := TensorToNativeTensor(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if err := testSimpleApplyFunc(t, tensor, applyInterface); err != nil {
 		t.Fatal(err)
 	}
@@ -35,7 +38,10 @@ func TestSimpleApplyString(t *testing.T) {
 func TestSimpleApplyFloat(t *testing.T) {
 	v := []float32{1., 2., 3.}
 	tmp, _ := nativeToTensor(v)
-	tensor := TensorToNativeTensor(tmp)
+	tensor, err := TensorToNativeTensor(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if err := testSimpleApplyFunc(t, tensor, applyInterface); err != nil {
 		t.Fatal(err)
 	}
@@ -52,7 +58,10 @@ func TestSimpleApplyFloat(t *testing.T) {
 
 func TestSimpleApplyMulti(t *testing.T) {
 	tmp, _ := nativeToTensor([][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g", "h", "i"}})
-	tensor := TensorToNativeTensor(tmp)
+	tensor, err := TensorToNativeTensor(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if err := testSimpleApplyFunc(t, tensor, applyMulti); err != nil {
 		t.Fatal(err)
 	}
@@ -86,7 +95,10 @@ func testSimpleApplyFuncBounded(t *testing.T, tensor *NativeTensor, f interface{
 
 func TestSimpleApplyShapes(t *testing.T) {
 	tmp, _ := nativeToTensor([][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g", "h", "i"}})
-	tensor := TensorToNativeTensor(tmp)
+	tensor, err := TensorToNativeTensor(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
 	shape := [][]int64{{-1, 3}}
 	if err := testSimpleApplyFuncBounded(t, tensor, applyMulti, shape, nil); err != nil {
 		t.Fatal(err)
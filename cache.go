@@ -0,0 +1,845 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	bolt "github.com/coreos/bbolt"
+)
+
+// Cache stores model results for the server. Each output has its own
+// bucket, which holds the encoded type and shape of a single row of the
+// output along with the data of each row keyed by a hash of the inputs
+// that produced it. A Cache must be safe for concurrent use.
+type Cache interface {
+	// Get returns the type and shape of each output, or nil if it is not
+	// cached, and the data of each row of each output for keys, or nil
+	// for rows that are not cached. The returned slices are owned by the
+	// caller.
+	Get(outputs []string, keys [][]byte) (typeShapes [][]byte, data [][][]byte, err error)
+	// Put stores the type and shape of each output if it is not already
+	// known, and the data of each row of each output under keys.
+	Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error
+	// Stats returns the number of rows and bytes cached for each output.
+	Stats() (map[string]CacheStats, error)
+	// Purge removes outputs and all of their rows. If outputs is empty
+	// everything is removed.
+	Purge(outputs []string) error
+	// Each calls fn for every cached row. The slices are only valid
+	// during the call. If fn returns an error Each stops and returns it.
+	Each(fn func(output string, typeShape, key, data []byte) error) error
+	// Close releases the resources of the cache.
+	Close() error
+}
+
+// CacheStats describe the rows cached for an output.
+type CacheStats struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+const (
+	boltMetaBucket  = ".graphpipe"
+	boltVersionKey  = "version"
+	boltModelKey    = "model"
+	boltVersion     = "1"
+	stampLen        = 8
+	compactInterval = time.Minute
+	// compactBatch is how many rows Compact scans in each transaction
+	compactBatch = 1000
+	// the file is rewritten once at least 1/rewriteShare of it is free
+	rewriteShare = 4
+)
+
+// BoltCacheOptions bound the size and age of a BoltCache.
+type BoltCacheOptions struct {
+	// TTL is how long rows stay in the cache after they were last used.
+	// If it is 0 rows never expire.
+	TTL time.Duration
+	// MaxBytes bounds the size of the keys and data in the cache. Once it
+	// is exceeded the least recently used rows are evicted, so the file
+	// can briefly grow past it between compactions. If it is 0 the cache
+	// is unbounded.
+	MaxBytes int64
+	// CompactInterval is how often expired and evicted rows are removed
+	// and the file is checked for free space to compact. The zero value
+	// means once a minute.
+	CompactInterval time.Duration
+	// ModelID identifies the model whose results are cached. If a file
+	// was written for a different model its contents are dropped.
+	ModelID string
+}
+
+// BoltCache is a Cache stored in a BoltDB file, so results survive
+// restarts. Each row is stored with the time it was last used, which is
+// how rows are expired and evicted.
+type BoltCache struct {
+	// mu guards db, which is replaced when the file is compacted, and
+	// broken, which is set if the file could not be reopened afterwards
+	mu     sync.RWMutex
+	db     *bolt.DB
+	broken error
+	closed bool
+	path   string
+	opts   BoltCacheOptions
+	// touched holds the rows read since the last compaction, by output
+	// and key, so that reads do not need a write transaction
+	touchMu sync.Mutex
+	touched map[string]map[string]int64
+	stop    chan bool
+	done    chan bool
+}
+
+// NewBoltCache opens or creates a BoltDB cache file at path. If opts is
+// nil the cache never expires or evicts rows.
+func NewBoltCache(path string, opts *BoltCacheOptions) (*BoltCache, error) {
+	bc := &BoltCache{path: path, touched: map[string]map[string]int64{}}
+	if opts != nil {
+		bc.opts = *opts
+	}
+	if bc.opts.CompactInterval <= 0 {
+		bc.opts.CompactInterval = compactInterval
+	}
+	var err error
+	if bc.db, err = openBolt(path, bc.opts.ModelID); err != nil {
+		return nil, err
+	}
+	if bc.bounded() {
+		bc.stop = make(chan bool)
+		bc.done = make(chan bool)
+		go bc.maintain()
+	}
+	return bc, nil
+}
+
+// openBolt opens a cache file, dropping the contents of files written
+// in an older format or for another model.
+func openBolt(path string, modelID string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(boltMetaBucket))
+		if meta != nil && string(meta.Get([]byte(boltVersionKey))) == boltVersion &&
+			string(meta.Get([]byte(boltModelKey))) == modelID {
+			return nil
+		}
+		if meta != nil {
+			logrus.Infof("Dropping results cached for another model")
+		}
+		names := [][]byte{}
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, copyBytes(name))
+			return nil
+		})
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucket([]byte(boltMetaBucket))
+		if err != nil {
+			return err
+		}
+		if err := meta.Put([]byte(boltVersionKey), []byte(boltVersion)); err != nil {
+			return err
+		}
+		return meta.Put([]byte(boltModelKey), []byte(modelID))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (bc *BoltCache) bounded() bool {
+	return bc.opts.TTL > 0 || bc.opts.MaxBytes > 0
+}
+
+func (bc *BoltCache) expired(stamp, now int64) bool {
+	return bc.opts.TTL > 0 && time.Duration(now-stamp) > bc.opts.TTL
+}
+
+// Get implements Cache. Rows older than the TTL are not returned.
+func (bc *BoltCache) Get(outputs []string, keys [][]byte) ([][]byte, [][][]byte, error) {
+	typeShapes := make([][]byte, len(outputs))
+	data := make([][][]byte, len(outputs))
+	now := time.Now().UnixNano()
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.broken != nil {
+		return nil, nil, bc.broken
+	}
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		for i := range outputs {
+			data[i] = make([][]byte, len(keys))
+			// values are only valid for the length of the transaction
+			bucket := tx.Bucket([]byte(outputs[i]))
+			if bucket == nil {
+				continue
+			}
+			typeShapes[i] = copyBytes(bucket.Get([]byte(tsKey)))
+			if typeShapes[i] == nil {
+				// if we haven't set the shape then there should be
+				// no keys so skip retrieval
+				continue
+			}
+			for j := range keys {
+				v := bucket.Get(keys[j])
+				if len(v) < stampLen || bc.expired(int64(binary.LittleEndian.Uint64(v)), now) {
+					continue
+				}
+				data[i][j] = copyBytes(v[stampLen:])
+				if bc.bounded() {
+					bc.touch(outputs[i], keys[j], now)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return typeShapes, data, nil
+}
+
+func (bc *BoltCache) touch(output string, key []byte, now int64) {
+	bc.touchMu.Lock()
+	defer bc.touchMu.Unlock()
+	keys, ok := bc.touched[output]
+	if !ok {
+		keys = map[string]int64{}
+		bc.touched[output] = keys
+	}
+	keys[string(key)] = now
+}
+
+// Put implements Cache. Puts after the cache is closed are ignored.
+func (bc *BoltCache) Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	stamp := make([]byte, stampLen)
+	binary.LittleEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.broken != nil {
+		return bc.broken
+	}
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		for i := range outputs {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(outputs[i]))
+			if err != nil {
+				return err
+			}
+			if bucket.Get([]byte(tsKey)) == nil {
+				if err := bucket.Put([]byte(tsKey), typeShapes[i]); err != nil {
+					return err
+				}
+			}
+			for j := range keys {
+				if err := bucket.Put(keys[j], append(stamp, data[i][j]...)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err == bolt.ErrDatabaseNotOpen {
+		return nil
+	}
+	return err
+}
+
+// Stats implements Cache.
+func (bc *BoltCache) Stats() (map[string]CacheStats, error) {
+	stats := map[string]CacheStats{}
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.broken != nil {
+		return nil, bc.broken
+	}
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if string(name) == boltMetaBucket {
+				return nil
+			}
+			s := CacheStats{}
+			bucket.ForEach(func(k, v []byte) error {
+				if string(k) != tsKey {
+					s.Entries++
+					s.Bytes += int64(len(k) + len(v))
+				}
+				return nil
+			})
+			stats[string(name)] = s
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Purge implements Cache. The file is rewritten afterwards if enough of it
+// was freed.
+func (bc *BoltCache) Purge(outputs []string) error {
+	bc.mu.RLock()
+	if bc.broken != nil {
+		bc.mu.RUnlock()
+		return bc.broken
+	}
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		if len(outputs) == 0 {
+			tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				if string(name) != boltMetaBucket {
+					outputs = append(outputs, string(name))
+				}
+				return nil
+			})
+		}
+		for _, output := range outputs {
+			err := tx.DeleteBucket([]byte(output))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	bc.mu.RUnlock()
+	if err != nil || !bc.mostlyFree() {
+		return err
+	}
+	return bc.rewrite()
+}
+
+// Each implements Cache. Rows are visited by output and then by key, and
+// expired rows are skipped.
+func (bc *BoltCache) Each(fn func(output string, typeShape, key, data []byte) error) error {
+	now := time.Now().UnixNano()
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if bc.broken != nil {
+		return bc.broken
+	}
+	return bc.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			typeShape := bucket.Get([]byte(tsKey))
+			if string(name) == boltMetaBucket || typeShape == nil {
+				return nil
+			}
+			return bucket.ForEach(func(k, v []byte) error {
+				if string(k) == tsKey || len(v) < stampLen || bc.expired(int64(binary.LittleEndian.Uint64(v)), now) {
+					return nil
+				}
+				return fn(string(name), typeShape, k, v[stampLen:])
+			})
+		})
+	})
+}
+
+func (bc *BoltCache) maintain() {
+	defer close(bc.done)
+	ticker := time.NewTicker(bc.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.stop:
+			return
+		case <-ticker.C:
+			if err := bc.Compact(); err != nil {
+				logrus.Errorf("Failed to compact cache: %v", err)
+			}
+		}
+	}
+}
+
+type boltRow struct {
+	stamp int64
+	size  int64
+}
+
+// Compact removes rows older than the TTL and evicts the least recently used
+// rows until the cache fits in MaxBytes. Rows are deleted in small batches so
+// that writes are not held up. If enough of the file is then free it is
+// rewritten so that the space is returned to the disk. It is run in the
+// background for caches with a TTL or MaxBytes.
+func (bc *BoltCache) Compact() error {
+	if err := bc.recoverBroken(); err != nil {
+		return err
+	}
+	if err := bc.flushTouched(); err != nil {
+		return err
+	}
+	before, err := bc.evictBefore()
+	if err != nil {
+		return err
+	}
+	removed, err := bc.removeBefore(before)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		logrus.Infof("Removed %d rows from the cache", removed)
+	}
+	if !bc.mostlyFree() {
+		return nil
+	}
+	return bc.rewrite()
+}
+
+// flushTouched records the reads since the last compaction, so that recently
+// used rows are kept.
+func (bc *BoltCache) flushTouched() error {
+	bc.touchMu.Lock()
+	touched := bc.touched
+	bc.touched = map[string]map[string]int64{}
+	bc.touchMu.Unlock()
+	if len(touched) == 0 {
+		return nil
+	}
+
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		for output, keys := range touched {
+			bucket := tx.Bucket([]byte(output))
+			if bucket == nil {
+				continue
+			}
+			for key, stamp := range keys {
+				v := bucket.Get([]byte(key))
+				if len(v) < stampLen || int64(binary.LittleEndian.Uint64(v)) >= stamp {
+					continue
+				}
+				nv := copyBytes(v)
+				binary.LittleEndian.PutUint64(nv, uint64(stamp))
+				if err := bucket.Put([]byte(key), nv); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// evictBefore returns the stamp that rows must be at least as new as to be
+// kept. It covers the TTL and, if the live rows exceed MaxBytes, enough of
+// the least recently used rows to fit. Only the stamp and size of each row
+// are held in memory.
+func (bc *BoltCache) evictBefore() (int64, error) {
+	before := int64(0)
+	if bc.opts.TTL > 0 {
+		before = time.Now().UnixNano() - int64(bc.opts.TTL)
+	}
+	if bc.opts.MaxBytes <= 0 {
+		return before, nil
+	}
+
+	live := []boltRow{}
+	total := int64(0)
+	bc.mu.RLock()
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if string(name) == boltMetaBucket {
+				return nil
+			}
+			return bucket.ForEach(func(k, v []byte) error {
+				if string(k) == tsKey || len(v) < stampLen {
+					return nil
+				}
+				row := boltRow{int64(binary.LittleEndian.Uint64(v)), int64(len(k) + len(v))}
+				if row.stamp >= before {
+					live = append(live, row)
+					total += row.size
+				}
+				return nil
+			})
+		})
+	})
+	bc.mu.RUnlock()
+	if err != nil || total <= bc.opts.MaxBytes {
+		return before, err
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].stamp < live[j].stamp })
+	for _, row := range live {
+		if total <= bc.opts.MaxBytes {
+			break
+		}
+		before = row.stamp + 1
+		total -= row.size
+	}
+	return before, nil
+}
+
+// removeBefore deletes the rows last used before the given stamp, along
+// with rows too short to hold a stamp. Each bucket is scanned and cleaned
+// compactBatch rows at a time, each batch in its own transaction.
+func (bc *BoltCache) removeBefore(before int64) (int, error) {
+	stale := func(v []byte) bool {
+		return len(v) < stampLen || int64(binary.LittleEndian.Uint64(v)) < before
+	}
+	names := [][]byte{}
+	bc.mu.RLock()
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) != boltMetaBucket {
+				names = append(names, copyBytes(name))
+			}
+			return nil
+		})
+	})
+	bc.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, name := range names {
+		var next []byte
+		for first := true; first || next != nil; first = false {
+			keys := [][]byte{}
+			bc.mu.RLock()
+			err := bc.db.View(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(name)
+				if bucket == nil {
+					next = nil
+					return nil
+				}
+				c := bucket.Cursor()
+				k, v := c.Seek(next)
+				for n := 0; k != nil && n < compactBatch; n++ {
+					if string(k) != tsKey && stale(v) {
+						keys = append(keys, copyBytes(k))
+					}
+					k, v = c.Next()
+				}
+				next = copyBytes(k)
+				return nil
+			})
+			if err == nil && len(keys) > 0 {
+				err = bc.db.Update(func(tx *bolt.Tx) error {
+					bucket := tx.Bucket(name)
+					if bucket == nil {
+						return nil
+					}
+					for _, key := range keys {
+						// the row may have been written again since the scan
+						if !stale(bucket.Get(key)) {
+							continue
+						}
+						if err := bucket.Delete(key); err != nil {
+							return err
+						}
+						removed++
+					}
+					return nil
+				})
+			}
+			bc.mu.RUnlock()
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// mostlyFree reports whether enough of the file is free pages for a
+// rewrite to be worth holding up the cache for.
+func (bc *BoltCache) mostlyFree() bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	info, err := os.Stat(bc.path)
+	if err != nil {
+		return false
+	}
+	free := int64(bc.db.Stats().FreeAlloc)
+	return free > 0 && free*rewriteShare >= info.Size()
+}
+
+// renameFile is os.Rename, replaced in tests.
+var renameFile = os.Rename
+
+// rewrite copies the cache into a new file and swaps it in, since bolt
+// never shrinks its file. If the new file can not be swapped in the old one
+// is reopened, and if neither can be opened the cache is left broken until
+// a later Compact manages to open it.
+func (bc *BoltCache) rewrite() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.broken != nil {
+		return bc.broken
+	}
+	tmpPath := bc.path + ".compact"
+	os.Remove(tmpPath)
+	tmp, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = bc.db.View(func(src *bolt.Tx) error {
+		return tmp.Update(func(dst *bolt.Tx) error {
+			return src.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				out, err := dst.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				out.FillPercent = 1
+				return bucket.ForEach(func(k, v []byte) error {
+					return out.Put(k, v)
+				})
+			})
+		})
+	})
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = bc.db.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	renameErr := renameFile(tmpPath, bc.path)
+	if renameErr != nil {
+		os.Remove(tmpPath)
+	}
+	if err := bc.reopen(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// reopen opens the cache file again after it was closed for a rewrite. If
+// that fails the cache is marked broken. bc.mu must be held for writing.
+func (bc *BoltCache) reopen() error {
+	db, err := openBolt(bc.path, bc.opts.ModelID)
+	if err != nil {
+		bc.broken = fmt.Errorf("Could not reopen the cache file: %v", err)
+		return bc.broken
+	}
+	bc.db = db
+	bc.broken = nil
+	return nil
+}
+
+// recoverBroken tries to reopen a cache that was left broken by a failed rewrite.
+func (bc *BoltCache) recoverBroken() error {
+	bc.mu.RLock()
+	broken := bc.broken
+	bc.mu.RUnlock()
+	if broken == nil {
+		return nil
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.broken == nil || bc.closed {
+		return bc.broken
+	}
+	return bc.reopen()
+}
+
+// Close implements Cache.
+func (bc *BoltCache) Close() error {
+	if bc.stop != nil {
+		close(bc.stop)
+		<-bc.done
+		bc.stop = nil
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.closed = true
+	if bc.broken != nil {
+		// the file was already closed by the failed rewrite
+		return nil
+	}
+	return bc.db.Close()
+}
+
+// MemoryCache is a Cache held in memory that evicts the least recently
+// used rows once it holds more than a given number of bytes. It suits
+// read-only containers where a cache file can not be written.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxBytes   int64
+	size       int64
+	typeShapes map[string][]byte
+	rows       map[string]*list.Element
+	lru        *list.List
+	stats      map[string]CacheStats
+}
+
+type memoryEntry struct {
+	output string
+	key    string
+	value  []byte
+}
+
+// NewMemoryCache creates a MemoryCache that holds up to maxBytes of keys
+// and row data.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes:   maxBytes,
+		typeShapes: map[string][]byte{},
+		rows:       map[string]*list.Element{},
+		lru:        list.New(),
+		stats:      map[string]CacheStats{},
+	}
+}
+
+func memoryKey(output string, key []byte) string {
+	return output + "\x00" + string(key)
+}
+
+// Get implements Cache.
+func (mc *MemoryCache) Get(outputs []string, keys [][]byte) ([][]byte, [][][]byte, error) {
+	typeShapes := make([][]byte, len(outputs))
+	data := make([][][]byte, len(outputs))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for i, output := range outputs {
+		data[i] = make([][]byte, len(keys))
+		typeShapes[i] = copyBytes(mc.typeShapes[output])
+		if typeShapes[i] == nil {
+			continue
+		}
+		for j := range keys {
+			if e, ok := mc.rows[memoryKey(output, keys[j])]; ok {
+				mc.lru.MoveToFront(e)
+				data[i][j] = copyBytes(e.Value.(*memoryEntry).value)
+			}
+		}
+	}
+	return typeShapes, data, nil
+}
+
+// Put implements Cache. Rows larger than the whole cache are not stored.
+func (mc *MemoryCache) Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for i, output := range outputs {
+		if _, ok := mc.typeShapes[output]; !ok {
+			mc.typeShapes[output] = copyBytes(typeShapes[i])
+		}
+		for j := range keys {
+			key := memoryKey(output, keys[j])
+			if e, ok := mc.rows[key]; ok {
+				mc.remove(e)
+			}
+			entry := &memoryEntry{output, key, copyBytes(data[i][j])}
+			if entry.size() > mc.maxBytes {
+				continue
+			}
+			mc.rows[key] = mc.lru.PushFront(entry)
+			mc.size += entry.size()
+			stats := mc.stats[output]
+			stats.Entries++
+			stats.Bytes += entry.size()
+			mc.stats[output] = stats
+		}
+	}
+	for mc.size > mc.maxBytes {
+		mc.remove(mc.lru.Back())
+	}
+	return nil
+}
+
+func (mc *MemoryCache) remove(e *list.Element) {
+	entry := mc.lru.Remove(e).(*memoryEntry)
+	delete(mc.rows, entry.key)
+	mc.size -= entry.size()
+	stats := mc.stats[entry.output]
+	stats.Entries--
+	stats.Bytes -= entry.size()
+	mc.stats[entry.output] = stats
+}
+
+// Stats implements Cache.
+func (mc *MemoryCache) Stats() (map[string]CacheStats, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	stats := make(map[string]CacheStats, len(mc.typeShapes))
+	for output := range mc.typeShapes {
+		stats[output] = mc.stats[output]
+	}
+	return stats, nil
+}
+
+// Purge implements Cache.
+func (mc *MemoryCache) Purge(outputs []string) error {
+	if len(outputs) == 0 {
+		return mc.Close()
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	purge := map[string]bool{}
+	for _, output := range outputs {
+		purge[output] = true
+		delete(mc.typeShapes, output)
+	}
+	for e := mc.lru.Front(); e != nil; {
+		next := e.Next()
+		if purge[e.Value.(*memoryEntry).output] {
+			mc.remove(e)
+		}
+		e = next
+	}
+	for output := range purge {
+		delete(mc.stats, output)
+	}
+	return nil
+}
+
+// Each implements Cache. Rows are visited from the least to the most
+// recently used.
+func (mc *MemoryCache) Each(fn func(output string, typeShape, key, data []byte) error) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for e := mc.lru.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*memoryEntry)
+		key := []byte(entry.key[len(entry.output)+1:])
+		if err := fn(entry.output, mc.typeShapes[entry.output], key, entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// Close implements Cache.
+func (mc *MemoryCache) Close() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.typeShapes = map[string][]byte{}
+	mc.rows = map[string]*list.Element{}
+	mc.lru.Init()
+	mc.stats = map[string]CacheStats{}
+	mc.size = 0
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
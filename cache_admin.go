@@ -0,0 +1,374 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	archiveMagic  = "GPCACHE\x01"
+	archiveEnd    = byte(0)
+	archiveOutput = byte(1)
+	archiveRow    = byte(2)
+	// importBatch is how many rows are put in the cache at once
+	importBatch = 1000
+	// maxArchiveField bounds the fields of an archive, so that a corrupt
+	// archive can not make us allocate too much
+	maxArchiveField = 1 << 30
+)
+
+// ErrModelMismatch is returned when importing a cache archive that was
+// exported for a different model.
+var ErrModelMismatch = errors.New("Cache archive is for a different model")
+
+// ExportCache writes every row in cache to w as a gzipped archive that
+// ImportCache can load into any Cache, for example to warm up a new
+// replica. modelID is recorded so that archives are not loaded for other
+// models.
+func ExportCache(w io.Writer, cache Cache, modelID string) error {
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	bw.WriteString(archiveMagic)
+	writeField(bw, []byte(modelID))
+	last := ""
+	first := true
+	err := cache.Each(func(output string, typeShape, key, data []byte) error {
+		if first || output != last {
+			bw.WriteByte(archiveOutput)
+			writeField(bw, []byte(output))
+			writeField(bw, typeShape)
+			last, first = output, false
+		}
+		bw.WriteByte(archiveRow)
+		writeField(bw, key)
+		return writeField(bw, data)
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteByte(archiveEnd)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ImportCache loads an archive written by ExportCache into cache and
+// returns the number of rows loaded. It returns ErrModelMismatch if the
+// archive was exported for another model. If outputs is not empty, rows
+// for any other output are rejected, as are rows for outputs already
+// cached with a different type and shape.
+func ImportCache(r io.Reader, cache Cache, modelID string, outputs []string) (rows int, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(zr)
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != archiveMagic {
+		return 0, fmt.Errorf("Not a cache archive")
+	}
+	id, err := readField(br, maxArchiveField)
+	if err != nil {
+		return 0, err
+	}
+	if string(id) != modelID {
+		return 0, ErrModelMismatch
+	}
+
+	output := ""
+	var typeShape []byte
+	keys := [][]byte{}
+	data := [][]byte{}
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := cache.Put([]string{output}, [][]byte{typeShape}, keys, [][][]byte{data}); err != nil {
+			return err
+		}
+		rows += len(keys)
+		keys, data = [][]byte{}, [][]byte{}
+		return nil
+	}
+	for {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return rows, err
+		}
+		switch kind {
+		case archiveEnd:
+			return rows, flush()
+		case archiveOutput:
+			if err := flush(); err != nil {
+				return rows, err
+			}
+			name, err := readField(br, maxArchiveField)
+			if err != nil {
+				return rows, err
+			}
+			if typeShape, err = readField(br, maxArchiveField); err != nil {
+				return rows, err
+			}
+			output = string(name)
+			if err := checkImportOutput(cache, output, typeShape, outputs); err != nil {
+				return rows, err
+			}
+		case archiveRow:
+			if typeShape == nil {
+				return rows, fmt.Errorf("Cache archive has a row before its output")
+			}
+			key, err := readField(br, maxArchiveField)
+			if err != nil {
+				return rows, err
+			}
+			if string(key) == tsKey {
+				return rows, fmt.Errorf("Cache archive has a row with the reserved key '%s'", tsKey)
+			}
+			row, err := readField(br, maxArchiveField)
+			if err != nil {
+				return rows, err
+			}
+			keys = append(keys, key)
+			data = append(data, row)
+			if len(keys) == importBatch {
+				if err := flush(); err != nil {
+					return rows, err
+				}
+			}
+		default:
+			return rows, fmt.Errorf("Cache archive is corrupt")
+		}
+	}
+}
+
+// checkImportOutput checks that the rows of an output in an archive can be
+// stored under its name.
+func checkImportOutput(cache Cache, output string, typeShape []byte, outputs []string) error {
+	if output == "" || output == boltMetaBucket {
+		return fmt.Errorf("Cache archive has the reserved output name '%s'", output)
+	}
+	if len(outputs) > 0 {
+		known := false
+		for _, name := range outputs {
+			if cacheOutput(output) == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("Cache archive has unknown output '%s'", output)
+		}
+	}
+	typeShapes, _, err := cache.Get([]string{output}, nil)
+	if err != nil {
+		return err
+	}
+	if typeShapes[0] != nil && !bytes.Equal(typeShapes[0], typeShape) {
+		return fmt.Errorf("Cache archive has a different type or shape for output '%s'", output)
+	}
+	return nil
+}
+
+func writeField(w *bufio.Writer, b []byte) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutUvarint(buf, uint64(len(b)))])
+	_, err := w.Write(b)
+	return err
+}
+
+func readField(r *bufio.Reader, max uint64) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("Field of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// cacheOutput returns the output that a cache bucket belongs to, since
+// each config has its own buckets.
+func cacheOutput(bucket string) string {
+	if i := strings.LastIndex(bucket, " (config "); i >= 0 && strings.HasSuffix(bucket, ")") {
+		return bucket[:i]
+	}
+	return bucket
+}
+
+func setupCacheRoutes(c *appContext) {
+	http.Handle("/control/cache/stats", appHandler{c, adminOnly(cacheStatsHandler, false)})
+	http.Handle("/control/cache/purge", appHandler{c, adminOnly(cachePurgeHandler, true)})
+	http.Handle("/control/cache/export", appHandler{c, adminOnly(cacheExportHandler, true)})
+	http.Handle("/control/cache/import", appHandler{c, adminOnly(cacheImportHandler, true)})
+	if pc, ok := c.cache.(*PeerCache); ok {
+		http.Handle(peerPath, pc)
+	}
+}
+
+// adminOnly checks for the admin token as a bearer token. Once a token is
+// set every route needs it. Without one the write handlers are disabled,
+// but the read only ones are deliberately open to everyone, so that the
+// stats can be monitored. They only hold counts and sizes, never inputs or
+// results.
+func adminOnly(h func(*appContext, http.ResponseWriter, *http.Request) error, write bool) func(*appContext, http.ResponseWriter, *http.Request) error {
+	return func(c *appContext, w http.ResponseWriter, r *http.Request) error {
+		if c.cache == nil {
+			return StatusError{404, errors.New("caching is not enabled")}
+		}
+		if c.adminToken == "" {
+			if write {
+				return StatusError{403, errors.New("cache administration needs an admin token")}
+			}
+			return h(c, w, r)
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return StatusError{401, errors.New("invalid admin token")}
+		}
+		return h(c, w, r)
+	}
+}
+
+type cacheStatsResponse struct {
+	Entries  int64                 `json:"entries"`
+	Bytes    int64                 `json:"bytes"`
+	Hits     int64                 `json:"hits"`
+	Misses   int64                 `json:"misses"`
+	HitRatio float64               `json:"hit_ratio"`
+	Queued   int64                 `json:"queued"`
+	Dropped  int64                 `json:"dropped"`
+	Outputs  map[string]CacheStats `json:"outputs"`
+}
+
+func cacheStatsHandler(c *appContext, w http.ResponseWriter, r *http.Request) error {
+	stats, err := c.cache.Stats()
+	if err != nil {
+		return err
+	}
+	res := cacheStatsResponse{
+		Hits:    atomic.LoadInt64(&c.cacheHits),
+		Misses:  atomic.LoadInt64(&c.cacheMisses),
+		Queued:  int64(c.cacheWriter().queued()),
+		Dropped: atomic.LoadInt64(&c.cacheWriter().dropped),
+		Outputs: stats,
+	}
+	for _, s := range stats {
+		res.Entries += s.Entries
+		res.Bytes += s.Bytes
+	}
+	if res.Hits+res.Misses > 0 {
+		res.HitRatio = float64(res.Hits) / float64(res.Hits+res.Misses)
+	}
+	js, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+	return nil
+}
+
+// cachePurgeHandler removes everything, or with ?output=name every bucket
+// of that output.
+func cachePurgeHandler(c *appContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return StatusError{405, errors.New("purge needs a POST")}
+	}
+	outputs := []string{}
+	if name := r.URL.Query().Get("output"); name != "" {
+		stats, err := c.cache.Stats()
+		if err != nil {
+			return err
+		}
+		for bucket := range stats {
+			if cacheOutput(bucket) == name {
+				outputs = append(outputs, bucket)
+			}
+		}
+		if len(outputs) == 0 {
+			return StatusError{404, fmt.Errorf("output '%s' is not cached", name)}
+		}
+	}
+	// rows waiting to be cached would come back after the purge
+	c.cacheWriter().flush()
+	if err := c.cache.Purge(outputs); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "purged\n")
+	return nil
+}
+
+func cacheExportHandler(c *appContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return StatusError{405, errors.New("export needs a GET")}
+	}
+	c.cacheWriter().flush()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"cache.gpc\"")
+	cw := &countingWriter{w: w}
+	if err := ExportCache(cw, c.cache, c.modelID); err != nil {
+		if cw.n == 0 {
+			w.Header().Del("Content-Disposition")
+			return err
+		}
+		// the archive is streamed, so once part of it is sent the only
+		// way to report the error is to cut the response short
+		logrus.Errorf("Failed to export the cache after %d bytes: %v", cw.n, err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func cacheImportHandler(c *appContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return StatusError{405, errors.New("import needs a POST")}
+	}
+	outputs := []string{}
+	if c.meta != nil {
+		for _, out := range c.meta.Outputs {
+			outputs = append(outputs, out.Name)
+		}
+	}
+	rows, err := ImportCache(r.Body, c.cache, c.modelID, outputs)
+	if err != nil {
+		return StatusError{400, err}
+	}
+	fmt.Fprintf(w, "imported %d rows\n", rows)
+	return nil
+}
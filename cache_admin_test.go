@@ -0,0 +1,257 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func adminRequest(c *appContext, h func(*appContext, http.ResponseWriter, *http.Request) error, write bool, method, url, token string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	appHandler{c, adminOnly(h, write)}.ServeHTTP(w, r)
+	return w
+}
+
+func fillAdminCache(cache Cache) {
+	ts := [][]byte{{1}, {2}, {3}}
+	keys := [][]byte{[]byte("k1"), []byte("k2")}
+	data := [][][]byte{
+		{[]byte("a1"), []byte("a2")},
+		{[]byte("c1"), []byte("c2")},
+		{[]byte("b1"), []byte("b2")},
+	}
+	cache.Put([]string{"a", "a (config 0011223344556677)", "b"}, ts, keys, data)
+}
+
+func cachedBuckets(t *testing.T, cache Cache) []string {
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := []string{}
+	for bucket, s := range stats {
+		if s.Entries > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+func TestCacheStatsHandler(t *testing.T) {
+	c := &appContext{}
+	w := adminRequest(c, cacheStatsHandler, false, "GET", "/control/cache/stats", "", nil)
+	if w.Code != 404 {
+		t.Errorf("Expected a 404 without a cache, got %d", w.Code)
+	}
+
+	c.cache = NewMemoryCache(1 << 20)
+	c.cache.Put([]string{"a", "b"}, [][]byte{{1}, {2}}, [][]byte{[]byte("key")}, [][][]byte{{[]byte("x")}, {[]byte("yy")}})
+	c.cacheHits, c.cacheMisses = 3, 1
+	w = adminRequest(c, cacheStatsHandler, false, "GET", "/control/cache/stats", "", nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected a 200, got %d: %s", w.Code, w.Body)
+	}
+	res := cacheStatsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	expected := cacheStatsResponse{
+		Entries:  2,
+		Bytes:    13,
+		Hits:     3,
+		Misses:   1,
+		HitRatio: 0.75,
+		Outputs:  map[string]CacheStats{"a": {1, 6}, "b": {1, 7}},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected %v, got %v", expected, res)
+	}
+}
+
+func TestCacheAdminAuth(t *testing.T) {
+	c := &appContext{cache: NewMemoryCache(1 << 20)}
+	if w := adminRequest(c, cachePurgeHandler, true, "POST", "/control/cache/purge", "", nil); w.Code != 403 {
+		t.Errorf("Expected a 403 without an admin token, got %d", w.Code)
+	}
+
+	c.adminToken = "secret"
+	for token, code := range map[string]int{"": 401, "wrong": 401, "secret": 200} {
+		if w := adminRequest(c, cacheStatsHandler, false, "GET", "/control/cache/stats", token, nil); w.Code != code {
+			t.Errorf("Expected a %d for token '%s', got %d", code, token, w.Code)
+		}
+	}
+}
+
+func TestCachePurgeHandler(t *testing.T) {
+	bc, cleanup := newTestBoltCache(t, nil)
+	defer cleanup()
+	for _, cache := range []Cache{NewMemoryCache(1 << 20), bc} {
+		c := &appContext{cache: cache, adminToken: "secret"}
+		fillAdminCache(cache)
+		if w := adminRequest(c, cachePurgeHandler, true, "GET", "/control/cache/purge", "secret", nil); w.Code != 405 {
+			t.Errorf("Expected a 405 for a GET, got %d", w.Code)
+		}
+		if w := adminRequest(c, cachePurgeHandler, true, "POST", "/control/cache/purge?output=c", "secret", nil); w.Code != 404 {
+			t.Errorf("Expected a 404 for an unknown output, got %d", w.Code)
+		}
+
+		// purging an output purges it for every config
+		if w := adminRequest(c, cachePurgeHandler, true, "POST", "/control/cache/purge?output=a", "secret", nil); w.Code != 200 {
+			t.Fatalf("Expected a 200, got %d: %s", w.Code, w.Body)
+		}
+		if buckets := cachedBuckets(t, cache); !reflect.DeepEqual(buckets, []string{"b"}) {
+			t.Errorf("Expected only b to be left, got %v", buckets)
+		}
+		if w := adminRequest(c, cachePurgeHandler, true, "POST", "/control/cache/purge", "secret", nil); w.Code != 200 {
+			t.Fatalf("Expected a 200, got %d: %s", w.Code, w.Body)
+		}
+		if buckets := cachedBuckets(t, cache); len(buckets) != 0 {
+			t.Errorf("Expected an empty cache, got %v", buckets)
+		}
+	}
+}
+
+func TestCacheExportImport(t *testing.T) {
+	bc, cleanup := newTestBoltCache(t, nil)
+	defer cleanup()
+	fillAdminCache(bc)
+	src := &appContext{cache: bc, adminToken: "secret", modelID: "model"}
+	w := adminRequest(src, cacheExportHandler, true, "GET", "/control/cache/export", "secret", nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected a 200, got %d: %s", w.Code, w.Body)
+	}
+	archive := w.Body.Bytes()
+
+	meta := &NativeMetadataResponse{Outputs: []NativeIOMetadata{{Name: "a"}, {Name: "b"}}}
+	dst := &appContext{cache: NewMemoryCache(1 << 20), adminToken: "secret", modelID: "model", meta: meta}
+	w = adminRequest(dst, cacheImportHandler, true, "POST", "/control/cache/import", "secret", bytes.NewReader(archive))
+	if w.Code != 200 || w.Body.String() != "imported 6 rows\n" {
+		t.Fatalf("Expected 6 rows to be imported, got %d: %s", w.Code, w.Body)
+	}
+	typeShapes, data, err := dst.cache.Get([]string{"a (config 0011223344556677)"}, [][]byte{[]byte("k1"), []byte("k2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(typeShapes[0], []byte{2}) || string(data[0][0]) != "c1" || string(data[0][1]) != "c2" {
+		t.Errorf("Unexpected imported rows %q %q", typeShapes, data)
+	}
+
+	other := &appContext{cache: NewMemoryCache(1 << 20), adminToken: "secret", modelID: "other"}
+	w = adminRequest(other, cacheImportHandler, true, "POST", "/control/cache/import", "secret", bytes.NewReader(archive))
+	if w.Code != 400 {
+		t.Errorf("Expected a 400 for another model, got %d", w.Code)
+	}
+	w = adminRequest(other, cacheImportHandler, true, "POST", "/control/cache/import", "secret", bytes.NewReader([]byte("junk")))
+	if w.Code != 400 {
+		t.Errorf("Expected a 400 for junk, got %d", w.Code)
+	}
+
+	// rows are only counted once they are in the cache
+	rows, err := ImportCache(bytes.NewReader(archive), failingCache{NewMemoryCache(1 << 20)}, "model", nil)
+	if err == nil || rows != 0 {
+		t.Errorf("Expected no rows and an error, got %d, %v", rows, err)
+	}
+}
+
+func TestCacheImportChecks(t *testing.T) {
+	ts := [][]byte{{1}}
+	keys := [][]byte{[]byte("k")}
+	data := [][][]byte{{[]byte("v")}}
+	archive := func(output string, keys [][]byte) []byte {
+		cache := NewMemoryCache(1 << 20)
+		cache.Put([]string{output}, ts, keys, data)
+		buf := &bytes.Buffer{}
+		if err := ExportCache(buf, cache, "model"); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	existing := NewMemoryCache(1 << 20)
+	existing.Put([]string{"b"}, [][]byte{{2}}, keys, data)
+
+	tests := []struct {
+		archive []byte
+		cache   Cache
+		fails   bool
+	}{
+		{archive("a", keys), NewMemoryCache(1 << 20), false},
+		{archive("a (config 0011223344556677)", keys), NewMemoryCache(1 << 20), false},
+		{archive("c", keys), NewMemoryCache(1 << 20), true},
+		{archive(boltMetaBucket, keys), NewMemoryCache(1 << 20), true},
+		{archive("a", [][]byte{[]byte(tsKey)}), NewMemoryCache(1 << 20), true},
+		// the type and shape must match what is already cached
+		{archive("b", keys), existing, true},
+	}
+	for i, test := range tests {
+		rows, err := ImportCache(bytes.NewReader(test.archive), test.cache, "model", []string{"a", "b"})
+		if test.fails {
+			if err == nil || rows != 0 {
+				t.Errorf("Test %d: expected an error, got %d rows", i, rows)
+			}
+		} else if err != nil || rows != 1 {
+			t.Errorf("Test %d: expected a row, got %d, %v", i, rows, err)
+		}
+	}
+}
+
+// eachCache is a Cache that visits rows of count random bytes and then
+// fails.
+type eachCache struct {
+	*MemoryCache
+	count int
+}
+
+func (c eachCache) Each(fn func(output string, typeShape, key, data []byte) error) error {
+	for i := 0; i < c.count; i++ {
+		data := make([]byte, 1024)
+		rand.Read(data)
+		if err := fn("a", []byte{1}, []byte(fmt.Sprint(i)), data); err != nil {
+			return err
+		}
+	}
+	return errors.New("failed")
+}
+
+func TestCacheExportFailure(t *testing.T) {
+	// errors before anything is sent get an error response
+	c := &appContext{cache: eachCache{NewMemoryCache(1 << 20), 0}, adminToken: "secret"}
+	if w := adminRequest(c, cacheExportHandler, true, "GET", "/control/cache/export", "secret", nil); w.Code != 500 {
+		t.Errorf("Expected a 500, got %d", w.Code)
+	}
+
+	// later errors abort the response
+	c.cache = eachCache{NewMemoryCache(1 << 20), 1000}
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("Expected the export to be aborted, got %v", r)
+		}
+	}()
+	adminRequest(c, cacheExportHandler, true, "GET", "/control/cache/export", "secret", nil)
+}
+
+// failingCache is a Cache that can not store anything.
+type failingCache struct {
+	*MemoryCache
+}
+
+func (failingCache) Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	return errors.New("failed")
+}
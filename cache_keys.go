@@ -0,0 +1,135 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"hash/crc64"
+	"io"
+	"runtime"
+	"sync"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// minParallelRows is the smallest batch whose keys are hashed by more
+// than one worker, since smaller ones are not worth the goroutines.
+const minParallelRows = 64
+
+var (
+	isoTable  = crc64.MakeTable(crc64.ISO)
+	ecmaTable = crc64.MakeTable(crc64.ECMA)
+)
+
+// crc128 is a fast non-cryptographic hash made of two 64 bit crcs with
+// different polynomials. It is only safe for non-adversarial inputs: crcs
+// are linear, so anyone who can choose the inputs can make rows collide
+// with little effort, and even for ordinary inputs it gives no guarantee
+// of 128 bit collision resistance.
+type crc128 struct {
+	iso  hash.Hash64
+	ecma hash.Hash64
+}
+
+func newCRC128() hash.Hash {
+	return &crc128{crc64.New(isoTable), crc64.New(ecmaTable)}
+}
+
+func (h *crc128) Write(p []byte) (int, error) {
+	h.iso.Write(p)
+	return h.ecma.Write(p)
+}
+
+func (h *crc128) Sum(b []byte) []byte {
+	return h.ecma.Sum(h.iso.Sum(b))
+}
+
+func (h *crc128) Reset() {
+	h.iso.Reset()
+	h.ecma.Reset()
+}
+
+func (h *crc128) Size() int      { return 16 }
+func (h *crc128) BlockSize() int { return 1 }
+
+// keyHash returns the hash that cache keys are made with.
+func keyHash(c *appContext) func() hash.Hash {
+	if c.fastCacheKeys {
+		return newCRC128
+	}
+	return sha512.New
+}
+
+// writeKey writes everything that identifies a row of inputs to h. Row
+// data is hashed in place, and the strings of a row are hashed as if they
+// were encoded with encodeStrs.
+func writeKey(h hash.Hash, salt []byte, inputs []*Nt, index int, buf []byte) {
+	h.Write(salt)
+	if len(inputs) == 0 {
+		h.Write([]byte(emptyKey))
+	}
+	for _, in := range inputs {
+		h.Write(in.name)
+		h.Write(in.typeShape[0:8])
+		// skip the batch dimension
+		if len(in.typeShape) > 16 {
+			h.Write(in.typeShape[16:])
+		}
+		if in.tensor.Type != graphpipefb.TypeString {
+			h.Write(in.tensor.Data[index*in.dlen : (index+1)*in.dlen])
+			continue
+		}
+		vals := in.tensor.StringVals[index*in.dlen : (index+1)*in.dlen]
+		for _, s := range vals {
+			h.Write(buf[:binary.PutUvarint(buf, uint64(len(s)))])
+		}
+		for _, s := range vals {
+			io.WriteString(h, s)
+		}
+	}
+}
+
+// hashKeys returns the cache key of each row. The rows are split into
+// contiguous ranges that a worker per cpu hashes, each with one hash and
+// one allocation for all of its keys.
+func hashKeys(newHash func() hash.Hash, salt []byte, inputs []*Nt, numChunks int) [][]byte {
+	keys := make([][]byte, numChunks)
+	hashRange := func(lo, hi int) {
+		h := newHash()
+		size := h.Size()
+		sums := make([]byte, 0, (hi-lo)*size)
+		buf := make([]byte, binary.MaxVarintLen64)
+		for i := lo; i < hi; i++ {
+			h.Reset()
+			writeKey(h, salt, inputs, i, buf)
+			sums = h.Sum(sums)
+			keys[i] = sums[len(sums)-size : len(sums) : len(sums)]
+		}
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if numChunks < minParallelRows || workers == 1 {
+		hashRange(0, numChunks)
+		return keys
+	}
+	per := (numChunks + workers - 1) / workers
+	var wg sync.WaitGroup
+	for lo := 0; lo < numChunks; lo += per {
+		hi := lo + per
+		if hi > numChunks {
+			hi = numChunks
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			hashRange(lo, hi)
+		}(lo, hi)
+	}
+	wg.Wait()
+	return keys
+}
@@ -0,0 +1,180 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"sync"
+	"testing"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// hashKeysPerRow is how keys used to be made, with a goroutine per row
+// and a copy of the strings of each row, for comparison.
+func hashKeysPerRow(salt []byte, inputs []*Nt, numChunks int) [][]byte {
+	type hashPair struct {
+		index int
+		hash  []byte
+	}
+	keys := make([][]byte, numChunks)
+	ch := make(chan hashPair, numChunks)
+	var wg sync.WaitGroup
+	wg.Add(numChunks)
+	for i := 0; i < numChunks; i++ {
+		go func(i int) {
+			h := sha512.New()
+			h.Write(salt)
+			for _, in := range inputs {
+				h.Write(in.name)
+				h.Write(in.typeShape[0:8])
+				if len(in.typeShape) > 16 {
+					h.Write(in.typeShape[16:])
+				}
+				h.Write(in.data(i))
+			}
+			ch <- hashPair{i, h.Sum(nil)}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	close(ch)
+	for elem := range ch {
+		keys[elem.index] = elem.hash
+	}
+	return keys
+}
+
+func keyInputs(rows int) []*Nt {
+	floats := makeTensor(rows, 0, graphpipefb.TypeFloat32)
+	strs := makeTensor(rows, rows*8, graphpipefb.TypeString)
+	return []*Nt{newNt(floats, "a", rows), newNt(strs, "b", rows)}
+}
+
+func TestHashKeys(t *testing.T) {
+	salt := keySalt("model", "config")
+	for _, rows := range []int{1, minParallelRows * 3} {
+		inputs := keyInputs(rows)
+		// the keys are the same as they have always been
+		expected := hashKeysPerRow(salt, inputs, rows)
+		keys := hashKeys(sha512.New, salt, inputs, rows)
+		for i := range keys {
+			if !bytes.Equal(keys[i], expected[i]) {
+				t.Fatalf("Key %d of %d rows changed", i, rows)
+			}
+		}
+	}
+}
+
+func TestFastCacheKeys(t *testing.T) {
+	tp := makeTensor(minParallelRows, 0, graphpipefb.TypeFloat32)
+	twice, _ := Concat([]*NativeTensor{tp, tp})
+	rows := int(twice.Shape[0])
+	keys := hashKeys(newCRC128, nil, []*Nt{newNt(twice, "a", rows)}, rows)
+	seen := map[string]int{}
+	for i, key := range keys {
+		if len(key) != 16 {
+			t.Fatalf("Expected 16 byte keys, got %d", len(key))
+		}
+		seen[string(key)] = i
+	}
+	if len(seen) != rows/2 {
+		t.Errorf("Expected %d distinct keys, got %d", rows/2, len(seen))
+	}
+	if !bytes.Equal(keys[0], keys[rows/2]) {
+		t.Errorf("Expected the same rows to have the same key")
+	}
+
+	// results are cached under the fast keys
+	c := &appContext{cache: NewMemoryCache(1 << 20), fastCacheKeys: true}
+	applied := 0
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		applied++
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	for i := 0; i < 2; i++ {
+		results, err := getResultsCached(c, rc, makeRequestRaw(tp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(results[0].Data, tp.Data) {
+			t.Errorf("Results are not the same as the input")
+		}
+		c.cacheWriter().flush()
+		waitForDups(t, &c.flights, 0)
+	}
+	if applied != 1 {
+		t.Errorf("Expected the second request to be cached, got %d applies", applied)
+	}
+}
+
+const benchKeyRows = 10000
+
+func benchHashKeys(b *testing.B, hashKeys func(salt []byte, inputs []*Nt, numChunks int) [][]byte) {
+	inputs := keyInputs(benchKeyRows)
+	salt := keySalt("", "")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hashKeys(salt, inputs, benchKeyRows)
+	}
+}
+
+func BenchmarkHashKeysPerRow(b *testing.B) {
+	benchHashKeys(b, hashKeysPerRow)
+}
+
+func BenchmarkHashKeys(b *testing.B) {
+	benchHashKeys(b, func(salt []byte, inputs []*Nt, numChunks int) [][]byte {
+		return hashKeys(sha512.New, salt, inputs, numChunks)
+	})
+}
+
+func BenchmarkHashKeysFast(b *testing.B) {
+	benchHashKeys(b, func(salt []byte, inputs []*Nt, numChunks int) [][]byte {
+		return hashKeys(newCRC128, salt, inputs, numChunks)
+	})
+}
+
+// benchLargeBatch measures requests for a large batch that is already
+// cached, or with no cache at all.
+func benchLargeBatch(b *testing.B, cache Cache, fast bool) {
+	tp := makeTensor(benchKeyRows, 0, graphpipefb.TypeFloat32)
+	c := &appContext{cache: cache, fastCacheKeys: fast}
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+	req := makeRequestRaw(tp)
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	get := getResults
+	if cache != nil {
+		get = getResultsCached
+		get(c, rc, req)
+		c.cacheWriter().flush()
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := get(c, rc, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLargeBatchUncached(b *testing.B) {
+	benchLargeBatch(b, nil, false)
+}
+
+func BenchmarkLargeBatchCached(b *testing.B) {
+	benchLargeBatch(b, NewMemoryCache(1<<30), false)
+}
+
+func BenchmarkLargeBatchCachedFast(b *testing.B) {
+	benchLargeBatch(b, NewMemoryCache(1<<30), true)
+}
@@ -0,0 +1,402 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// notifyCache signals after each Put, since results are cached in the
+// background.
+type notifyCache struct {
+	Cache
+	put chan bool
+}
+
+func (nc *notifyCache) Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	err := nc.Cache.Put(outputs, typeShapes, keys, data)
+	nc.put <- true
+	return err
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	mc := NewMemoryCache(40)
+	ts := [][]byte{[]byte("ts")}
+	row := func(b byte) [][][]byte {
+		return [][][]byte{{bytes.Repeat([]byte{b}, 10)}}
+	}
+	for _, k := range []byte("abc") {
+		if err := mc.Put([]string{"out"}, ts, [][]byte{{k}}, row(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each row takes 15 bytes, so only two fit and "a" is evicted
+	typeShapes, data, err := mc.Get([]string{"out", "other"}, [][]byte{{'a'}, {'b'}, {'c'}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(typeShapes[0]) != "ts" || typeShapes[1] != nil {
+		t.Errorf("Unexpected type shapes %q", typeShapes)
+	}
+	if data[0][0] != nil || data[0][1] == nil || data[0][2] == nil {
+		t.Errorf("Expected only 'a' to be evicted, got %q", data[0])
+	}
+
+	// reading "b" makes "c" the least recently used
+	mc.Get([]string{"out"}, [][]byte{{'b'}})
+	mc.Put([]string{"out"}, ts, [][]byte{{'d'}}, row('d'))
+	_, data, _ = mc.Get([]string{"out"}, [][]byte{{'b'}, {'c'}, {'d'}})
+	if data[0][0] == nil || data[0][1] != nil || data[0][2] == nil {
+		t.Errorf("Expected only 'c' to be evicted, got %q", data[0])
+	}
+
+	// rows larger than the cache are not stored
+	mc.Put([]string{"out"}, ts, [][]byte{{'e'}}, [][][]byte{{make([]byte, 100)}})
+	_, data, _ = mc.Get([]string{"out"}, [][]byte{{'e'}})
+	if data[0][0] != nil {
+		t.Errorf("Expected a row larger than the cache to be skipped")
+	}
+}
+
+func newTestBoltCache(t *testing.T, opts *BoltCacheOptions) (*BoltCache, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewBoltCache(filepath.Join(dir, "test.db"), opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return bc, func() {
+		bc.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltCacheExpiry(t *testing.T) {
+	bc, cleanup := newTestBoltCache(t, &BoltCacheOptions{TTL: 50 * time.Millisecond, CompactInterval: time.Hour})
+	defer cleanup()
+
+	ts := [][]byte{[]byte("ts")}
+	keys := [][]byte{[]byte("a")}
+	bc.Put([]string{"out"}, ts, keys, [][][]byte{{[]byte("row")}})
+	_, data, err := bc.Get([]string{"out"}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0][0]) != "row" {
+		t.Fatalf("Expected 'row', got %q", data[0][0])
+	}
+	time.Sleep(60 * time.Millisecond)
+	_, data, _ = bc.Get([]string{"out"}, keys)
+	if data[0][0] != nil {
+		t.Errorf("Expected the row to expire, got %q", data[0][0])
+	}
+	if err := bc.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := bc.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["out"] != (CacheStats{}) {
+		t.Errorf("Expected compaction to remove the row, got %v", stats)
+	}
+}
+
+func TestBoltCacheMaxBytes(t *testing.T) {
+	// each row takes 1 byte of key, 8 of timestamp and 10 of data
+	bc, cleanup := newTestBoltCache(t, &BoltCacheOptions{MaxBytes: 40, CompactInterval: time.Hour})
+	defer cleanup()
+
+	ts := [][]byte{[]byte("ts")}
+	for _, k := range []byte("abc") {
+		bc.Put([]string{"out"}, ts, [][]byte{{k}}, [][][]byte{{bytes.Repeat([]byte{k}, 10)}})
+		time.Sleep(time.Millisecond)
+	}
+	// reading "a" makes "b" the least recently used
+	bc.Get([]string{"out"}, [][]byte{{'a'}})
+	if err := bc.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := bc.Get([]string{"out"}, [][]byte{{'a'}, {'b'}, {'c'}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0][0] == nil || data[0][1] != nil || data[0][2] == nil {
+		t.Errorf("Expected only 'b' to be evicted, got %q", data[0])
+	}
+	stats, _ := bc.Stats()
+	if stats["out"] != (CacheStats{Entries: 2, Bytes: 38}) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+// fillBoltCache puts n rows of 1KB into output.
+func fillBoltCache(t *testing.T, bc *BoltCache, output string, n int) {
+	keys := make([][]byte, n)
+	data := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%s-%06d", output, i))
+		data[i] = make([]byte, 1024)
+	}
+	if err := bc.Put([]string{output}, [][]byte{[]byte("ts")}, keys, [][][]byte{data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestBoltCacheRewrite(t *testing.T) {
+	bc, cleanup := newTestBoltCache(t, &BoltCacheOptions{TTL: 50 * time.Millisecond, CompactInterval: time.Hour})
+	defer cleanup()
+
+	// more rows than a compaction batch
+	fillBoltCache(t, bc, "old", 2*compactBatch+10)
+	time.Sleep(60 * time.Millisecond)
+	fillBoltCache(t, bc, "new", 10)
+	full := fileSize(t, bc.path)
+
+	// purging a small output frees too little to rewrite the file
+	fillBoltCache(t, bc, "small", 1)
+	if err := bc.Purge([]string{"small"}); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, bc.path); size < full {
+		t.Errorf("Expected the file not to be rewritten, it shrank from %d to %d", full, size)
+	}
+
+	if err := bc.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, bc.path); size*2 > full {
+		t.Errorf("Expected the file to be rewritten, it went from %d to %d", full, size)
+	}
+	stats, err := bc.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["old"].Entries != 0 || stats["new"].Entries != 10 {
+		t.Errorf("Expected only the new rows to be kept, got %v", stats)
+	}
+}
+
+func TestBoltCacheRewriteFailure(t *testing.T) {
+	bc, cleanup := newTestBoltCache(t, &BoltCacheOptions{TTL: 50 * time.Millisecond, CompactInterval: time.Hour})
+	defer cleanup()
+	defer func() { renameFile = os.Rename }()
+
+	fillBoltCache(t, bc, "old", 1000)
+	time.Sleep(60 * time.Millisecond)
+
+	// a failed rename leaves the old file open and removes the new one
+	renameFile = func(from, to string) error {
+		return fmt.Errorf("rename failed")
+	}
+	if err := bc.Compact(); err == nil {
+		t.Fatal("Expected the rename to fail")
+	}
+	if _, err := os.Stat(bc.path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be removed, got %v", err)
+	}
+	fillBoltCache(t, bc, "new", 1)
+	if stats, err := bc.Stats(); err != nil || stats["new"].Entries != 1 {
+		t.Errorf("Expected the cache to be usable, got %v %v", stats, err)
+	}
+
+	// if the file can not be reopened the cache reports it until it can
+	fillBoltCache(t, bc, "old", 1000)
+	time.Sleep(60 * time.Millisecond)
+	renameFile = func(from, to string) error {
+		os.Remove(from)
+		os.Remove(to)
+		return os.Mkdir(to, 0700)
+	}
+	if err := bc.Compact(); err == nil {
+		t.Fatal("Expected the reopen to fail")
+	}
+	if _, err := bc.Stats(); err == nil {
+		t.Errorf("Expected a broken cache to return an error")
+	}
+	if err := bc.Put([]string{"new"}, [][]byte{[]byte("ts")}, [][]byte{[]byte("k")}, [][][]byte{{[]byte("v")}}); err == nil {
+		t.Errorf("Expected a broken cache to fail puts")
+	}
+	if err := bc.Compact(); err == nil {
+		t.Errorf("Expected the cache to stay broken")
+	}
+	renameFile = os.Rename
+	os.Remove(bc.path)
+	if err := bc.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	fillBoltCache(t, bc, "new", 1)
+	if stats, err := bc.Stats(); err != nil || stats["new"].Entries != 1 {
+		t.Errorf("Expected the cache to recover, got %v %v", stats, err)
+	}
+}
+
+func testCachedResults(t *testing.T, cache Cache) {
+	nc := &notifyCache{cache, make(chan bool, 1)}
+	c := &appContext{cache: nc}
+	applied := []int64{}
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, outputNames []string) ([]*NativeTensor, error) {
+		in := inputs["some/input/name:0"]
+		applied = append(applied, in.Shape[0])
+		return []*NativeTensor{in, in}, nil
+	}
+
+	tp1 := makeTensor(10, 0, graphpipefb.TypeFloat32)
+	tp2 := makeTensor(10, 0, graphpipefb.TypeFloat32)
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	results, err := getResultsCached(c, rc, makeRequestRaw(tp1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-nc.put
+	if !bytes.Equal(results[1].Data, tp1.Data) {
+		t.Errorf("Results are not the same as the input")
+	}
+
+	// only the new rows are computed
+	both, err := Concat([]*NativeTensor{tp1, tp2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = getResultsCached(c, rc, makeRequestRaw(both))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-nc.put
+	if !bytes.Equal(results[0].Data, both.Data) || results[0].Shape[0] != 20 {
+		t.Errorf("Results are not the same as the input")
+	}
+
+	// everything is cached now
+	if _, err = getResultsCached(c, rc, makeRequestRaw(tp2)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, []int64{10, 10}) {
+		t.Errorf("Expected apply on [10 10] rows, got %v", applied)
+	}
+}
+
+func TestMemoryCacheResults(t *testing.T) {
+	testCachedResults(t, NewMemoryCache(1<<20))
+}
+
+func TestBoltCacheResults(t *testing.T) {
+	bc, cleanup := newTestBoltCache(t, nil)
+	defer cleanup()
+	testCachedResults(t, bc)
+}
+
+func makeConfigRequest(tp *NativeTensor, config string) *graphpipefb.InferRequest {
+	req := NewInferRequest().Input("x", tp).Output("y").Config(config)
+	builder := fb.NewBuilder(1024)
+	offset, err := req.Build(builder)
+	if err != nil {
+		panic(err)
+	}
+	return graphpipefb.GetRootAsInferRequest(Serialize(builder, offset), 0)
+}
+
+func TestCachedResultsConfigAndModel(t *testing.T) {
+	nc := &notifyCache{NewMemoryCache(1 << 20), make(chan bool, 1)}
+	c := &appContext{cache: nc, modelID: "model-a"}
+	applied := []string{}
+	c.apply = func(_ *RequestContext, config string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		applied = append(applied, config)
+		in := inputs["x"]
+		if config == "" {
+			return []*NativeTensor{in}, nil
+		}
+		// with a config, each row of the output is the input row twice
+		data := []byte{}
+		for i := 0; i < len(in.Data); i += 4 {
+			data = append(data, in.Data[i:i+4]...)
+			data = append(data, in.Data[i:i+4]...)
+		}
+		out := &NativeTensor{}
+		err := out.InitWithData(data, []int64{in.Shape[0], 2}, in.Type)
+		return []*NativeTensor{out}, err
+	}
+
+	tp := makeTensor(10, 0, graphpipefb.TypeFloat32)
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	for _, config := range []string{"", "pair", "", "pair"} {
+		before := len(applied)
+		results, err := getResultsCached(c, rc, makeConfigRequest(tp, config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []int64{10}
+		if config != "" {
+			expected = []int64{10, 2}
+		}
+		if !reflect.DeepEqual(results[0].Shape, expected) {
+			t.Errorf("Expected shape %v for config '%s', got %v", expected, config, results[0].Shape)
+		}
+		if len(applied) > before {
+			<-nc.put
+		}
+	}
+	if !reflect.DeepEqual(applied, []string{"", "pair"}) {
+		t.Errorf("Expected apply for each config once, got %q", applied)
+	}
+
+	// another model sharing the cache does not see these results
+	c.modelID = "model-b"
+	if _, err := getResultsCached(c, rc, makeConfigRequest(tp, "")); err != nil {
+		t.Fatal(err)
+	}
+	<-nc.put
+	if len(applied) != 3 {
+		t.Errorf("Expected apply for another model, got %q", applied)
+	}
+}
+
+func TestBoltCacheModelID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	keys := [][]byte{[]byte("a")}
+	for i, modelID := range []string{"one", "one", "two"} {
+		bc, err := NewBoltCache(path, &BoltCacheOptions{ModelID: modelID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := bc.Get([]string{"out"}, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached := data[0][0] != nil; cached != (i == 1) {
+			t.Errorf("Open %d for model '%s': expected cached to be %v", i, modelID, i == 1)
+		}
+		bc.Put([]string{"out"}, [][]byte{[]byte("ts")}, keys, [][][]byte{{[]byte("row")}})
+		bc.Close()
+	}
+}
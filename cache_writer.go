@@ -0,0 +1,177 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultCacheQueue is how many results can wait to be cached before new
+// ones are dropped.
+const defaultCacheQueue = 1024
+
+// cacheWriter puts results in the cache in the background. Results that
+// are waiting together are merged into one Put, so that a BoltCache writes
+// them in one transaction, and results are dropped when the queue is full
+// rather than holding up requests.
+type cacheWriter struct {
+	cache   Cache
+	queue   chan *cacheWrite
+	dropped int64
+	// closing holds writes off while close marks the writer closed, so
+	// that nothing is queued after the last flush
+	closing sync.RWMutex
+	closed  bool
+	mu      sync.Mutex
+	flushes chan chan bool
+}
+
+// cacheWrite is the rows of one request. done is called once they are
+// written or dropped.
+type cacheWrite struct {
+	outputs    []string
+	typeShapes [][]byte
+	keys       [][]byte
+	data       [][][]byte
+	done       func()
+}
+
+func newCacheWriter(cache Cache, size int) *cacheWriter {
+	if size <= 0 {
+		size = defaultCacheQueue
+	}
+	w := &cacheWriter{
+		cache:   cache,
+		queue:   make(chan *cacheWrite, size),
+		flushes: make(chan chan bool),
+	}
+	go w.run(w.flushes)
+	return w
+}
+
+// write queues cw, or drops it if the queue is full or the writer is
+// closed.
+func (w *cacheWriter) write(cw *cacheWrite) {
+	w.closing.RLock()
+	if !w.closed {
+		select {
+		case w.queue <- cw:
+			w.closing.RUnlock()
+			return
+		default:
+		}
+	}
+	w.closing.RUnlock()
+	atomic.AddInt64(&w.dropped, 1)
+	logrus.Debugf("Dropped %d rows because the cache queue is full", len(cw.keys))
+	if cw.done != nil {
+		cw.done()
+	}
+}
+
+// queued returns how many writes are waiting.
+func (w *cacheWriter) queued() int {
+	return len(w.queue)
+}
+
+// flush waits until everything queued so far is written.
+func (w *cacheWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.flushes == nil {
+		return
+	}
+	done := make(chan bool)
+	w.flushes <- done
+	<-done
+}
+
+// close flushes the queue and stops the writer. Later writes are dropped.
+func (w *cacheWriter) close() {
+	w.closing.Lock()
+	w.closed = true
+	w.closing.Unlock()
+	w.flush()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.flushes != nil {
+		close(w.flushes)
+		w.flushes = nil
+	}
+}
+
+func (w *cacheWriter) run(flushes chan chan bool) {
+	for {
+		select {
+		case cw := <-w.queue:
+			w.writeBatch(cw)
+		case done, ok := <-flushes:
+			if !ok {
+				return
+			}
+			for len(w.queue) > 0 {
+				w.writeBatch(<-w.queue)
+			}
+			close(done)
+		}
+	}
+}
+
+// writeBatch writes first along with whatever else is waiting, merging
+// writes to the same outputs.
+func (w *cacheWriter) writeBatch(first *cacheWrite) {
+	batch := []*cacheWrite{first}
+	for len(batch) < cap(w.queue) && len(w.queue) > 0 {
+		batch = append(batch, <-w.queue)
+	}
+
+	merged := map[string]*cacheWrite{}
+	order := []string{}
+	for _, cw := range batch {
+		group := writeGroup(cw)
+		m, ok := merged[group]
+		if !ok {
+			m = &cacheWrite{
+				outputs:    cw.outputs,
+				typeShapes: cw.typeShapes,
+				data:       make([][][]byte, len(cw.outputs)),
+			}
+			merged[group] = m
+			order = append(order, group)
+		}
+		m.keys = append(m.keys, cw.keys...)
+		for i := range cw.data {
+			m.data[i] = append(m.data[i], cw.data[i]...)
+		}
+	}
+	for _, group := range order {
+		m := merged[group]
+		if err := w.cache.Put(m.outputs, m.typeShapes, m.keys, m.data); err != nil {
+			logrus.Errorf("Failed to put item in cache: %v", err)
+		}
+	}
+	for _, cw := range batch {
+		if cw.done != nil {
+			cw.done()
+		}
+	}
+}
+
+// writeGroup identifies the outputs and the type and shape of their rows,
+// which must match for writes to be merged.
+func writeGroup(cw *cacheWrite) string {
+	b := &bytes.Buffer{}
+	for i := range cw.outputs {
+		fmt.Fprintf(b, "%d %s %d ", len(cw.outputs[i]), cw.outputs[i], len(cw.typeShapes[i]))
+		b.Write(cw.typeShapes[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// blockingCache holds up the first Put until it is released, and records
+// how many rows each Put had.
+type blockingCache struct {
+	Cache
+	started chan bool
+	release chan bool
+	puts    []int
+}
+
+func newBlockingCache() *blockingCache {
+	return &blockingCache{NewMemoryCache(1 << 20), make(chan bool), make(chan bool), nil}
+}
+
+func (bc *blockingCache) Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	if len(bc.puts) == 0 {
+		bc.started <- true
+		<-bc.release
+	}
+	bc.puts = append(bc.puts, len(keys))
+	return bc.Cache.Put(outputs, typeShapes, keys, data)
+}
+
+func testWrite(output string, key string, done func()) *cacheWrite {
+	return &cacheWrite{
+		outputs:    []string{output},
+		typeShapes: [][]byte{{1}},
+		keys:       [][]byte{[]byte(key)},
+		data:       [][][]byte{{[]byte(key)}},
+		done:       done,
+	}
+}
+
+func TestCacheWriterMerges(t *testing.T) {
+	bc := newBlockingCache()
+	w := newCacheWriter(bc, 10)
+	defer w.close()
+	done := 0
+	w.write(testWrite("a", "1", func() { done++ }))
+	<-bc.started
+	for _, key := range []string{"2", "3"} {
+		w.write(testWrite("a", key, func() { done++ }))
+	}
+	w.write(testWrite("b", "4", func() { done++ }))
+	if w.queued() != 3 {
+		t.Errorf("Expected 3 queued writes, got %d", w.queued())
+	}
+	close(bc.release)
+	w.flush()
+
+	// the writes waiting for the same output are merged
+	if !reflect.DeepEqual(bc.puts, []int{1, 2, 1}) {
+		t.Errorf("Expected puts of [1 2 1] rows, got %v", bc.puts)
+	}
+	if done != 4 {
+		t.Errorf("Expected 4 writes to be done, got %d", done)
+	}
+	_, data, _ := bc.Get([]string{"a"}, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	for j, row := range data[0] {
+		if row == nil {
+			t.Errorf("Row %d was not written", j)
+		}
+	}
+}
+
+func TestCacheWriterDrops(t *testing.T) {
+	bc := newBlockingCache()
+	w := newCacheWriter(bc, 1)
+	w.write(testWrite("a", "1", nil))
+	<-bc.started
+	w.write(testWrite("a", "2", nil))
+	dropped := false
+	w.write(testWrite("a", "3", func() { dropped = true }))
+	if !dropped || w.dropped != 1 {
+		t.Errorf("Expected a write to be dropped when the queue is full")
+	}
+	close(bc.release)
+
+	// closing flushes the queue, and later writes are dropped
+	w.close()
+	if !reflect.DeepEqual(bc.puts, []int{1, 1}) {
+		t.Errorf("Expected puts of [1 1] rows, got %v", bc.puts)
+	}
+	w.write(testWrite("a", "4", nil))
+	w.flush()
+	if w.dropped != 2 {
+		t.Errorf("Expected writes after close to be dropped, got %d dropped", w.dropped)
+	}
+}
+
+func TestCacheWriterCloseWhileWriting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := newCacheWriter(NewMemoryCache(1<<20), 100)
+		done := int32(0)
+		var wg sync.WaitGroup
+		wg.Add(10)
+		for j := 0; j < 10; j++ {
+			go func(j int) {
+				defer wg.Done()
+				w.write(testWrite("a", strconv.Itoa(j), func() { atomic.AddInt32(&done, 1) }))
+			}(j)
+		}
+		w.close()
+		wg.Wait()
+		// every write is either written by close or dropped
+		if done != 10 {
+			t.Fatalf("Expected 10 writes to be done, got %d", done)
+		}
+	}
+}
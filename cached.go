@@ -10,12 +10,13 @@ import (
 	"crypto/sha512"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"sort"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/Sirupsen/logrus"
-	bolt "github.com/coreos/bbolt"
 	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
 )
 
@@ -38,9 +39,10 @@ func newNt(tensor *NativeTensor, name string, chunks int) *Nt {
 	typeShape := make([]byte, (len(tensor.Shape)+1)*8)
 	binary.LittleEndian.PutUint64(typeShape[0:8], uint64(tensor.Type))
 
+	// dlen is the number of strings or bytes in each chunk
 	var dlen int
 	if tensor.Type == graphpipefb.TypeString {
-		dlen = len(tensor.StringVals)
+		dlen = int(numElements(tensor.Shape))
 	} else {
 		dlen = len(tensor.Data)
 	}
@@ -69,10 +71,11 @@ func newNt(tensor *NativeTensor, name string, chunks int) *Nt {
 
 func (t *Nt) data(index int) []byte {
 	if t.tensor.Type == graphpipefb.TypeString {
-		// encode strings into TensorContent style
-		strs := make([][]byte, len(t.tensor.StringVals))
-		for i := 0; i < len(t.tensor.StringVals); i++ {
-			strs[i] = []byte(t.tensor.StringVals[i])
+		// encode the strings of the chunk into TensorContent style
+		vals := t.tensor.StringVals[index*t.dlen : (index+1)*t.dlen]
+		strs := make([][]byte, len(vals))
+		for i := range vals {
+			strs[i] = []byte(vals[i])
 		}
 		return encodeStrs(strs)
 	}
@@ -80,58 +83,40 @@ func (t *Nt) data(index int) []byte {
 	return rval
 }
 
-func (t *Nt) tensorFromIndexes(indexes []int) *NativeTensor {
-	dt := t.tensor.Type
-	shape := make([]int64, len(t.tensor.Shape))
-	for i := 0; i < len(t.tensor.Shape); i++ {
-		shape[i] = t.tensor.Shape[i]
+func (t *Nt) tensorFromIndexes(indexes []int) (*NativeTensor, error) {
+	if len(t.tensor.Shape) == 0 || t.rows != 1 {
+		// the tensor was not split into rows, so it is a single chunk
+		return t.tensor, nil
 	}
-	if len(shape) > 0 {
-		shape[0] = int64(len(indexes))
-	}
-	nt := &NativeTensor{}
-
-	if dt == graphpipefb.TypeString {
-		stringVals := make([]string, len(indexes)*t.dlen)
-
-		for i, index := range indexes {
-			for j := 0; j < t.dlen; j++ {
-				stringVals[i*t.dlen+j] = t.tensor.StringVals[index*t.dlen+j]
-			}
-		}
-		nt.InitWithStringVals(stringVals, shape)
-	} else {
-		data := []byte{}
-		for _, i := range indexes {
-			data = append(data, t.data(i)...)
-		}
-
-		nt.InitWithData(data, shape, dt)
-	}
-	return nt
+	return t.tensor.Gather(0, indexes)
 }
 
-type hashPair struct {
-	index int
-	hash  []byte
+// keySalt identifies the model and config that results were computed
+// with, so that the keys of other models and configs never collide.
+func keySalt(modelID, config string) []byte {
+	h := sha512.New()
+	b := make([]byte, 8)
+	for _, s := range []string{modelID, config} {
+		binary.LittleEndian.PutUint64(b, uint64(len(s)))
+		h.Write(b)
+		h.Write([]byte(s))
+	}
+	return h.Sum(nil)
 }
 
-func getKey(inputs []*Nt, index int) []byte {
-	numInputs := len(inputs)
-	if numInputs == 0 {
-		return []byte(emptyKey)
+// cacheBuckets returns the names that outputs are cached under. Each
+// config has its own buckets, since the type and shape of the outputs
+// may depend on it.
+func cacheBuckets(outputs []string, config string) []string {
+	if config == "" {
+		return outputs
 	}
-	h := sha512.New()
-	for i := 0; i < numInputs; i++ {
-		h.Write(inputs[i].name)
-		h.Write(inputs[i].typeShape[0:8])
-		// skip the batch dimension
-		if len(inputs[i].typeShape) > 16 {
-			h.Write(inputs[i].typeShape[16:])
-		}
-		h.Write(inputs[i].data(index))
+	sum := sha512.Sum512([]byte(config))
+	buckets := make([]string, len(outputs))
+	for i := range outputs {
+		buckets[i] = fmt.Sprintf("%s (config %x)", outputs[i], sum[:8])
 	}
-	return h.Sum(nil)
+	return buckets
 }
 
 func dataLen(typeShape []byte) int {
@@ -140,121 +125,73 @@ func dataLen(typeShape []byte) int {
 	for i := 1; i < dims; i++ {
 		elements *= int64(binary.LittleEndian.Uint64(typeShape[(i * 8) : (i+1)*8]))
 	}
-	var size int
 	dt := binary.LittleEndian.Uint64(typeShape[0:8])
-	switch dt {
-	case graphpipefb.TypeUint8, graphpipefb.TypeInt8:
-		size = 1
-	case graphpipefb.TypeUint16, graphpipefb.TypeInt16, graphpipefb.TypeFloat16:
-		size = 2
-	case graphpipefb.TypeUint32, graphpipefb.TypeInt32, graphpipefb.TypeFloat32:
-		size = 4
-	case graphpipefb.TypeUint64, graphpipefb.TypeInt64, graphpipefb.TypeFloat64:
-		size = 8
-	case graphpipefb.TypeString:
-		fallthrough
-	default:
+	if dt >= uint64(len(types)) || types[dt].size <= 0 {
+		// strings and unknown types have no fixed size
 		return -1
 	}
+	size := int(types[dt].size)
 	return int(elements) * size
 }
 
 func getCache(c *appContext, keys [][]byte, outputs []string) ([][][]byte, [][]byte, []bool, []bool, error) {
 	numOutputs := len(outputs)
-	data := make([][][]byte, numOutputs)
-	typeShape := make([][]byte, numOutputs)
 	incompleteOutputs := make([]bool, numOutputs)
 	numChunks := len(keys)
 	incompleteChunks := make([]bool, numChunks)
-	if err := c.db.View(func(tx *bolt.Tx) error {
-		for i := range outputs {
-			data[i] = make([][]byte, numChunks)
-			// b is only valid for the length of the transaction
-			bucket := tx.Bucket([]byte(outputs[i]))
-			var b []byte
-			if bucket != nil {
-				b = bucket.Get([]byte(tsKey))
-			}
-			if bucket == nil || b == nil {
-				// if we haven't set the shape then there should be
-				// no keys so skip retrieval
-				incompleteOutputs[i] = true
-				for j := 0; j < numChunks; j++ {
-					incompleteChunks[j] = true
-				}
-			} else {
-				typeShape[i] = make([]byte, len(b))
-				copy(typeShape[i], b)
-				dlen := dataLen(typeShape[i])
-				if dlen != -1 {
-					// make data contiguous
-					content := make([]byte, dlen*numChunks)
-					for j := 0; j < numChunks; j++ {
-						data[i][j] = content[j*dlen : (j+1)*dlen]
-						b := bucket.Get(keys[j])
-						if b == nil {
-							incompleteOutputs[i] = true
-							incompleteChunks[j] = true
-						} else {
-							copy(data[i][j], b)
-						}
-					}
-				} else {
-					for j := 0; j < numChunks; j++ {
-						b := bucket.Get(keys[j])
-						if b == nil {
-							incompleteOutputs[i] = true
-							incompleteChunks[j] = true
-						} else {
-							data[i][j] = make([]byte, len(b))
-							copy(data[i][j], b)
-						}
-					}
-				}
-			}
-		}
-		return nil
-	}); err != nil {
+	typeShape, cached, err := c.cache.Get(outputs, keys)
+	if err != nil {
 		logrus.Errorf("Failed to get item from cache: %v", err)
 		return nil, nil, nil, nil, err
 	}
-	return data, typeShape, incompleteChunks, incompleteOutputs, nil
-}
-
-func setCache(c *appContext, keys [][]byte, outputs []string, data [][][]byte, typeShape [][]byte, missing []int) error {
-	if err := c.db.Update(func(tx *bolt.Tx) error {
-		for i := range outputs {
-			bucket := tx.Bucket([]byte(outputs[i]))
-			if bucket == nil {
-				var err error
-				bucket, err = tx.CreateBucketIfNotExists([]byte(outputs[i]))
-				if err != nil {
-					return err
-				}
+	data := make([][][]byte, numOutputs)
+	for i := range outputs {
+		data[i] = make([][]byte, numChunks)
+		if typeShape[i] == nil {
+			incompleteOutputs[i] = true
+			for j := 0; j < numChunks; j++ {
+				incompleteChunks[j] = true
 			}
-			b := bucket.Get([]byte(tsKey))
+			continue
+		}
+		dlen := dataLen(typeShape[i])
+		var content []byte
+		if dlen != -1 {
+			// make data contiguous
+			content = make([]byte, dlen*numChunks)
+		}
+		for j := 0; j < numChunks; j++ {
+			b := cached[i][j]
 			if b == nil {
-				if err := bucket.Put([]byte(tsKey), typeShape[i]); err != nil {
-					return err
-				}
+				incompleteOutputs[i] = true
+				incompleteChunks[j] = true
 			}
-			for j := range missing {
-				row := missing[j]
-				if err := bucket.Put(keys[row], data[i][row]); err != nil {
-					return err
-				}
+			if content == nil {
+				data[i][j] = b
+				continue
 			}
+			data[i][j] = content[j*dlen : (j+1)*dlen]
+			copy(data[i][j], b)
 		}
-		return nil
-	}); err != nil {
-		if err == bolt.ErrDatabaseNotOpen {
-			logrus.Debugf("Ingoring put cache error: %v", err)
-			return nil
+	}
+	return data, typeShape, incompleteChunks, incompleteOutputs, nil
+}
+
+// setCache queues the missing rows to be cached, and calls done once they
+// are written or dropped.
+func setCache(c *appContext, keys [][]byte, outputs []string, data [][][]byte, typeShape [][]byte, missing []int, done func()) {
+	missingKeys := make([][]byte, len(missing))
+	for j, row := range missing {
+		missingKeys[j] = keys[row]
+	}
+	missingData := make([][][]byte, len(outputs))
+	for i := range outputs {
+		missingData[i] = make([][]byte, len(missing))
+		for j, row := range missing {
+			missingData[i][j] = data[i][row]
 		}
-		logrus.Errorf("Failed to put item in cache: %v", err)
-		return err
 	}
-	return nil
+	c.cacheWriter().write(&cacheWrite{outputs, typeShape, missingKeys, missingData, done})
 }
 
 func rows(inputs []*NativeTensor) int64 {
@@ -289,9 +226,8 @@ func decodeStrs(buf []byte, num int64) ([]string, error) {
 		if lens[i] == 0 {
 			continue
 		}
-		n, err := reader.Read(tmp)
-		if err != nil || uint64(n) != lens[i] {
-			return nil, err
+		if _, err := io.ReadFull(reader, tmp); err != nil {
+			return nil, fmt.Errorf("Could not decode cached strings: %v", err)
 		}
 		strs[i] = string(tmp)
 	}
@@ -324,8 +260,10 @@ func ntFromData(typeShape []byte, data [][]byte) (*NativeTensor, error) {
 		tp.Shape[i] = size
 	}
 	// update the dimension with the number of chunks
-	elementsPerChunk := tp.Shape[0]
-	tp.Shape[0] *= int64(len(data))
+	elementsPerChunk := numElements(tp.Shape)
+	if dims > 0 {
+		tp.Shape[0] *= int64(len(data))
+	}
 	if tp.Type == graphpipefb.TypeString {
 		for i := 0; i < len(data); i++ {
 			strs, err := decodeStrs(data[i], elementsPerChunk)
@@ -356,14 +294,7 @@ func mergeResultsWithCacheData(results []*NativeTensor, applyIndexes []int, type
 		nt := newNt(results[i], "", numMissing)
 		if typeShape[ix] == nil {
 			typeShape[ix] = nt.typeShape
-			dlen := dataLen(typeShape[ix])
-			if dlen != -1 {
-				// make data contiguous
-				content := make([]byte, dlen*numChunks)
-				for j := 0; j < numChunks; j++ {
-					data[ix][j] = content[j*dlen : (j+1)*dlen]
-				}
-			}
+			allocOutput(data[ix], typeShape[ix], numChunks)
 		}
 		for j := 0; j < numMissing; j++ {
 			if data[ix][missing[j]] == nil {
@@ -376,7 +307,21 @@ func mergeResultsWithCacheData(results []*NativeTensor, applyIndexes []int, type
 	return data
 }
 
-func getInputTensors(req *graphpipefb.InferRequest) ([]*NativeTensor, error) {
+// allocOutput makes the rows of an output contiguous, which ntFromData
+// relies on for types with a fixed size.
+func allocOutput(data [][]byte, typeShape []byte, numChunks int) {
+	dlen := dataLen(typeShape)
+	if dlen == -1 {
+		return
+	}
+	content := make([]byte, dlen*numChunks)
+	for j := 0; j < numChunks; j++ {
+		data[j] = content[j*dlen : (j+1)*dlen]
+	}
+}
+
+func getInputTensors(req *graphpipefb.InferRequest) (_ []*NativeTensor, err error) {
+	defer recoverMalformed(&err)
 	inputTensors := make([]*NativeTensor, req.InputTensorsLength())
 
 	for i := 0; i < req.InputTensorsLength(); i++ {
@@ -387,7 +332,10 @@ func getInputTensors(req *graphpipefb.InferRequest) ([]*NativeTensor, error) {
 			return nil, err
 		}
 
-		nt := TensorToNativeTensor(tensor)
+		nt, err := TensorToNativeTensor(tensor)
+		if err != nil {
+			return nil, err
+		}
 		inputTensors[i] = nt
 	}
 	return inputTensors, nil
@@ -414,21 +362,9 @@ func getResultsCached(c *appContext, requestContext *RequestContext, req *graphp
 		return nil, err
 	}
 
-	keys := make([][]byte, numChunks)
-	ch := make(chan hashPair, numChunks)
-	var wg sync.WaitGroup
-	wg.Add(numChunks)
-	for i := 0; i < numChunks; i++ {
-		go func(i int) {
-			ch <- hashPair{i, getKey(inputs, i)}
-			wg.Done()
-		}(i)
-	}
-	wg.Wait()
-	close(ch)
-	for elem := range ch {
-		keys[elem.index] = elem.hash
-	}
+	config := string(req.Config())
+	salt := keySalt(c.modelID, config)
+	keys := hashKeys(keyHash(c), salt, inputs, numChunks)
 
 	outputNames, err := getOutputNames(c, req)
 	if err != nil {
@@ -446,7 +382,8 @@ func getResultsCached(c *appContext, requestContext *RequestContext, req *graphp
 		}
 	}
 
-	data, typeShape, incompleteChunks, incompleteOutputs, err := getCache(c, keys, outputNames)
+	buckets := cacheBuckets(outputNames, config)
+	data, typeShape, incompleteChunks, incompleteOutputs, err := getCache(c, keys, buckets)
 	if err != nil {
 		logrus.Errorf("Failed to get cached data: %v", err)
 		return nil, err
@@ -469,6 +406,8 @@ func getResultsCached(c *appContext, requestContext *RequestContext, req *graphp
 
 	numMissing := len(missing)
 	numApply := len(applyIndexes)
+	atomic.AddInt64(&c.cacheHits, int64(numChunks-numMissing))
+	atomic.AddInt64(&c.cacheMisses, int64(numMissing))
 	logrus.Debugf("%d rows must be calculated", numMissing)
 
 	if numMissing == 0 {
@@ -476,22 +415,99 @@ func getResultsCached(c *appContext, requestContext *RequestContext, req *graphp
 	} else if numApply == 0 {
 		logrus.Infof("Skipping apply because no outputs requested")
 	} else {
-		applyInputs := map[string]*NativeTensor{}
-		for i := 0; i < len(inputs); i++ {
-			applyInputs[string(inputs[i].name)] = inputs[i].tensorFromIndexes(missing)
+		compute := func(rows []int) error {
+			applyInputs := map[string]*NativeTensor{}
+			for i := 0; i < len(inputs); i++ {
+				applyInputs[string(inputs[i].name)], err = inputs[i].tensorFromIndexes(rows)
+				if err != nil {
+					logrus.Errorf("Failed to gather missing rows: %v", err)
+					return err
+				}
+			}
+			results, err := c.apply(requestContext, config, applyInputs, outputNames)
+			if err != nil {
+				logrus.Errorf("Apply failed: %v", err)
+				return err
+			}
+			data = mergeResultsWithCacheData(results, applyIndexes, typeShape, rows, numChunks, data)
+			return nil
 		}
-		results, err := c.apply(requestContext, string(req.Config()), applyInputs, outputNames)
-		if err != nil {
-			logrus.Errorf("Apply failed: %v", err)
-			return nil, err
+
+		// rows that identical requests are computing right now are
+		// waited for instead of computed again
+		prefix := strings.Join(buckets, "\x00") + "\x00"
+		own := []int{}
+		ownFlights := map[int]*flight{}
+		waiting := []int{}
+		waitFlights := map[int]*flight{}
+		for _, row := range missing {
+			f, leader := c.flights.join(prefix + string(keys[row]))
+			if leader {
+				own = append(own, row)
+				ownFlights[row] = f
+			} else {
+				waiting = append(waiting, row)
+				waitFlights[row] = f
+			}
 		}
-		data = mergeResultsWithCacheData(results, applyIndexes, typeShape, missing, numChunks, data)
-		// set cache async so we can complete the request
-		go func() {
-			if err := setCache(c, keys, outputNames, data, typeShape, missing); err != nil {
-				logrus.Errorf("Failed to set cache: %v", err)
+		// the flights are kept until the rows are cached, so that
+		// requests arriving in between do not compute them again
+		forget := func(err error) {
+			for row, f := range ownFlights {
+				c.flights.forget(prefix+string(keys[row]), f)
+				if err != nil {
+					f.finish(nil, err)
+				}
+			}
+		}
+		scheduled := false
+		flightErr := errFlightAbandoned
+		defer func() {
+			if !scheduled {
+				forget(flightErr)
 			}
 		}()
+
+		if len(own) > 0 {
+			if flightErr = compute(own); flightErr != nil {
+				return nil, flightErr
+			}
+			for _, row := range own {
+				res := &rowResult{make([][]byte, numOutputs), make([][]byte, numOutputs)}
+				for i := 0; i < numOutputs; i++ {
+					res.typeShape[i] = typeShape[i]
+					res.data[i] = data[i][row]
+				}
+				ownFlights[row].finish(res, nil)
+			}
+		}
+		flightErr = nil
+
+		computed := own
+		retry := []int{}
+		for _, row := range waiting {
+			val, err := waitFlights[row].wait()
+			if err != nil || !fillRow(val.(*rowResult), typeShape, data, row, numChunks) {
+				retry = append(retry, row)
+			}
+		}
+		if len(retry) > 0 {
+			logrus.Debugf("Computing %d coalesced rows again", len(retry))
+			if err := compute(retry); err != nil {
+				return nil, err
+			}
+			computed = append(computed, retry...)
+			sort.Ints(computed)
+		}
+		logrus.Debugf("%d rows were computed by identical requests", numMissing-len(computed))
+
+		// cache in the background so we can complete the request
+		scheduled = true
+		if len(computed) > 0 {
+			setCache(c, keys, buckets, data, typeShape, computed, func() { forget(nil) })
+		} else {
+			forget(nil)
+		}
 	}
 
 	outputNts := make([]*NativeTensor, numOutputs)
@@ -510,21 +526,28 @@ func (a byName) Len() int           { return len(a) }
 func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byName) Less(i, j int) bool { return bytes.Compare(a[i].name, a[j].name) < 0 }
 
-func getInputs(c *appContext, req *graphpipefb.InferRequest, numChunks int) ([]*Nt, error) {
+func getInputs(c *appContext, req *graphpipefb.InferRequest, numChunks int) (_ []*Nt, err error) {
+	defer recoverMalformed(&err)
 	inputs := make([]*Nt, req.InputTensorsLength())
 	for i := 0; i < req.InputTensorsLength(); i++ {
 		tensor := &graphpipefb.Tensor{}
 		if !req.InputTensors(tensor, i) {
 			return nil, fmt.Errorf("Could not init tensor")
 		}
-		nt := TensorToNativeTensor(tensor)
 		name := ""
 		if i < req.InputNamesLength() {
 			name = string(req.InputNames(i))
 		}
 		if name == "" {
+			if i >= len(c.defaultInputs) {
+				return nil, fmt.Errorf("No name for input %d", i)
+			}
 			name = c.defaultInputs[i]
 		}
+		nt, err := TensorToNativeTensor(tensor)
+		if err != nil {
+			return nil, withTensorName(err, name)
+		}
 		inputs[i] = newNt(nt, name, numChunks)
 	}
 	sort.Sort(byName(inputs))
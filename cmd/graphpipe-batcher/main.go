@@ -6,6 +6,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -35,17 +37,22 @@ func version() string {
 }
 
 type options struct {
-	verbose   bool
-	version   bool
-	cache     bool
-	cacheDir  string
-	listen    string
-	inputs    string
-	outputs   string
-	targetURL string
-	batchSize int
-	timeout   int
-	workers   int
+	verbose    bool
+	version    bool
+	cache      bool
+	cacheDir   string
+	cacheTTL   time.Duration
+	cacheMaxMB int64
+	adminToken string
+	cachePeers string
+	cacheSelf  string
+	listen     string
+	inputs     string
+	outputs    string
+	targetURL  string
+	batchSize  int
+	timeout    int
+	workers    int
 }
 
 func main() {
@@ -103,17 +110,31 @@ func main() {
 	f.StringVarP(&opts.cacheDir, "cache-dir", "d", "~/.graphpipe", "directory for local cache state")
 	f.StringVarP(&opts.listen, "listen", "l", "127.0.0.1:10000", "listen string")
 	f.BoolVarP(&opts.cache, "cache", "c", false, "enable results caching")
+	f.DurationVarP(&opts.cacheTTL, "cache-ttl", "", 0, "expire cached results unused for this long (0 keeps them forever)")
+	f.Int64VarP(&opts.cacheMaxMB, "cache-max-mb", "", 0, "evict the least recently used cached results beyond this size (0 is unbounded)")
+	f.StringVarP(&opts.adminToken, "admin-token", "", "", "bearer token for the /control/cache routes")
+	f.StringVarP(&opts.cachePeers, "cache-peers", "", "", "comma separated urls of the servers sharing the cache, or a file listing them; needs --admin-token")
+	f.StringVarP(&opts.cacheSelf, "cache-self", "", "", "url of this server in --cache-peers")
 	f.StringVarP(&opts.targetURL, "target-url", "", "", "upstream graphpipe server")
 	f.IntVarP(&opts.batchSize, "batch-size", "", 10, "batch size")
 	f.StringVarP(&opts.inputs, "inputs", "i", "", "comma seprated default inputs")
 	f.StringVarP(&opts.outputs, "outputs", "o", "", "comma separated default outputs")
-	f.IntVarP(&opts.timeout, "timeout", "", 250, "timeout, in ms")
+	f.IntVarP(&opts.timeout, "timeout", "", 250, "how long a request waits for its batch to fill, in ms")
 	f.IntVarP(&opts.workers, "workers", "", 1, "number of workers")
 	f = cmd.PersistentFlags()
 	f.BoolVarP(&opts.verbose, "verbose", "v", false, "verbose output")
 	f.BoolVarP(&opts.version, "version", "V", false, "show version")
 
 	opts.cacheDir = strings.Replace(opts.cacheDir, "~", os.Getenv("HOME"), -1)
+	if opts.adminToken == "" {
+		opts.adminToken = os.Getenv("GP_ADMIN_TOKEN")
+	}
+	if opts.cachePeers == "" {
+		opts.cachePeers = os.Getenv("GP_CACHE_PEERS")
+	}
+	if opts.cacheSelf == "" {
+		opts.cacheSelf = os.Getenv("GP_CACHE_SELF")
+	}
 
 	cmd.Execute()
 	os.Exit(cmdExitCode)
@@ -122,6 +143,7 @@ func main() {
 type ioData struct {
 	Inputs        map[string]*graphpipe.NativeTensor
 	OutputNames   []string
+	Config        string
 	OutputTensors []*graphpipe.NativeTensor
 	Error         error
 	ReturnChannel chan *ioData
@@ -132,45 +154,42 @@ type bContext struct {
 	meta *graphpipe.NativeMetadataResponse
 }
 
-func concatCopyPreAllocate(slices [][]byte) []byte {
-	var totalLen int
-	for _, s := range slices {
-		totalLen += len(s)
-	}
-	tmp := make([]byte, totalLen)
-	var i int
-	for _, s := range slices {
-		i += copy(tmp[i:], s)
-	}
-	return tmp
+// ioGroup is the queued requests that can be sent upstream together.
+type ioGroup struct {
+	data     []*ioData
+	rows     int64
+	deadline time.Time
 }
 
-func checkDataShapes(firstIo, io *ioData) error {
-	rows := -1
-	for name, tensor := range io.Inputs {
-		firstTensor, ok := firstIo.Inputs[name]
-		if !ok {
-			return errors.New("Could not find input: " + name)
-		}
-		if len(firstTensor.Shape) != len(tensor.Shape) {
-			return errors.New("Shape length mismatch in batch")
-		}
-		for j := 1; j < len(firstTensor.Shape); j++ {
-			if firstTensor.Shape[j] != tensor.Shape[j] {
-				return errors.New("Shape mismatch in batch")
-			}
-
-		}
+// batchKey checks that io can be batched and returns its row count, and a
+// signature of everything that must match for requests to be sent in one
+// batch: the output names, the config, and the name, type and row shape of
+// each input.
+func batchKey(io *ioData) (string, int64, error) {
+	if len(io.Inputs) == 0 {
+		return "", 0, errors.New("No inputs in batch")
+	}
+	names := make([]string, 0, len(io.Inputs))
+	for name := range io.Inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%q %q", io.OutputNames, io.Config)
+	rows := int64(-1)
+	for _, name := range names {
+		tensor := io.Inputs[name]
 		if len(tensor.Shape) <= 0 || tensor.Shape[0] <= 0 {
-			return errors.New("Invalid shape in batch ")
+			return "", 0, errors.New("Invalid shape in batch")
 		}
 		if rows < 0 {
-			rows = int(tensor.Shape[0])
-		} else if int(tensor.Shape[0]) != rows {
-			return errors.New("All inputs must have same row count")
+			rows = tensor.Shape[0]
+		} else if tensor.Shape[0] != rows {
+			return "", 0, errors.New("All inputs must have same row count")
 		}
+		fmt.Fprintf(b, " %q %d %v", name, tensor.Type, tensor.Shape[1:])
 	}
-	return nil
+	return b.String(), rows, nil
 }
 
 func serve(opts options) error {
@@ -205,9 +224,23 @@ func serve(opts options) error {
 		meta.Outputs = append(meta.Outputs, io)
 	}
 
+	var peers *graphpipe.PeerCacheOptions
+	if opts.cachePeers != "" {
+		peers = &graphpipe.PeerCacheOptions{Self: opts.cacheSelf}
+		if _, err := os.Stat(opts.cachePeers); err == nil {
+			peers.PeersFile = opts.cachePeers
+		} else {
+			peers.Peers = strings.Split(opts.cachePeers, ",")
+		}
+	}
+
 	serveOpts := &graphpipe.ServeRawOptions{
 		Listen:         opts.listen,
 		CacheFile:      cachePath,
+		CacheOptions:   &graphpipe.BoltCacheOptions{TTL: opts.cacheTTL, MaxBytes: opts.cacheMaxMB * 1024 * 1024},
+		ModelID:        opts.targetURL,
+		AdminToken:     opts.adminToken,
+		Peers:          peers,
 		Meta:           ctx.meta,
 		DefaultInputs:  dIn,
 		DefaultOutputs: dOut,
@@ -229,140 +262,140 @@ func serve(opts options) error {
 				Transport: transport,
 			}
 
-			data := []*ioData{}
-
-			for {
-				timedOut := false
-				select {
-				case c := <-ctx.q:
-					data = append(data, <-c)
-					break
-				case <-time.After(time.Duration(opts.timeout) * time.Millisecond):
-					timedOut = true
-					break
-				}
-				batchErrors := []int{}
-				if len(data) == 0 {
-					continue
-				}
-
-				firstIo := data[0]
-				batchErrors = []int{}
-				for i, io := range data {
-					err := checkDataShapes(firstIo, io)
-					if err != nil {
-						io.Error = err
-						io.ReturnChannel <- io
-						batchErrors = append(batchErrors, i)
-					}
-				}
-				if len(batchErrors) >= 0 {
-					fixedData := []*ioData{}
-					for i := range data {
-						for _, idx := range batchErrors {
-							if i == idx {
-								break
-							}
-						}
-						fixedData = append(fixedData, data[i])
-					}
-					data = fixedData
-				}
-				totalRows := int64(0)
-				for _, io := range data {
-					for _, tensor := range io.Inputs {
-						totalRows += tensor.Shape[0]
-						break
-					}
-				}
-				if totalRows >= int64(opts.batchSize) || timedOut {
-					inputs := []*graphpipe.NativeTensor{}
-					inputNames := []string{}
-					outputNames := []string{}
-					rowCounts := []int64{}
-
-					for _, io := range data {
-						for name := range io.Inputs {
-							inputNames = append(inputNames, name)
-						}
-						for j := range io.OutputNames {
-							outputNames = append(outputNames, io.OutputNames[j])
-						}
-						break
-					}
-					allData := make([][][]byte, len(inputNames))
-					for _, io := range data {
-						rc := int64(-1)
-						for i, name := range inputNames {
-							tensor := io.Inputs[name]
-							allData[i] = append(allData[i], tensor.Data)
-							rc = tensor.Shape[0]
-						}
-						rowCounts = append(rowCounts, rc)
-					}
-					for i, d := range allData {
-						nt := graphpipe.NativeTensor{}
-						name := inputNames[i]
-						shape := []int64{}
-						for _, s := range data[0].Inputs[name].Shape {
-							shape = append(shape, s)
-						}
-						shape[0] = int64(totalRows)
-						inputNames = append(inputNames, name)
-						nt.InitWithData(concatCopyPreAllocate(d), shape, data[0].Inputs[name].Type)
-						inputs = append(inputs, &nt)
-					}
-					//ship it!
-					tensors, err := graphpipe.MultiRemoteRaw(client, opts.targetURL, "", inputs, inputNames, outputNames)
-					if err != nil {
-						for _, io := range data {
-							io.Error = err
-							io.ReturnChannel <- io
-						}
-
-					} else {
-						offset := int64(0)
-						for i, io := range data {
-							outputs := []*graphpipe.NativeTensor{}
-							curRows := rowCounts[i]
-							for _, t := range tensors {
-								shape := []int64{}
-								rowSize := int64(1)
-								for j := 1; j < len(t.Shape); j++ {
-									rowSize *= t.Shape[j]
-								}
-								itemCount := int64(1)
-								for j := 0; j < len(t.Shape); j++ {
-									itemCount *= t.Shape[j]
-									shape = append(shape, t.Shape[j])
-								}
-								shape[0] = curRows
-								itemSize := len(t.Data) / int(itemCount)
-								start := int(offset) * int(itemSize) * int(rowSize)
-								end := start + int(rowSize)*int(curRows)*int(itemSize)
-								nt := graphpipe.NativeTensor{}
-								nt.InitWithData(t.Data[start:end], shape, t.Type)
-								outputs = append(outputs, &nt)
-							}
-							io.OutputTensors = outputs
-
-							io.ReturnChannel <- io
-							offset += curRows
-						}
-					}
-					data = []*ioData{}
-				}
-			}
+			ctx.batch(client, opts.targetURL, opts.batchSize, time.Duration(opts.timeout)*time.Millisecond)
 		}()
 	}
 
 	return graphpipe.ServeRaw(serveOpts)
 }
 
+// batch groups queued requests by batchKey and sends each group upstream
+// on its own, once it has batchSize rows or once its first request has
+// waited for timeout. Requests that cannot be batched are answered with an
+// error.
+func (ctx *bContext) batch(client *http.Client, targetURL string, batchSize int, timeout time.Duration) {
+	groups := map[string]*ioGroup{}
+	for {
+		// wake up when the oldest group is due
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if len(groups) > 0 {
+			timer = time.NewTimer(time.Until(nextDeadline(groups)))
+			expired = timer.C
+		}
+		select {
+		case c := <-ctx.q:
+			io := <-c
+			key, rows, err := batchKey(io)
+			if err != nil {
+				io.Error = err
+				io.ReturnChannel <- io
+				break
+			}
+			g, ok := groups[key]
+			if !ok {
+				g = &ioGroup{deadline: time.Now().Add(timeout)}
+				groups[key] = g
+			}
+			g.data = append(g.data, io)
+			g.rows += rows
+			if g.rows >= int64(batchSize) {
+				sendBatch(client, targetURL, g.data)
+				delete(groups, key)
+			}
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		now := time.Now()
+		for key, g := range groups {
+			if !g.deadline.After(now) {
+				sendBatch(client, targetURL, g.data)
+				delete(groups, key)
+			}
+		}
+	}
+}
+
+// nextDeadline returns the earliest deadline of groups.
+func nextDeadline(groups map[string]*ioGroup) time.Time {
+	var next time.Time
+	for _, g := range groups {
+		if next.IsZero() || g.deadline.Before(next) {
+			next = g.deadline
+		}
+	}
+	return next
+}
+
+// sendBatch concatenates the rows of each input of data into one request,
+// and splits the rows of each output back into the requests. String and
+// numeric tensors are both merged and split by rows. The requests must have
+// the same batchKey.
+func sendBatch(client *http.Client, targetURL string, data []*ioData) {
+	inputNames := []string{}
+	for name := range data[0].Inputs {
+		inputNames = append(inputNames, name)
+	}
+	sort.Strings(inputNames)
+	rowCounts := make([]int64, len(data))
+	req := graphpipe.NewInferRequest().Output(data[0].OutputNames...).Config(data[0].Config)
+	var err error
+	for _, name := range inputNames {
+		parts := make([]*graphpipe.NativeTensor, len(data))
+		for i, io := range data {
+			parts[i] = io.Inputs[name]
+			rowCounts[i] = parts[i].Shape[0]
+		}
+		var nt *graphpipe.NativeTensor
+		if nt, err = graphpipe.Concat(parts); err != nil {
+			break
+		}
+		req.Input(name, nt)
+	}
+	//ship it!
+	var named map[string]*graphpipe.NativeTensor
+	if err == nil {
+		named, err = req.Send(client, targetURL)
+	}
+	// split each output back into the rows of each request
+	split := make([][]*graphpipe.NativeTensor, len(data[0].OutputNames))
+	if err == nil {
+		for j, name := range data[0].OutputNames {
+			t, ok := named[name]
+			if !ok {
+				err = fmt.Errorf("Output '%s' is missing from the response", name)
+				break
+			}
+			if split[j], err = t.Split(rowCounts); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		for _, io := range data {
+			io.Error = err
+			io.ReturnChannel <- io
+		}
+		return
+	}
+	for i, io := range data {
+		outputs := make([]*graphpipe.NativeTensor, len(split))
+		for j := range split {
+			outputs[j] = split[j][i]
+		}
+		io.OutputTensors = outputs
+
+		io.ReturnChannel <- io
+	}
+}
+
 func (ctx *bContext) apply(requestContext *graphpipe.RequestContext, config string, inputs map[string]*graphpipe.NativeTensor, outputNames []string) ([]*graphpipe.NativeTensor, error) {
 	io := ioData{}
 	io.Inputs = inputs
 	io.OutputNames = outputNames
+	io.Config = config
 
 	io.ReturnChannel = make(chan *ioData, 1)
 	c := make(chan *ioData, 1)
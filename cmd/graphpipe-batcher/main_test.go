@@ -0,0 +1,280 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// echoBatch is a request received by echoServer, with the row count of
+// each output.
+type echoBatch struct {
+	config string
+	rows   []int64
+}
+
+// echoServer answers each request with its inputs as outputs, with the
+// output "out_x" holding the input "in_x".
+func echoServer(t *testing.T, batches *[]echoBatch) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := graphpipefb.GetRootAsRequest(body, 0)
+		req := &graphpipefb.InferRequest{}
+		table := req.Table()
+		request.Req(&table)
+		req.Init(table.Bytes, table.Pos)
+
+		inputs := map[string]*graphpipe.NativeTensor{}
+		for i := 0; i < req.InputTensorsLength(); i++ {
+			tensor := &graphpipefb.Tensor{}
+			req.InputTensors(tensor, i)
+			nt, err := graphpipe.TensorToNativeTensor(tensor)
+			if err != nil {
+				t.Error(err)
+			}
+			inputs[string(req.InputNames(i))] = nt
+		}
+		shapes := []int64{}
+		b := fb.NewBuilder(1024)
+		outputs := make([]fb.UOffsetT, req.OutputNamesLength())
+		names := make([]fb.UOffsetT, req.OutputNamesLength())
+		for i := range outputs {
+			name := string(req.OutputNames(i))
+			nt := inputs[strings.Replace(name, "out_", "in_", 1)]
+			shapes = append(shapes, nt.Shape[0])
+			outputs[i] = nt.Build(b)
+			names[i] = b.CreateString(name)
+		}
+		mu.Lock()
+		*batches = append(*batches, echoBatch{string(req.Config()), shapes})
+		mu.Unlock()
+		graphpipefb.InferResponseStartOutputTensorsVector(b, len(outputs))
+		for i := len(outputs) - 1; i >= 0; i-- {
+			b.PrependUOffsetT(outputs[i])
+		}
+		tensors := b.EndVector(len(outputs))
+		graphpipefb.InferResponseStartOutputNamesVector(b, len(names))
+		for i := len(names) - 1; i >= 0; i-- {
+			b.PrependUOffsetT(names[i])
+		}
+		outNames := b.EndVector(len(names))
+		graphpipefb.InferResponseStart(b)
+		graphpipefb.InferResponseAddOutputTensors(b, tensors)
+		graphpipefb.InferResponseAddOutputNames(b, outNames)
+		w.Write(graphpipe.Serialize(b, graphpipefb.InferResponseEnd(b)))
+	}))
+}
+
+func stringRows(rows [][]string) *graphpipe.NativeTensor {
+	vals := []string{}
+	for _, row := range rows {
+		vals = append(vals, row...)
+	}
+	nt := &graphpipe.NativeTensor{}
+	nt.InitWithStringVals(vals, []int64{int64(len(rows)), int64(len(rows[0]))})
+	return nt
+}
+
+func TestSendBatchStrings(t *testing.T) {
+	batches := []echoBatch{}
+	server := echoServer(t, &batches)
+	defer server.Close()
+
+	requests := []struct {
+		tokens [][]string
+		floats [][]float32
+	}{
+		{[][]string{{"a", "b"}}, [][]float32{{1, 2, 3}}},
+		{[][]string{{"c", "d"}, {"e", ""}}, [][]float32{{4, 5, 6}, {7, 8, 9}}},
+		{[][]string{{"longer string", "f"}}, [][]float32{{10, 11, 12}}},
+	}
+	data := make([]*ioData, len(requests))
+	for i, r := range requests {
+		floats := &graphpipe.NativeTensor{}
+		if err := floats.InitSimple(r.floats); err != nil {
+			t.Fatal(err)
+		}
+		data[i] = &ioData{
+			Inputs:        map[string]*graphpipe.NativeTensor{"in_tokens": stringRows(r.tokens), "in_floats": floats},
+			OutputNames:   []string{"out_tokens", "out_floats"},
+			ReturnChannel: make(chan *ioData, 1),
+		}
+	}
+	sendBatch(http.DefaultClient, server.URL, data)
+
+	if !reflect.DeepEqual(batches, []echoBatch{{"", []int64{4, 4}}}) {
+		t.Errorf("Expected one batch of 4 rows, got %v", batches)
+	}
+	for i, r := range requests {
+		io := <-data[i].ReturnChannel
+		if io.Error != nil {
+			t.Fatal(io.Error)
+		}
+		tokens := stringRows(r.tokens)
+		if !reflect.DeepEqual(io.OutputTensors[0].StringVals, tokens.StringVals) || !reflect.DeepEqual(io.OutputTensors[0].Shape, tokens.Shape) {
+			t.Errorf("Request %d got strings %q %v", i, io.OutputTensors[0].StringVals, io.OutputTensors[0].Shape)
+		}
+		floats, err := graphpipe.NativeTensorToNative(io.OutputTensors[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(floats, r.floats) {
+			t.Errorf("Request %d got floats %v", i, floats)
+		}
+	}
+}
+
+func floatRows(t *testing.T, v interface{}) *graphpipe.NativeTensor {
+	nt := &graphpipe.NativeTensor{}
+	if err := nt.InitSimple(v); err != nil {
+		t.Fatal(err)
+	}
+	return nt
+}
+
+func TestBatchGroups(t *testing.T) {
+	batches := []echoBatch{}
+	server := echoServer(t, &batches)
+	defer server.Close()
+
+	ctx := &bContext{q: make(chan chan *ioData, 10)}
+	go ctx.batch(http.DefaultClient, server.URL, 100, 200*time.Millisecond)
+
+	x := []string{"out_x"}
+	requests := []struct {
+		config  string
+		outputs []string
+		inputs  map[string]*graphpipe.NativeTensor
+		fails   bool
+	}{
+		{"", x, map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float32{{1, 2}})}, false},
+		{"", x, map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float32{{3, 4}, {5, 6}})}, false},
+		{"fast", x, map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float32{{7, 8}})}, false},
+		{"", []string{"out_x", "out_y"}, map[string]*graphpipe.NativeTensor{
+			"in_x": floatRows(t, [][]float32{{9, 10}}),
+			"in_y": floatRows(t, [][]float32{{11}}),
+		}, false},
+		{"", x, map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float64{{12, 13}})}, false},
+		{"", x, map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float32{{14, 15, 16}})}, false},
+		{"", x, map[string]*graphpipe.NativeTensor{
+			"in_x": floatRows(t, [][]float32{{17, 18}}),
+			"in_y": floatRows(t, [][]float32{{19}, {20}}),
+		}, true},
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(requests))
+	for i, r := range requests {
+		go func(i int, config string, outputs []string, inputs map[string]*graphpipe.NativeTensor, fails bool) {
+			defer wg.Done()
+			results, err := ctx.apply(nil, config, inputs, outputs)
+			if fails {
+				if err == nil {
+					t.Errorf("Request %d should have failed", i)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+				return
+			}
+			for j, name := range outputs {
+				in := inputs[strings.Replace(name, "out_", "in_", 1)]
+				if !reflect.DeepEqual(results[j].Data, in.Data) || !reflect.DeepEqual(results[j].Shape, in.Shape) {
+					t.Errorf("Request %d got the wrong %s", i, name)
+				}
+			}
+		}(i, r.config, r.outputs, r.inputs, r.fails)
+	}
+	wg.Wait()
+
+	// the two requests with the same signature share a batch, and every
+	// other request is sent on its own
+	sort.Slice(batches, func(i, j int) bool {
+		return fmt.Sprint(batches[i]) < fmt.Sprint(batches[j])
+	})
+	expected := []echoBatch{
+		{"", []int64{1, 1}},
+		{"", []int64{1}},
+		{"", []int64{1}},
+		{"", []int64{3}},
+		{"fast", []int64{1}},
+	}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("Expected batches %v, got %v", expected, batches)
+	}
+}
+
+func TestBatchTimeoutPerGroup(t *testing.T) {
+	batches := []echoBatch{}
+	server := echoServer(t, &batches)
+	defer server.Close()
+
+	timeout := 100 * time.Millisecond
+	ctx := &bContext{q: make(chan chan *ioData, 10)}
+	go ctx.batch(http.DefaultClient, server.URL, 1000, timeout)
+
+	// keep requests coming for another group, so the queue is never idle
+	busy := map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float32{{1}})}
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	var wg sync.WaitGroup
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := ctx.apply(nil, "busy", busy, []string{"out_x"}); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+		wg.Wait()
+	}()
+
+	time.Sleep(timeout / 2)
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ctx.apply(nil, "", map[string]*graphpipe.NativeTensor{"in_x": floatRows(t, [][]float32{{2}})}, []string{"out_x"})
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * timeout):
+		t.Fatalf("The request was not sent while another group was busy")
+	}
+	// allow for some scheduling delay past the timeout
+	if elapsed := time.Since(start); elapsed > timeout+timeout/2 {
+		t.Errorf("Expected the request to be sent within %v, took %v", timeout, elapsed)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+)
+
+var (
+	ver string
+	sha string
+)
+
+func version() string {
+	if ver == "" {
+		ver = "dev"
+		sha = "unknown"
+	}
+	return fmt.Sprintf("version %s (built from sha %s)", ver, sha)
+}
+
+type options struct {
+	verbose      bool
+	version      bool
+	json         bool
+	qps          float64
+	concurrency  int
+	duration     time.Duration
+	requests     int
+	warmup       int
+	timeout      int
+	batchSize    int
+	stringLength int
+	inputs       string
+	outputs      string
+	config       string
+	requestsFile string
+	baseline     string
+	saveBaseline string
+}
+
+func main() {
+	var opts options
+	var cmdExitCode int
+
+	cmd := cobra.Command{
+		Use:   "graphpipe-bench <url>",
+		Short: "graphpipe-bench - load testing for graphpipe servers",
+		Long: `Load test a graphpipe server.
+
+Requests are either generated from the server metadata, using random data for
+each input and --batch-size for unknown dimensions, or replayed from
+--requests-file. The requests file holds one json request per line:
+
+  {"config": "", "inputs": [{"name": "x", "tensor": {"Type": 10, "Shape": [1, 2], "Data": "<base64>"}}], "outputs": ["y"]}
+
+With --qps requests are sent at a fixed rate, otherwise --concurrency workers
+send requests back to back.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if opts.verbose {
+				logrus.SetLevel(logrus.DebugLevel)
+			} else {
+				logrus.SetLevel(logrus.InfoLevel)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				fmt.Printf("%s\n", version())
+				return
+			}
+			if len(args) != 1 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if opts.concurrency <= 0 {
+				cmdExitCode = 1
+				logrus.Infof("--concurrency must be positive")
+				cmd.Usage()
+				return
+			}
+
+			logrus.Infof("Starting graphpipe-bench %s", version())
+
+			if err := bench(opts, args[0]); err != nil {
+				logrus.Errorf("Failed to bench: %v", err)
+				cmdExitCode = 1
+			}
+		},
+	}
+	f := cmd.Flags()
+	f.Float64VarP(&opts.qps, "qps", "q", 0, "send requests at a fixed rate instead of using --concurrency")
+	f.IntVarP(&opts.concurrency, "concurrency", "n", 1, "number of concurrent workers")
+	f.DurationVarP(&opts.duration, "duration", "d", 30*time.Second, "how long to run for")
+	f.IntVarP(&opts.requests, "requests", "r", 0, "stop after this many requests")
+	f.IntVarP(&opts.warmup, "warmup", "w", 0, "requests to send before measuring")
+	f.IntVarP(&opts.timeout, "timeout", "t", 60, "request timeout, in seconds")
+	f.IntVarP(&opts.batchSize, "batch-size", "b", 1, "size of unknown dimensions in generated inputs")
+	f.IntVarP(&opts.stringLength, "string-length", "", 16, "length of generated string values")
+	f.StringVarP(&opts.inputs, "inputs", "i", "", "comma separated inputs to generate (defaults to all inputs in the metadata)")
+	f.StringVarP(&opts.outputs, "outputs", "o", "", "comma separated outputs to request")
+	f.StringVarP(&opts.config, "config", "c", "", "config string sent with generated requests")
+	f.StringVarP(&opts.requestsFile, "requests-file", "f", "", "replay requests from this file")
+	f.StringVarP(&opts.baseline, "baseline", "", "", "compare results against a saved baseline")
+	f.StringVarP(&opts.saveBaseline, "save-baseline", "", "", "save results as a baseline")
+	f.BoolVarP(&opts.json, "json", "j", false, "print results as json")
+	f = cmd.PersistentFlags()
+	f.BoolVarP(&opts.verbose, "verbose", "v", false, "verbose output")
+	f.BoolVarP(&opts.version, "version", "V", false, "show version")
+
+	cmd.Execute()
+	os.Exit(cmdExitCode)
+}
+
+func splitNames(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func bench(opts options, uri string) error {
+	counter := &countingTransport{
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout: 5 * time.Second,
+			}).Dial,
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: opts.concurrency,
+		},
+	}
+	client := &http.Client{
+		Timeout:   time.Duration(opts.timeout) * time.Second,
+		Transport: counter,
+	}
+
+	var requests []*benchRequest
+	var err error
+	if opts.requestsFile != "" {
+		requests, err = loadRequests(opts.requestsFile)
+	} else {
+		var meta *graphpipe.NativeMetadataResponse
+		meta, err = graphpipe.Metadata(client, uri)
+		if err != nil {
+			return err
+		}
+		var req *benchRequest
+		req, err = generateRequest(meta, opts)
+		requests = []*benchRequest{req}
+	}
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return fmt.Errorf("no requests to send")
+	}
+
+	if opts.warmup > 0 {
+		logrus.Infof("Sending %d warmup requests", opts.warmup)
+		for i := 0; i < opts.warmup; i++ {
+			requests[i%len(requests)].send(client, uri)
+		}
+	}
+
+	if !opts.verbose {
+		// failures are counted in the report, so keep them from flooding the log
+		logrus.SetLevel(logrus.FatalLevel)
+	}
+	counter.reset()
+	rec := newRecorder()
+	start := time.Now()
+	if opts.qps > 0 {
+		runFixedRate(opts, client, uri, requests, rec)
+	} else {
+		runConcurrent(opts, client, uri, requests, rec)
+	}
+	elapsed := time.Since(start)
+	logrus.SetLevel(logrus.InfoLevel)
+
+	rep := rec.report(elapsed, counter)
+	if opts.saveBaseline != "" {
+		if err := saveReport(opts.saveBaseline, rep); err != nil {
+			return err
+		}
+	}
+	var base *report
+	if opts.baseline != "" {
+		if base, err = loadReport(opts.baseline); err != nil {
+			return err
+		}
+	}
+	if opts.json {
+		return printReportJSON(os.Stdout, rep, base)
+	}
+	printReport(os.Stdout, rep, base)
+	return nil
+}
+
+// runConcurrent keeps opts.concurrency requests in flight until the duration
+// or request limit is reached.
+func runConcurrent(opts options, client *http.Client, uri string, requests []*benchRequest, rec *recorder) {
+	deadline := time.Now().Add(opts.duration)
+	next := make(chan int)
+	go func() {
+		for i := 0; opts.requests <= 0 || i < opts.requests; i++ {
+			if time.Now().After(deadline) {
+				break
+			}
+			next <- i
+		}
+		close(next)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(opts.concurrency)
+	for w := 0; w < opts.concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				req := requests[i%len(requests)]
+				start := time.Now()
+				err := req.send(client, uri)
+				rec.record(time.Since(start), req.rows, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runFixedRate sends requests at opts.qps regardless of how quickly the
+// server responds. Latency is measured from when a request was scheduled so
+// that a slow server is not hidden by requests queueing up on the client.
+func runFixedRate(opts options, client *http.Client, uri string, requests []*benchRequest, rec *recorder) {
+	interval := time.Duration(float64(time.Second) / opts.qps)
+	start := time.Now()
+	deadline := start.Add(opts.duration)
+	var wg sync.WaitGroup
+	for i := 0; opts.requests <= 0 || i < opts.requests; i++ {
+		scheduled := start.Add(time.Duration(i) * interval)
+		if scheduled.After(deadline) {
+			break
+		}
+		time.Sleep(time.Until(scheduled))
+		wg.Add(1)
+		go func(req *benchRequest) {
+			defer wg.Done()
+			err := req.send(client, uri)
+			rec.record(time.Since(scheduled), req.rows, err)
+		}(requests[i%len(requests)])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,267 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// countingTransport counts the bytes sent and received over http.
+type countingTransport struct {
+	Transport http.RoundTripper
+	sent      int64
+	received  int64
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.ContentLength > 0 {
+		atomic.AddInt64(&t.sent, r.ContentLength)
+	}
+	rs, err := t.Transport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	rs.Body = &countingReader{rs.Body, &t.received}
+	return rs, nil
+}
+
+func (t *countingTransport) reset() {
+	atomic.StoreInt64(&t.sent, 0)
+	atomic.StoreInt64(&t.received, 0)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+type recorder struct {
+	sync.Mutex
+	latencies []time.Duration
+	rows      int64
+	errors    map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{errors: map[string]int{}}
+}
+
+func (rec *recorder) record(latency time.Duration, rows int64, err error) {
+	rec.Lock()
+	defer rec.Unlock()
+	if err != nil {
+		rec.errors[classifyError(err)]++
+		return
+	}
+	rec.latencies = append(rec.latencies, latency)
+	rec.rows += rows
+}
+
+var statusRe = regexp.MustCompile(`^Remote failed with (\d+)`)
+
+// classifyError buckets errors so that the breakdown stays readable.
+func classifyError(err error) string {
+	if m := statusRe.FindStringSubmatch(err.Error()); m != nil {
+		return "http " + m[1]
+	}
+	if ue, ok := err.(*url.Error); ok {
+		if ue.Timeout() {
+			return "timeout"
+		}
+		if _, ok := ue.Err.(*net.OpError); ok {
+			return "connection"
+		}
+	}
+	return err.Error()
+}
+
+// report holds the results of a run. It is also the format of saved
+// baselines.
+type report struct {
+	Requests      int            `json:"requests"`
+	Errors        int            `json:"errors"`
+	ErrorKinds    map[string]int `json:"error_kinds"`
+	Seconds       float64        `json:"seconds"`
+	RequestsPerS  float64        `json:"requests_per_second"`
+	RowsPerS      float64        `json:"rows_per_second"`
+	BytesSent     int64          `json:"bytes_sent"`
+	BytesReceived int64          `json:"bytes_received"`
+	LatencyMs     latencies      `json:"latency_ms"`
+}
+
+type latencies struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p/100*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func (rec *recorder) report(elapsed time.Duration, counter *countingTransport) *report {
+	rec.Lock()
+	defer rec.Unlock()
+	sorted := append([]time.Duration{}, rec.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	errors := 0
+	for _, n := range rec.errors {
+		errors += n
+	}
+	rep := &report{
+		Requests:      len(sorted) + errors,
+		Errors:        errors,
+		ErrorKinds:    rec.errors,
+		Seconds:       elapsed.Seconds(),
+		BytesSent:     atomic.LoadInt64(&counter.sent),
+		BytesReceived: atomic.LoadInt64(&counter.received),
+	}
+	if rep.Seconds > 0 {
+		rep.RequestsPerS = float64(len(sorted)) / rep.Seconds
+		rep.RowsPerS = float64(rec.rows) / rep.Seconds
+	}
+	if len(sorted) > 0 {
+		total := time.Duration(0)
+		for _, l := range sorted {
+			total += l
+		}
+		rep.LatencyMs = latencies{
+			Min:  ms(sorted[0]),
+			Mean: ms(total / time.Duration(len(sorted))),
+			P50:  ms(percentile(sorted, 50)),
+			P90:  ms(percentile(sorted, 90)),
+			P95:  ms(percentile(sorted, 95)),
+			P99:  ms(percentile(sorted, 99)),
+			Max:  ms(sorted[len(sorted)-1]),
+		}
+	}
+	return rep
+}
+
+func saveReport(path string, rep *report) error {
+	js, err := json.MarshalIndent(rep, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, js, 0644)
+}
+
+func loadReport(path string) (*report, error) {
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rep := &report{}
+	if err := json.Unmarshal(js, rep); err != nil {
+		return nil, fmt.Errorf("could not read baseline '%s': %v", path, err)
+	}
+	return rep, nil
+}
+
+type metric struct {
+	name   string
+	format string
+	value  func(*report) float64
+}
+
+var metrics = []metric{
+	{"requests", "%.0f", func(r *report) float64 { return float64(r.Requests) }},
+	{"errors", "%.0f", func(r *report) float64 { return float64(r.Errors) }},
+	{"requests/s", "%.2f", func(r *report) float64 { return r.RequestsPerS }},
+	{"rows/s", "%.2f", func(r *report) float64 { return r.RowsPerS }},
+	{"bytes sent", "%.0f", func(r *report) float64 { return float64(r.BytesSent) }},
+	{"bytes received", "%.0f", func(r *report) float64 { return float64(r.BytesReceived) }},
+	{"latency min (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.Min }},
+	{"latency mean (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.Mean }},
+	{"latency p50 (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.P50 }},
+	{"latency p90 (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.P90 }},
+	{"latency p95 (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.P95 }},
+	{"latency p99 (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.P99 }},
+	{"latency max (ms)", "%.2f", func(r *report) float64 { return r.LatencyMs.Max }},
+}
+
+func printReport(w io.Writer, rep *report, base *report) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	if base != nil {
+		fmt.Fprintf(tw, "\tcurrent\tbaseline\tchange\t\n")
+	}
+	for _, m := range metrics {
+		cur := m.value(rep)
+		if base == nil {
+			fmt.Fprintf(tw, "%s\t"+m.format+"\t\n", m.name, cur)
+			continue
+		}
+		old := m.value(base)
+		change := "-"
+		if old != 0 {
+			change = fmt.Sprintf("%+.1f%%", (cur-old)/old*100)
+		}
+		fmt.Fprintf(tw, "%s\t"+m.format+"\t"+m.format+"\t%s\t\n", m.name, cur, old, change)
+	}
+	tw.Flush()
+
+	if len(rep.ErrorKinds) > 0 {
+		fmt.Fprintf(w, "\nerrors:\n")
+		kinds := make([]string, 0, len(rep.ErrorKinds))
+		for k := range rep.ErrorKinds {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			fmt.Fprintf(w, "  %6d  %s\n", rep.ErrorKinds[k], k)
+		}
+	}
+}
+
+func printReportJSON(w io.Writer, rep *report, base *report) error {
+	out := map[string]*report{"current": rep}
+	if base != nil {
+		out["baseline"] = base
+	}
+	js, err := json.MarshalIndent(out, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", js)
+	return nil
+}
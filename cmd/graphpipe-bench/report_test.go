@@ -0,0 +1,132 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func millis(ms ...int) []time.Duration {
+	ds := make([]time.Duration, len(ms))
+	for i, m := range ms {
+		ds[i] = time.Duration(m) * time.Millisecond
+	}
+	return ds
+}
+
+func TestPercentile(t *testing.T) {
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = i + 1
+	}
+	tests := []struct {
+		sorted   []time.Duration
+		p        float64
+		expected time.Duration
+	}{
+		{nil, 50, 0},
+		{millis(7), 0, 7 * time.Millisecond},
+		{millis(7), 99, 7 * time.Millisecond},
+		{millis(1, 2, 3, 4), 50, 2 * time.Millisecond},
+		{millis(1, 2, 3, 4), 100, 4 * time.Millisecond},
+		{millis(hundred...), 50, 50 * time.Millisecond},
+		{millis(hundred...), 90, 90 * time.Millisecond},
+		{millis(hundred...), 99, 99 * time.Millisecond},
+		{millis(hundred...), 0, 1 * time.Millisecond},
+	}
+	for i, test := range tests {
+		if got := percentile(test.sorted, test.p); got != test.expected {
+			t.Errorf("Test %d: expected p%v to be %v, got %v", i, test.p, test.expected, got)
+		}
+	}
+}
+
+func TestRecorderReport(t *testing.T) {
+	rec := newRecorder()
+	for _, l := range millis(40, 10, 30, 20) {
+		rec.record(l, 2, nil)
+	}
+	rec.record(0, 2, errors.New("Remote failed with 503 Service Unavailable"))
+	rec.record(0, 2, errors.New("Remote failed with 503 Service Unavailable"))
+	counter := &countingTransport{sent: 100, received: 50}
+
+	rep := rec.report(2*time.Second, counter)
+	expected := &report{
+		Requests:      6,
+		Errors:        2,
+		ErrorKinds:    map[string]int{"http 503": 2},
+		Seconds:       2,
+		RequestsPerS:  2,
+		RowsPerS:      4,
+		BytesSent:     100,
+		BytesReceived: 50,
+		LatencyMs:     latencies{Min: 10, Mean: 25, P50: 20, P90: 40, P95: 40, P99: 40, Max: 40},
+	}
+	if !reflect.DeepEqual(rep, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rep)
+	}
+}
+
+// reportLines splits the output of printReport into the fields of each
+// line, since tabwriter pads them.
+func reportLines(out string) map[string][]string {
+	lines := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "  ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		lines[parts[0]] = strings.Fields(parts[1])
+	}
+	return lines
+}
+
+func TestPrintReport(t *testing.T) {
+	rep := &report{
+		Requests:     10,
+		Errors:       3,
+		ErrorKinds:   map[string]int{"timeout": 1, "http 500": 2},
+		RequestsPerS: 5,
+		LatencyMs:    latencies{P50: 12.5},
+	}
+	out := &bytes.Buffer{}
+	printReport(out, rep, nil)
+	lines := reportLines(out.String())
+	for name, fields := range map[string][]string{
+		"requests":         {"10"},
+		"errors":           {"3"},
+		"requests/s":       {"5.00"},
+		"latency p50 (ms)": {"12.50"},
+	} {
+		if !reflect.DeepEqual(lines[name], fields) {
+			t.Errorf("Expected %s to be %v, got %v", name, fields, lines[name])
+		}
+	}
+	// error kinds are listed in order after the table
+	if !strings.HasSuffix(out.String(), "errors:\n       2  http 500\n       1  timeout\n") {
+		t.Errorf("Unexpected error breakdown in %q", out.String())
+	}
+
+	base := &report{Requests: 8, RequestsPerS: 10, LatencyMs: latencies{P50: 10}}
+	out.Reset()
+	printReport(out, rep, base)
+	lines = reportLines(out.String())
+	for name, fields := range map[string][]string{
+		"requests":         {"10", "8", "+25.0%"},
+		"errors":           {"3", "0", "-"},
+		"requests/s":       {"5.00", "10.00", "-50.0%"},
+		"latency p50 (ms)": {"12.50", "10.00", "+25.0%"},
+	} {
+		if !reflect.DeepEqual(lines[name], fields) {
+			t.Errorf("Expected %s to be %v against the baseline, got %v", name, fields, lines[name])
+		}
+	}
+}
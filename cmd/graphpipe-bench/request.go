@@ -0,0 +1,201 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+type benchRequest struct {
+	req  *graphpipe.InferRequest
+	rows int64
+}
+
+func (br *benchRequest) send(client *http.Client, uri string) error {
+	_, err := br.req.SendRaw(client, uri)
+	return err
+}
+
+func newBenchRequest(req *graphpipe.InferRequest) *benchRequest {
+	rows := req.Rows()
+	if rows < 0 {
+		rows = 1
+	}
+	return &benchRequest{req, rows}
+}
+
+// loadRequests reads a file with one json encoded request per line.
+func loadRequests(path string) ([]*benchRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	requests := []*benchRequest{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		req := &graphpipe.InferRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		requests = append(requests, newBenchRequest(req))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// generateRequest builds a request with random data for each input in the
+// metadata, using batchSize for any unknown dimensions.
+func generateRequest(meta *graphpipe.NativeMetadataResponse, opts options) (*benchRequest, error) {
+	ios := map[string]graphpipe.NativeIOMetadata{}
+	for _, io := range meta.Inputs {
+		ios[io.Name] = io
+	}
+	names := splitNames(opts.inputs)
+	if len(names) == 0 {
+		for _, io := range meta.Inputs {
+			names = append(names, io.Name)
+		}
+	}
+
+	req := graphpipe.NewInferRequest().Config(opts.config).Output(splitNames(opts.outputs)...)
+	for _, name := range names {
+		io, ok := ios[name]
+		if !ok {
+			return nil, fmt.Errorf("input '%s' is not in the metadata", name)
+		}
+		nt, err := randomTensor(io.Type, io.Shape, opts.batchSize, opts.stringLength)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate input '%s': %v", name, err)
+		}
+		req.Input(name, nt)
+	}
+	if err := req.Err(); err != nil {
+		return nil, err
+	}
+	return newBenchRequest(req), nil
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func randomTensor(dt uint8, metaShape []int64, batchSize int, stringLength int) (*graphpipe.NativeTensor, error) {
+	shape := make([]int64, len(metaShape))
+	elems := int64(1)
+	for i, d := range metaShape {
+		if d <= 0 {
+			d = int64(batchSize)
+		}
+		shape[i] = d
+		elems *= d
+	}
+
+	nt := &graphpipe.NativeTensor{}
+	if dt == graphpipefb.TypeString {
+		strs := make([]string, elems)
+		buf := make([]byte, stringLength)
+		for i := range strs {
+			for j := range buf {
+				buf[j] = letters[rand.Intn(len(letters))]
+			}
+			strs[i] = string(buf)
+		}
+		return nt, nt.InitWithStringVals(strs, shape)
+	}
+
+	var vals interface{}
+	switch dt {
+	case graphpipefb.TypeUint8, graphpipefb.TypeInt8:
+		data := make([]byte, elems)
+		rand.Read(data)
+		vals = data
+	case graphpipefb.TypeUint16, graphpipefb.TypeInt16:
+		data := make([]int16, elems)
+		for i := range data {
+			data[i] = int16(rand.Intn(256))
+		}
+		vals = data
+	case graphpipefb.TypeUint32, graphpipefb.TypeInt32:
+		data := make([]int32, elems)
+		for i := range data {
+			data[i] = int32(rand.Intn(256))
+		}
+		vals = data
+	case graphpipefb.TypeUint64, graphpipefb.TypeInt64:
+		data := make([]int64, elems)
+		for i := range data {
+			data[i] = int64(rand.Intn(256))
+		}
+		vals = data
+	case graphpipefb.TypeFloat16:
+		data := make([]graphpipe.Float16, elems)
+		for i := range data {
+			data[i] = graphpipe.Float32ToFloat16(rand.Float32())
+		}
+		vals = data
+	case graphpipefb.TypeBFloat16:
+		data := make([]graphpipe.BFloat16, elems)
+		for i := range data {
+			data[i] = graphpipe.Float32ToBFloat16(rand.Float32())
+		}
+		vals = data
+	case graphpipefb.TypeFloat32:
+		data := make([]float32, elems)
+		for i := range data {
+			data[i] = rand.Float32()
+		}
+		vals = data
+	case graphpipefb.TypeFloat64:
+		data := make([]float64, elems)
+		for i := range data {
+			data[i] = rand.Float64()
+		}
+		vals = data
+	case graphpipefb.TypeBool:
+		data := make([]bool, elems)
+		for i := range data {
+			data[i] = rand.Intn(2) == 1
+		}
+		vals = data
+	case graphpipefb.TypeComplex64:
+		data := make([]complex64, elems)
+		for i := range data {
+			data[i] = complex(rand.Float32(), rand.Float32())
+		}
+		vals = data
+	case graphpipefb.TypeComplex128:
+		data := make([]complex128, elems)
+		for i := range data {
+			data[i] = complex(rand.Float64(), rand.Float64())
+		}
+		vals = data
+	default:
+		return nil, fmt.Errorf("unsupported dtype %d", dt)
+	}
+	if err := nt.InitSimple(vals); err != nil {
+		return nil, err
+	}
+	// InitSimple infers the signed types, so restore the real dtype and shape
+	nt.Type = dt
+	nt.Shape = shape
+	return nt, nil
+}
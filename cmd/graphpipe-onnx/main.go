@@ -51,6 +51,11 @@ type options struct {
 	model       string
 	listen      string
 	cacheDir    string
+	cacheTTL    time.Duration
+	cacheMaxMB  int64
+	adminToken  string
+	cachePeers  string
+	cacheSelf   string
 	verbose     bool
 	version     bool
 	cache       bool
@@ -167,6 +172,11 @@ func main() {
 	f.StringVarP(&opts.predictNet, "predict-net", "", "", "predict_net file to load.  Accepts local file or http(s) url.")
 	f.StringVarP(&opts.valueInputs, "value-inputs", "", "", "value_inputs.json for the model.  Accepts local file or http(s) url.")
 	f.BoolVarP(&opts.cache, "cache", "", false, "enable results caching")
+	f.DurationVarP(&opts.cacheTTL, "cache-ttl", "", 0, "expire cached results unused for this long (0 keeps them forever)")
+	f.Int64VarP(&opts.cacheMaxMB, "cache-max-mb", "", 0, "evict the least recently used cached results beyond this size (0 is unbounded)")
+	f.StringVarP(&opts.adminToken, "admin-token", "", "", "bearer token for the /control/cache routes")
+	f.StringVarP(&opts.cachePeers, "cache-peers", "", "", "comma separated urls of the servers sharing the cache, or a file listing them; needs --admin-token")
+	f.StringVarP(&opts.cacheSelf, "cache-self", "", "", "url of this server in --cache-peers")
 	f.BoolVarP(&opts.disableCuda, "disable-cuda", "", false, "disable Cuda")
 	f.StringVarP(&opts.profile, "profile", "", "", "profile and write profiling output to this file")
 	f.IntVarP(&opts.engineCount, "engine-count", "", 1, "number of caffe2 graph engines to create")
@@ -176,6 +186,15 @@ func main() {
 	f.BoolVarP(&opts.version, "version", "V", false, "show version")
 
 	opts.cacheDir = strings.Replace(opts.cacheDir, "~", os.Getenv("HOME"), -1)
+	if opts.adminToken == "" {
+		opts.adminToken = os.Getenv("GP_ADMIN_TOKEN")
+	}
+	if opts.cachePeers == "" {
+		opts.cachePeers = os.Getenv("GP_CACHE_PEERS")
+	}
+	if opts.cacheSelf == "" {
+		opts.cacheSelf = os.Getenv("GP_CACHE_SELF")
+	}
 
 	if opts.model == "" {
 		opts.model = os.Getenv("GP_MODEL")
@@ -342,7 +361,10 @@ func serve(opts options) error {
 		io := graphpipe.NativeIOMetadata{}
 		io.Name = name
 		io.Shape = dims[:dimCount]
-		io.Type = ctype2gptype[dtype]
+		io.Type, err = gptypeFor(int(dtype))
+		if err != nil {
+			return fmt.Errorf("Could not serve input '%s': %v", name, err)
+		}
 		meta.Inputs = append(meta.Inputs, io)
 
 	}
@@ -365,7 +387,10 @@ func serve(opts options) error {
 		io := graphpipe.NativeIOMetadata{}
 		io.Name = name
 		io.Shape = dims[:dimCount]
-		io.Type = ctype2gptype[dtype]
+		io.Type, err = gptypeFor(int(dtype))
+		if err != nil {
+			return fmt.Errorf("Could not serve output '%s': %v", name, err)
+		}
 		meta.Outputs = append(meta.Outputs, io)
 	}
 
@@ -381,9 +406,23 @@ func serve(opts options) error {
 		cachePath = filepath.Join(opts.cacheDir, fmt.Sprintf("%x.db", c2c.modelHash))
 	}
 
+	var peers *graphpipe.PeerCacheOptions
+	if opts.cachePeers != "" {
+		peers = &graphpipe.PeerCacheOptions{Self: opts.cacheSelf}
+		if _, err := os.Stat(opts.cachePeers); err == nil {
+			peers.PeersFile = opts.cachePeers
+		} else {
+			peers.Peers = strings.Split(opts.cachePeers, ",")
+		}
+	}
+
 	serveOpts := &graphpipe.ServeRawOptions{
 		Listen:         opts.listen,
 		CacheFile:      cachePath,
+		CacheOptions:   &graphpipe.BoltCacheOptions{TTL: opts.cacheTTL, MaxBytes: opts.cacheMaxMB * 1024 * 1024},
+		ModelID:        fmt.Sprintf("%x", c2c.modelHash),
+		AdminToken:     opts.adminToken,
+		Peers:          peers,
 		Meta:           c2c.meta,
 		Apply:          c2c.apply,
 		GetHandler:     c2c.getHandler,
@@ -420,6 +459,10 @@ var gptype2ctype = []int{
 	C.TensorProto_DataType_FLOAT,     // Type_Float32 = 10,
 	C.TensorProto_DataType_DOUBLE,    // Type_Float64 = 11,
 	C.TensorProto_DataType_STRING,    // Type_String = 12,
+	C.TensorProto_DataType_UNDEFINED, // Type_BFloat16 = 13,
+	C.TensorProto_DataType_BOOL,      // Type_Bool = 14,
+	C.TensorProto_DataType_UNDEFINED, // Type_Complex64 = 15,
+	C.TensorProto_DataType_UNDEFINED, // Type_Complex128 = 16,
 }
 
 var ctype2gptype = []uint8{
@@ -428,7 +471,7 @@ var ctype2gptype = []uint8{
 	graphpipefb.TypeInt32,   // TensorProto_DataType_INT32 = 2,
 	graphpipefb.TypeInt8,    // TensorProto_DataType_BYTE = 3,
 	graphpipefb.TypeString,  // TensorProto_DataType_STRING = 4,
-	graphpipefb.TypeNull,    // TensorProto_DataType_BOOL = 5,
+	graphpipefb.TypeBool,    // TensorProto_DataType_BOOL = 5,
 	graphpipefb.TypeInt8,    // TensorProto_DataType_UINT8 = 6,
 	graphpipefb.TypeInt8,    // TensorProto_DataType_INT8 = 7,
 	graphpipefb.TypeUint16,  // TensorProto_DataType_UINT16 = 8,
@@ -438,6 +481,28 @@ var ctype2gptype = []uint8{
 	graphpipefb.TypeFloat64, // TensorProto_DataType_DOUBLE = 13
 }
 
+// ctypeFor returns the caffe2 type for a graphpipe type, or an error if caffe2
+// has no equivalent, as for the complex types.
+func ctypeFor(gptype uint8) (int, error) {
+	if int(gptype) < len(gptype2ctype) && gptype2ctype[gptype] != C.TensorProto_DataType_UNDEFINED {
+		return gptype2ctype[gptype], nil
+	}
+	name, ok := graphpipefb.EnumNamesType[int(gptype)]
+	if !ok {
+		name = strconv.Itoa(int(gptype))
+	}
+	return 0, fmt.Errorf("Type %s is not supported by caffe2", name)
+}
+
+// gptypeFor returns the graphpipe type for a caffe2 type, or an error if the
+// type cannot be served.
+func gptypeFor(ctype int) (uint8, error) {
+	if ctype >= 0 && ctype < len(ctype2gptype) && ctype2gptype[ctype] != graphpipefb.TypeNull {
+		return ctype2gptype[ctype], nil
+	}
+	return 0, fmt.Errorf("Caffe2 type %d is not supported", ctype)
+}
+
 func (c2c *c2Context) apply(requestContext *graphpipe.RequestContext, config string, inputs map[string]*graphpipe.NativeTensor, outputNames []string) ([]*graphpipe.NativeTensor, error) {
 	engine_ctx := <-c2c.engineChannels
 	defer func() {
@@ -453,8 +518,12 @@ func (c2c *c2Context) apply(requestContext *graphpipe.RequestContext, config str
 			return nil, fmt.Errorf("Could not find input: %s", name)
 		}
 
-		if gptype2ctype[input.Type] != dtype {
-			return nil, fmt.Errorf("Input type mismatch.  Got %d expected %d", gptype2ctype[input.Type], C.c2_engine_get_dtype(engine_ctx, cname))
+		ctype, err := ctypeFor(input.Type)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set input '%s': %v", name, err)
+		}
+		if ctype != dtype {
+			return nil, fmt.Errorf("Input type mismatch.  Got %d expected %d", ctype, dtype)
 		}
 
 		itemSize := int(C.c2_engine_get_itemsize(engine_ctx, cname))
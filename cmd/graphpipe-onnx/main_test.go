@@ -0,0 +1,36 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+func TestUnsupportedTypes(t *testing.T) {
+	for _, gptype := range []uint8{graphpipefb.TypeNull, graphpipefb.TypeBFloat16, graphpipefb.TypeComplex64, graphpipefb.TypeComplex128, 200} {
+		if _, err := ctypeFor(gptype); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("Expected type %d to be rejected, got %v", gptype, err)
+		}
+	}
+	for _, gptype := range []uint8{graphpipefb.TypeFloat32, graphpipefb.TypeInt64, graphpipefb.TypeBool} {
+		ctype, err := ctypeFor(gptype)
+		if err != nil {
+			t.Errorf("Expected type %d to be supported, got %v", gptype, err)
+			continue
+		}
+		if back, err := gptypeFor(ctype); err != nil || back != gptype {
+			t.Errorf("Expected type %d to map back from %d, got %d %v", gptype, ctype, back, err)
+		}
+	}
+	for _, ctype := range []int{-1, 0, 9, len(ctype2gptype)} {
+		if _, err := gptypeFor(ctype); err == nil {
+			t.Errorf("Expected caffe2 type %d to be rejected", ctype)
+		}
+	}
+}
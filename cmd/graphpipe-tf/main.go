@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -43,15 +44,20 @@ func version() string {
 }
 
 type options struct {
-	verbose  bool
-	version  bool
-	cache    bool
-	cacheDir string
-	listen   string
-	model    string
-	inputs   string
-	shape    string
-	outputs  string
+	verbose    bool
+	version    bool
+	cache      bool
+	cacheDir   string
+	cacheTTL   time.Duration
+	cacheMaxMB int64
+	adminToken string
+	cachePeers string
+	cacheSelf  string
+	listen     string
+	model      string
+	inputs     string
+	shape      string
+	outputs    string
 }
 
 func main() {
@@ -99,11 +105,25 @@ func main() {
 	f.StringVarP(&opts.inputs, "inputs", "i", "", "comma seprated default inputs")
 	f.StringVarP(&opts.outputs, "outputs", "o", "", "comma separated default outputs")
 	f.BoolVarP(&opts.cache, "cache", "c", false, "enable results caching")
+	f.DurationVarP(&opts.cacheTTL, "cache-ttl", "", 0, "expire cached results unused for this long (0 keeps them forever)")
+	f.Int64VarP(&opts.cacheMaxMB, "cache-max-mb", "", 0, "evict the least recently used cached results beyond this size (0 is unbounded)")
+	f.StringVarP(&opts.adminToken, "admin-token", "", "", "bearer token for the /control/cache routes")
+	f.StringVarP(&opts.cachePeers, "cache-peers", "", "", "comma separated urls of the servers sharing the cache, or a file listing them; needs --admin-token")
+	f.StringVarP(&opts.cacheSelf, "cache-self", "", "", "url of this server in --cache-peers")
 	f = cmd.PersistentFlags()
 	f.BoolVarP(&opts.verbose, "verbose", "v", false, "verbose output")
 	f.BoolVarP(&opts.version, "version", "V", false, "show version")
 
 	opts.cacheDir = strings.Replace(opts.cacheDir, "~", os.Getenv("HOME"), -1)
+	if opts.adminToken == "" {
+		opts.adminToken = os.Getenv("GP_ADMIN_TOKEN")
+	}
+	if opts.cachePeers == "" {
+		opts.cachePeers = os.Getenv("GP_CACHE_PEERS")
+	}
+	if opts.cacheSelf == "" {
+		opts.cacheSelf = os.Getenv("GP_CACHE_SELF")
+	}
 	if opts.model == "" {
 		opts.model = os.Getenv("GP_MODEL")
 	}
@@ -371,9 +391,23 @@ func serve(opts options) error {
 	logrus.Infof("Using default inputs %s", dIn)
 	logrus.Infof("Using default outputs %s", dOut)
 
+	var peers *graphpipe.PeerCacheOptions
+	if opts.cachePeers != "" {
+		peers = &graphpipe.PeerCacheOptions{Self: opts.cacheSelf}
+		if _, err := os.Stat(opts.cachePeers); err == nil {
+			peers.PeersFile = opts.cachePeers
+		} else {
+			peers.Peers = strings.Split(opts.cachePeers, ",")
+		}
+	}
+
 	serveOpts := &graphpipe.ServeRawOptions{
 		Listen:         opts.listen,
 		CacheFile:      cachePath,
+		CacheOptions:   &graphpipe.BoltCacheOptions{TTL: opts.cacheTTL, MaxBytes: opts.cacheMaxMB * 1024 * 1024},
+		ModelID:        fmt.Sprintf("%x", c.modelHash),
+		AdminToken:     opts.adminToken,
+		Peers:          peers,
 		Meta:           c.meta,
 		DefaultInputs:  dIn,
 		DefaultOutputs: dOut,
@@ -385,30 +419,30 @@ func serve(opts options) error {
 }
 
 var conv2flat = []byte{
-	graphpipefb.TypeNull,    // DT_INVALID = 0;
-	graphpipefb.TypeFloat32, // DT_FLOAT = 1;
-	graphpipefb.TypeFloat64, // DT_DOUBLE = 2;
-	graphpipefb.TypeInt32,   // DT_INT32 = 3;
-	graphpipefb.TypeUint8,   // DT_UINT8 = 4;
-	graphpipefb.TypeInt16,   // DT_INT16 = 5;
-	graphpipefb.TypeInt8,    // DT_INT8 = 6;
-	graphpipefb.TypeString,  // DT_STRING = 7;
-	graphpipefb.TypeNull,    // DT_COMPLEX64 = 8;  // Single-precision complex
-	graphpipefb.TypeInt64,   // DT_INT64 = 9;
-	graphpipefb.TypeNull,    // DT_BOOL = 10;
-	graphpipefb.TypeNull,    // DT_QINT8 = 11;     // Quantized int8
-	graphpipefb.TypeNull,    // DT_QUINT8 = 12;    // Quantized uint8
-	graphpipefb.TypeNull,    // DT_QINT32 = 13;    // Quantized int32
-	graphpipefb.TypeNull,    // DT_BFLOAT16 = 14;  // Float32 truncated to 16 bits.  Only for cast ops.
-	graphpipefb.TypeNull,    // DT_QINT16 = 15;    // Quantized int16
-	graphpipefb.TypeNull,    // DT_QUINT16 = 16;   // Quantized uint16
-	graphpipefb.TypeUint16,  // DT_UINT16 = 17;
-	graphpipefb.TypeNull,    // DT_COMPLEX128 = 18;  // Double-precision complex
-	graphpipefb.TypeFloat16, // DT_HALF = 19;
-	graphpipefb.TypeNull,    // DT_RESOURCE = 20;
-	graphpipefb.TypeNull,    // DT_VARIANT = 21;  // Arbitrary C++ data types
-	graphpipefb.TypeUint32,  // DT_UINT32 = 22;
-	graphpipefb.TypeUint64,  // DT_UINT64 = 23;
+	graphpipefb.TypeNull,       // DT_INVALID = 0;
+	graphpipefb.TypeFloat32,    // DT_FLOAT = 1;
+	graphpipefb.TypeFloat64,    // DT_DOUBLE = 2;
+	graphpipefb.TypeInt32,      // DT_INT32 = 3;
+	graphpipefb.TypeUint8,      // DT_UINT8 = 4;
+	graphpipefb.TypeInt16,      // DT_INT16 = 5;
+	graphpipefb.TypeInt8,       // DT_INT8 = 6;
+	graphpipefb.TypeString,     // DT_STRING = 7;
+	graphpipefb.TypeComplex64,  // DT_COMPLEX64 = 8;  // Single-precision complex
+	graphpipefb.TypeInt64,      // DT_INT64 = 9;
+	graphpipefb.TypeBool,       // DT_BOOL = 10;
+	graphpipefb.TypeNull,       // DT_QINT8 = 11;     // Quantized int8
+	graphpipefb.TypeNull,       // DT_QUINT8 = 12;    // Quantized uint8
+	graphpipefb.TypeNull,       // DT_QINT32 = 13;    // Quantized int32
+	graphpipefb.TypeBFloat16,   // DT_BFLOAT16 = 14;  // Float32 truncated to 16 bits.  Only for cast ops.
+	graphpipefb.TypeNull,       // DT_QINT16 = 15;    // Quantized int16
+	graphpipefb.TypeNull,       // DT_QUINT16 = 16;   // Quantized uint16
+	graphpipefb.TypeUint16,     // DT_UINT16 = 17;
+	graphpipefb.TypeComplex128, // DT_COMPLEX128 = 18;  // Double-precision complex
+	graphpipefb.TypeFloat16,    // DT_HALF = 19;
+	graphpipefb.TypeNull,       // DT_RESOURCE = 20;
+	graphpipefb.TypeNull,       // DT_VARIANT = 21;  // Arbitrary C++ data types
+	graphpipefb.TypeUint32,     // DT_UINT32 = 22;
+	graphpipefb.TypeUint64,     // DT_UINT64 = 23;
 }
 
 func toFlatDtype(dt tf.DataType) byte {
@@ -424,12 +458,8 @@ func ntFromTensor(tensor *tf.Tensor) *graphpipe.NativeTensor {
 	for _, size := range tensor.Shape() {
 		nt.Shape = append(nt.Shape, int64(size))
 	}
-	// NOTE(vish): this could support multidimensional strings if we
-	//             had a way to flatten the tensor
 	if nt.Type == graphpipefb.TypeString {
-		for _, s := range tensor.Value().([]string) {
-			nt.StringVals = append(nt.StringVals, s)
-		}
+		nt.StringVals = flattenStrings(reflect.ValueOf(tensor.Value()), []string{})
 	} else {
 		buf := bytes.Buffer{}
 		tensor.WriteContentsTo(&buf)
@@ -438,6 +468,43 @@ func ntFromTensor(tensor *tf.Tensor) *graphpipe.NativeTensor {
 	return nt
 }
 
+// flattenStrings appends the strings in the nested slices of a string
+// tensor value in row major order.
+func flattenStrings(val reflect.Value, out []string) []string {
+	if val.Kind() == reflect.String {
+		return append(out, val.String())
+	}
+	for i := 0; i < val.Len(); i++ {
+		out = flattenStrings(val.Index(i), out)
+	}
+	return out
+}
+
+// nestStrings reshapes row major strings into the nested slices that
+// tf.NewTensor expects for shape.
+func nestStrings(vals []string, shape []int64) reflect.Value {
+	switch len(shape) {
+	case 0:
+		return reflect.ValueOf(vals[0])
+	case 1:
+		return reflect.ValueOf(vals)
+	}
+	typ := reflect.TypeOf(vals)
+	for range shape[1:] {
+		typ = reflect.SliceOf(typ)
+	}
+	rows := int(shape[0])
+	out := reflect.MakeSlice(typ, rows, rows)
+	size := 0
+	if rows > 0 {
+		size = len(vals) / rows
+	}
+	for i := 0; i < rows; i++ {
+		out.Index(i).Set(nestStrings(vals[i*size:(i+1)*size], shape[1:]))
+	}
+	return out
+}
+
 func getOutputRequests(c *tfContext, outputNames []string) ([]tf.Output, error) {
 	outputRequests := []tf.Output{}
 	for _, name := range outputNames {
@@ -456,24 +523,31 @@ func getOutputRequests(c *tfContext, outputNames []string) ([]tf.Output, error)
 }
 
 var gptype2tftype = []tf.DataType{
-	tf.DataType(tfproto.DataType_DT_INVALID), // Type_Null = 0,
-	tf.DataType(tfproto.DataType_DT_UINT8),   // Type_Uint8 = 1,
-	tf.DataType(tfproto.DataType_DT_INT8),    // Type_Int8 = 2,
-	tf.DataType(tfproto.DataType_DT_UINT16),  // Type_Uint16 = 3,
-	tf.DataType(tfproto.DataType_DT_INT16),   // Type_Int16 = 4,
-	tf.DataType(tfproto.DataType_DT_UINT32),  // Type_Uint32 = 5,
-	tf.DataType(tfproto.DataType_DT_INT32),   // Type_Int32 = 6,
-	tf.DataType(tfproto.DataType_DT_UINT64),  // Type_Uint64 = 7,
-	tf.DataType(tfproto.DataType_DT_INT64),   // Type_Int64 = 8,
-	tf.DataType(tfproto.DataType_DT_HALF),    // Type_Float16 = 9,
-	tf.DataType(tfproto.DataType_DT_FLOAT),   // Type_Float32 = 10,
-	tf.DataType(tfproto.DataType_DT_DOUBLE),  // Type_Float64 = 11,
-	tf.DataType(tfproto.DataType_DT_STRING),  // Type_String = 12,
+	tf.DataType(tfproto.DataType_DT_INVALID),    // Type_Null = 0,
+	tf.DataType(tfproto.DataType_DT_UINT8),      // Type_Uint8 = 1,
+	tf.DataType(tfproto.DataType_DT_INT8),       // Type_Int8 = 2,
+	tf.DataType(tfproto.DataType_DT_UINT16),     // Type_Uint16 = 3,
+	tf.DataType(tfproto.DataType_DT_INT16),      // Type_Int16 = 4,
+	tf.DataType(tfproto.DataType_DT_UINT32),     // Type_Uint32 = 5,
+	tf.DataType(tfproto.DataType_DT_INT32),      // Type_Int32 = 6,
+	tf.DataType(tfproto.DataType_DT_UINT64),     // Type_Uint64 = 7,
+	tf.DataType(tfproto.DataType_DT_INT64),      // Type_Int64 = 8,
+	tf.DataType(tfproto.DataType_DT_HALF),       // Type_Float16 = 9,
+	tf.DataType(tfproto.DataType_DT_FLOAT),      // Type_Float32 = 10,
+	tf.DataType(tfproto.DataType_DT_DOUBLE),     // Type_Float64 = 11,
+	tf.DataType(tfproto.DataType_DT_STRING),     // Type_String = 12,
+	tf.DataType(tfproto.DataType_DT_BFLOAT16),   // Type_BFloat16 = 13,
+	tf.DataType(tfproto.DataType_DT_BOOL),       // Type_Bool = 14,
+	tf.DataType(tfproto.DataType_DT_COMPLEX64),  // Type_Complex64 = 15,
+	tf.DataType(tfproto.DataType_DT_COMPLEX128), // Type_Complex128 = 16,
 }
 
 func tensorFromNT(nt *graphpipe.NativeTensor) (*tf.Tensor, error) {
 	if nt.Type == graphpipefb.TypeString {
-		return tf.NewTensor(nt.StringVals)
+		if err := nt.Validate(); err != nil {
+			return nil, err
+		}
+		return tf.NewTensor(nestStrings(nt.StringVals, nt.Shape).Interface())
 	}
 	dtype := gptype2tftype[nt.Type]
 	return tf.ReadTensor(dtype, nt.Shape, bytes.NewReader(nt.Data))
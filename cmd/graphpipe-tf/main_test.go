@@ -0,0 +1,73 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+	tf "github.com/tensorflow/tensorflow/tensorflow/go"
+)
+
+func TestStringTensors(t *testing.T) {
+	values := []interface{}{
+		"a",
+		[]string{"a", "b", "c"},
+		[][]string{{"a", "b", "c"}, {"d", "e", "f"}},
+		[][][]string{{{"a", "b"}, {"c", "d"}}, {{"e", "f"}, {"g", "h"}}},
+		[][]string{{"a"}, {"b"}, {"c"}},
+	}
+	for _, value := range values {
+		tensor, err := tf.NewTensor(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nt := ntFromTensor(tensor)
+		if nt.Type != graphpipefb.TypeString {
+			t.Errorf("Expected a string tensor, got type %d", nt.Type)
+		}
+		if !reflect.DeepEqual(nt.Shape, tensor.Shape()) {
+			t.Errorf("Expected shape %v, got %v", tensor.Shape(), nt.Shape)
+		}
+		expected := flattenStrings(reflect.ValueOf(value), []string{})
+		if !reflect.DeepEqual(nt.StringVals, expected) {
+			t.Errorf("Expected %v, got %v", expected, nt.StringVals)
+		}
+
+		back, err := tensorFromNT(nt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(back.Shape(), tensor.Shape()) {
+			t.Errorf("Expected shape %v, got %v", tensor.Shape(), back.Shape())
+		}
+		if !reflect.DeepEqual(back.Value(), value) {
+			t.Errorf("Expected %v, got %v", value, back.Value())
+		}
+	}
+}
+
+func TestStringTensorFromNT(t *testing.T) {
+	nt := &graphpipe.NativeTensor{}
+	if err := nt.InitWithStringVals([]string{"a", "b", "c", "d", "e", "f"}, []int64{3, 2}); err != nil {
+		t.Fatal(err)
+	}
+	tensor, err := tensorFromNT(nt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}}
+	if !reflect.DeepEqual(tensor.Value(), expected) {
+		t.Errorf("Expected %v, got %v", expected, tensor.Value())
+	}
+
+	nt.Shape = []int64{4, 2}
+	if _, err := tensorFromNT(nt); err == nil {
+		t.Errorf("Expected an error for a shape that does not match the strings")
+	}
+}
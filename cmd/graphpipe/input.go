@@ -0,0 +1,392 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+type inputSpec struct {
+	name  string
+	path  string
+	dtype uint8
+	shape []int64
+}
+
+func (spec *inputSpec) format() string {
+	switch strings.ToLower(filepath.Ext(spec.path)) {
+	case ".json":
+		return "json"
+	case ".npy":
+		return "npy"
+	case ".npz":
+		return "npz"
+	}
+	return "raw"
+}
+
+func needsMetadata(specs []*inputSpec) bool {
+	for _, spec := range specs {
+		switch spec.format() {
+		case "json":
+			if spec.dtype == graphpipefb.TypeNull {
+				return true
+			}
+		case "raw":
+			if spec.dtype == graphpipefb.TypeNull || spec.shape == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseDtype(name string) (uint8, error) {
+	name = strings.ToLower(name)
+	for dt, n := range graphpipefb.EnumNamesType {
+		if dt != graphpipefb.TypeNull && strings.ToLower(n) == name {
+			return uint8(dt), nil
+		}
+	}
+	return graphpipefb.TypeNull, fmt.Errorf("unknown dtype '%s'", name)
+}
+
+func dtypeName(dt uint8) string {
+	if name, ok := graphpipefb.EnumNamesType[int(dt)]; ok {
+		return strings.ToLower(name)
+	}
+	return fmt.Sprintf("unknown(%d)", dt)
+}
+
+func parseShape(dims string) ([]int64, error) {
+	shape := []int64{}
+	for _, d := range strings.Split(dims, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shape '%s'", dims)
+		}
+		shape = append(shape, v)
+	}
+	return shape, nil
+}
+
+func splitNameValue(s string) (string, string) {
+	idx := strings.Index(s, "=")
+	if idx < 0 {
+		return "", s
+	}
+	return s[:idx], s[idx+1:]
+}
+
+func parseInputSpecs(opts options) ([]*inputSpec, error) {
+	specs := []*inputSpec{}
+	byName := map[string]*inputSpec{}
+	for _, input := range opts.inputs {
+		name, path := splitNameValue(input)
+		spec := &inputSpec{name: name, path: path}
+		if name != "" {
+			if _, ok := byName[name]; ok {
+				return nil, fmt.Errorf("input '%s' was specified more than once", name)
+			}
+			byName[name] = spec
+		}
+		specs = append(specs, spec)
+	}
+	for _, dtype := range opts.dtypes {
+		name, value := splitNameValue(dtype)
+		spec, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("--dtype given for unknown input '%s'", name)
+		}
+		dt, err := parseDtype(value)
+		if err != nil {
+			return nil, err
+		}
+		spec.dtype = dt
+	}
+	for _, shape := range opts.shapes {
+		name, value := splitNameValue(shape)
+		spec, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("--shape given for unknown input '%s'", name)
+		}
+		var err error
+		if spec.shape, err = parseShape(value); err != nil {
+			return nil, err
+		}
+	}
+	return specs, nil
+}
+
+// fillFromMetadata uses the server metadata to fill in the dtype and shape
+// of an input if they were not given on the command line.
+func fillFromMetadata(spec *inputSpec, meta *graphpipe.NativeMetadataResponse) {
+	if meta == nil || spec.name == "" {
+		return
+	}
+	for _, io := range meta.Inputs {
+		if io.Name != spec.name {
+			continue
+		}
+		if spec.dtype == graphpipefb.TypeNull {
+			spec.dtype = io.Type
+		}
+		if spec.shape == nil {
+			spec.shape = io.Shape
+		}
+		return
+	}
+}
+
+func loadInput(spec *inputSpec, meta *graphpipe.NativeMetadataResponse) (*graphpipe.NativeTensor, error) {
+	data, err := ioutil.ReadFile(spec.path)
+	if err != nil {
+		return nil, err
+	}
+	switch spec.format() {
+	case "npy":
+		nt, err := graphpipe.ReadNpy(bytes.NewReader(data))
+		if err == nil && len(nt.Shape) == 0 {
+			// send scalars as a batch of one
+			nt.Shape = []int64{1}
+		}
+		return nt, err
+	case "json":
+		fillFromMetadata(spec, meta)
+		return tensorFromJSON(data, spec.dtype)
+	}
+	fillFromMetadata(spec, meta)
+	return tensorFromRaw(data, spec.dtype, spec.shape)
+}
+
+// loadNpz loads every array in an npz archive as a named input.
+func loadNpz(spec *inputSpec) (map[string]*graphpipe.NativeTensor, error) {
+	if spec.name != "" {
+		return nil, fmt.Errorf("npz inputs are named by the archive, not %s=", spec.name)
+	}
+	data, err := ioutil.ReadFile(spec.path)
+	if err != nil {
+		return nil, err
+	}
+	return graphpipe.ReadNpz(bytes.NewReader(data), int64(len(data)))
+}
+
+func tensorFromRaw(data []byte, dt uint8, shape []int64) (*graphpipe.NativeTensor, error) {
+	if dt == graphpipefb.TypeNull || dt == graphpipefb.TypeString {
+		return nil, fmt.Errorf("raw inputs need a numeric --dtype")
+	}
+	if shape == nil {
+		return nil, fmt.Errorf("raw inputs need a --shape")
+	}
+	size := int64(dtypeSize(dt))
+	if size <= 0 {
+		return nil, fmt.Errorf("unsupported dtype %s", dtypeName(dt))
+	}
+	shape = append([]int64{}, shape...)
+	unknown := -1
+	elems := int64(1)
+	for i, d := range shape {
+		if d < 0 {
+			if unknown >= 0 {
+				return nil, fmt.Errorf("shape %v has more than one unknown dimension", shape)
+			}
+			unknown = i
+			continue
+		}
+		elems *= d
+	}
+	if unknown >= 0 {
+		if elems == 0 || int64(len(data))%(elems*size) != 0 {
+			return nil, fmt.Errorf("%d bytes can not fill shape %v", len(data), shape)
+		}
+		shape[unknown] = int64(len(data)) / (elems * size)
+	}
+	nt := &graphpipe.NativeTensor{}
+	if err := nt.InitWithData(data, shape, dt); err != nil {
+		return nil, err
+	}
+	return nt, nil
+}
+
+func dtypeSize(dt uint8) int {
+	switch dt {
+	case graphpipefb.TypeUint8, graphpipefb.TypeInt8, graphpipefb.TypeBool:
+		return 1
+	case graphpipefb.TypeUint16, graphpipefb.TypeInt16, graphpipefb.TypeFloat16, graphpipefb.TypeBFloat16:
+		return 2
+	case graphpipefb.TypeUint32, graphpipefb.TypeInt32, graphpipefb.TypeFloat32:
+		return 4
+	case graphpipefb.TypeUint64, graphpipefb.TypeInt64, graphpipefb.TypeFloat64, graphpipefb.TypeComplex64:
+		return 8
+	case graphpipefb.TypeComplex128:
+		return 16
+	}
+	return -1
+}
+
+func tensorFromJSON(data []byte, dt uint8) (*graphpipe.NativeTensor, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var val interface{}
+	if err := decoder.Decode(&val); err != nil {
+		return nil, err
+	}
+	shape := []int64{}
+	for v := val; ; {
+		list, ok := v.([]interface{})
+		if !ok {
+			break
+		}
+		shape = append(shape, int64(len(list)))
+		if len(list) == 0 {
+			break
+		}
+		v = list[0]
+	}
+	if len(shape) == 0 {
+		return nil, fmt.Errorf("json input must be an array")
+	}
+	flat := []interface{}{}
+	if err := flattenJSON(val, shape, &flat); err != nil {
+		return nil, err
+	}
+
+	// half floats are read as float32 and cast afterwards
+	castTo := dt
+	if dt == graphpipefb.TypeFloat16 || dt == graphpipefb.TypeBFloat16 {
+		dt = graphpipefb.TypeFloat32
+	}
+	if dt == graphpipefb.TypeNull {
+		dt = graphpipefb.TypeFloat32
+		if len(flat) > 0 {
+			switch flat[0].(type) {
+			case string:
+				dt = graphpipefb.TypeString
+			case bool:
+				dt = graphpipefb.TypeBool
+			}
+		}
+	}
+	values, err := convertJSON(flat, dt)
+	if err != nil {
+		return nil, err
+	}
+	nt := &graphpipe.NativeTensor{}
+	if err := nt.InitSimple(values); err != nil {
+		return nil, err
+	}
+	nt.Shape = shape
+	if castTo != graphpipefb.TypeNull {
+		return nt.Cast(castTo)
+	}
+	return nt, nil
+}
+
+// flattenJSON walks nested json arrays in row major order, making sure that
+// they are not jagged.
+func flattenJSON(val interface{}, shape []int64, out *[]interface{}) error {
+	if len(shape) == 0 {
+		if _, ok := val.([]interface{}); ok {
+			return fmt.Errorf("json array is jagged")
+		}
+		*out = append(*out, val)
+		return nil
+	}
+	list, ok := val.([]interface{})
+	if !ok || int64(len(list)) != shape[0] {
+		return fmt.Errorf("json array is jagged")
+	}
+	for _, v := range list {
+		if err := flattenJSON(v, shape[1:], out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var jsonKinds = map[uint8]reflect.Type{
+	graphpipefb.TypeUint8:   reflect.TypeOf(uint8(0)),
+	graphpipefb.TypeInt8:    reflect.TypeOf(int8(0)),
+	graphpipefb.TypeUint16:  reflect.TypeOf(uint16(0)),
+	graphpipefb.TypeInt16:   reflect.TypeOf(int16(0)),
+	graphpipefb.TypeUint32:  reflect.TypeOf(uint32(0)),
+	graphpipefb.TypeInt32:   reflect.TypeOf(int32(0)),
+	graphpipefb.TypeUint64:  reflect.TypeOf(uint64(0)),
+	graphpipefb.TypeInt64:   reflect.TypeOf(int64(0)),
+	graphpipefb.TypeFloat32: reflect.TypeOf(float32(0)),
+	graphpipefb.TypeFloat64: reflect.TypeOf(float64(0)),
+	graphpipefb.TypeString:  reflect.TypeOf(""),
+	graphpipefb.TypeBool:    reflect.TypeOf(false),
+}
+
+// convertJSON converts decoded json values into a flat slice of the go type
+// matching dt.
+func convertJSON(flat []interface{}, dt uint8) (interface{}, error) {
+	typ, ok := jsonKinds[dt]
+	if !ok {
+		return nil, fmt.Errorf("unsupported dtype %s for json input", dtypeName(dt))
+	}
+	out := reflect.MakeSlice(reflect.SliceOf(typ), len(flat), len(flat))
+	for i, v := range flat {
+		elem := out.Index(i)
+		if typ.Kind() == reflect.Bool {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("expected a bool but got %v", v)
+			}
+			elem.SetBool(b)
+			continue
+		}
+		if typ.Kind() == reflect.String {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string but got %v", v)
+			}
+			elem.SetString(s)
+			continue
+		}
+		num, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("expected a number but got %v", v)
+		}
+		bits := int(typ.Size()) * 8
+		switch typ.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f, err := strconv.ParseFloat(num.String(), bits)
+			if err != nil {
+				return nil, err
+			}
+			elem.SetFloat(f)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u, err := strconv.ParseUint(num.String(), 10, bits)
+			if err != nil {
+				return nil, err
+			}
+			elem.SetUint(u)
+		default:
+			n, err := strconv.ParseInt(num.String(), 10, bits)
+			if err != nil {
+				return nil, err
+			}
+			elem.SetInt(n)
+		}
+	}
+	return out.Interface(), nil
+}
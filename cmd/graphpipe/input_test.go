@@ -0,0 +1,144 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+func TestParseInputSpecs(t *testing.T) {
+	tests := []struct {
+		opts  options
+		specs []*inputSpec
+		fails bool
+	}{
+		{
+			opts:  options{inputs: []string{"x=a.raw", "b.npz"}},
+			specs: []*inputSpec{{name: "x", path: "a.raw"}, {path: "b.npz"}},
+		},
+		{
+			opts: options{
+				inputs: []string{"x=a.raw", "y=b.json"},
+				dtypes: []string{"x=Float32", "y=int64"},
+				shapes: []string{"x=-1, 3"},
+			},
+			specs: []*inputSpec{
+				{name: "x", path: "a.raw", dtype: graphpipefb.TypeFloat32, shape: []int64{-1, 3}},
+				{name: "y", path: "b.json", dtype: graphpipefb.TypeInt64},
+			},
+		},
+		{opts: options{inputs: []string{"x=a.raw", "x=b.raw"}}, fails: true},
+		{opts: options{inputs: []string{"x=a.raw"}, dtypes: []string{"y=float32"}}, fails: true},
+		{opts: options{inputs: []string{"x=a.raw"}, dtypes: []string{"x=float128"}}, fails: true},
+		{opts: options{inputs: []string{"x=a.raw"}, shapes: []string{"y=1"}}, fails: true},
+		{opts: options{inputs: []string{"x=a.raw"}, shapes: []string{"x=1,two"}}, fails: true},
+	}
+	for i, test := range tests {
+		specs, err := parseInputSpecs(test.opts)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(specs, test.specs) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, test.specs, specs)
+		}
+	}
+}
+
+func writeTemp(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ints := &graphpipe.NativeTensor{}
+	ints.InitSimple([][]int32{{1, 2, 3}, {4, 5, 6}})
+	npy := &bytes.Buffer{}
+	if err := graphpipe.WriteNpy(npy, ints); err != nil {
+		t.Fatal(err)
+	}
+	raw := writeTemp(t, dir, "x.raw", ints.Data)
+	meta := &graphpipe.NativeMetadataResponse{
+		Inputs: []graphpipe.NativeIOMetadata{{Name: "x", Type: graphpipefb.TypeInt32, Shape: []int64{-1, 3}}},
+	}
+
+	tests := []struct {
+		spec     inputSpec
+		meta     *graphpipe.NativeMetadataResponse
+		expected interface{}
+	}{
+		{inputSpec{path: raw, dtype: graphpipefb.TypeInt32, shape: []int64{2, 3}}, nil, [][]int32{{1, 2, 3}, {4, 5, 6}}},
+		{inputSpec{path: raw, dtype: graphpipefb.TypeInt32, shape: []int64{-1}}, nil, []int32{1, 2, 3, 4, 5, 6}},
+		// the dtype and shape come from the metadata when they are not given
+		{inputSpec{name: "x", path: raw}, meta, [][]int32{{1, 2, 3}, {4, 5, 6}}},
+		{inputSpec{name: "x", path: raw, shape: []int64{3, 2}}, meta, [][]int32{{1, 2}, {3, 4}, {5, 6}}},
+		{inputSpec{path: writeTemp(t, dir, "x.npy", npy.Bytes())}, nil, [][]int32{{1, 2, 3}, {4, 5, 6}}},
+		{inputSpec{path: writeTemp(t, dir, "f.json", []byte("[[1.5, 2], [3, 4]]"))}, nil, [][]float32{{1.5, 2}, {3, 4}}},
+		{inputSpec{name: "x", path: writeTemp(t, dir, "i.json", []byte("[[1, 2, 3]]"))}, meta, [][]int32{{1, 2, 3}}},
+		{inputSpec{path: writeTemp(t, dir, "s.json", []byte(`["a", "b"]`))}, nil, []string{"a", "b"}},
+		{inputSpec{path: writeTemp(t, dir, "b.json", []byte("[true, false]"))}, nil, []bool{true, false}},
+		{inputSpec{path: writeTemp(t, dir, "h.json", []byte("[0.5, 2]")), dtype: graphpipefb.TypeFloat16}, nil,
+			[]graphpipe.Float16{graphpipe.Float32ToFloat16(0.5), graphpipe.Float32ToFloat16(2)}},
+	}
+	for i, test := range tests {
+		spec := test.spec
+		nt, err := loadInput(&spec, test.meta)
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		native, err := graphpipe.NativeTensorToNative(nt)
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(native, test.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expected, native)
+		}
+	}
+
+	bad := []inputSpec{
+		// raw inputs need a dtype and shape from somewhere
+		{path: raw},
+		{path: raw, dtype: graphpipefb.TypeInt32},
+		{path: raw, dtype: graphpipefb.TypeInt32, shape: []int64{4, -1}},
+		{path: raw, dtype: graphpipefb.TypeInt32, shape: []int64{-1, -1}},
+		{path: raw, dtype: graphpipefb.TypeString, shape: []int64{-1}},
+		{path: writeTemp(t, dir, "j.json", []byte("[[1, 2], [3]]"))},
+		{path: writeTemp(t, dir, "n.json", []byte("1"))},
+		{path: writeTemp(t, dir, "o.json", []byte("[300]")), dtype: graphpipefb.TypeUint8},
+		{path: filepath.Join(dir, "missing.raw")},
+	}
+	for i, spec := range bad {
+		spec := spec
+		if _, err := loadInput(&spec, nil); err == nil {
+			t.Errorf("Bad input %d: expected an error", i)
+		}
+	}
+}
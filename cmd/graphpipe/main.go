@@ -0,0 +1,232 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+)
+
+var (
+	ver string
+	sha string
+)
+
+func version() string {
+	if ver == "" {
+		ver = "dev"
+		sha = "unknown"
+	}
+	return fmt.Sprintf("version %s (built from sha %s)", ver, sha)
+}
+
+type options struct {
+	verbose      bool
+	version      bool
+	timeout      int
+	json         bool
+	config       string
+	inputs       []string
+	outputs      []string
+	dtypes       []string
+	shapes       []string
+	outputDir    string
+	outputFormat string
+}
+
+func main() {
+	var opts options
+	var cmdExitCode int
+
+	cmd := &cobra.Command{
+		Use:   "graphpipe",
+		Short: "graphpipe - command line client for graphpipe servers",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if opts.verbose {
+				logrus.SetLevel(logrus.DebugLevel)
+			} else {
+				logrus.SetLevel(logrus.InfoLevel)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				fmt.Printf("%s\n", version())
+				return
+			}
+			cmdExitCode = 1
+			cmd.Usage()
+		},
+	}
+	f := cmd.PersistentFlags()
+	f.BoolVarP(&opts.verbose, "verbose", "v", false, "verbose output")
+	f.BoolVarP(&opts.version, "version", "V", false, "show version")
+	f.IntVarP(&opts.timeout, "timeout", "t", 60, "request timeout, in seconds")
+
+	metadataCmd := &cobra.Command{
+		Use:   "metadata <url>",
+		Short: "print the metadata of a graphpipe server",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if err := metadata(opts, args[0]); err != nil {
+				logrus.Errorf("Failed to get metadata: %v", err)
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = metadataCmd.Flags()
+	f.BoolVarP(&opts.json, "json", "j", false, "print metadata as json")
+	cmd.AddCommand(metadataCmd)
+
+	inferCmd := &cobra.Command{
+		Use:   "infer <url>",
+		Short: "send an inference request to a graphpipe server",
+		Long: `Send an inference request to a graphpipe server.
+
+Inputs are given as [name=]path. Files ending in .json hold a (nested) array
+of numbers or strings, files ending in .npy are numpy arrays, files ending in
+.npz are numpy archives holding one array per named input and anything else
+is read as raw tensor data. Raw and json inputs take their dtype and shape from
+--dtype and --shape, falling back to the server metadata for the named input.
+If names are omitted the server default inputs are used in order.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if len(opts.inputs) == 0 {
+				cmdExitCode = 1
+				logrus.Infof("--input must be specified")
+				cmd.Usage()
+				return
+			}
+			if err := infer(opts, args[0]); err != nil {
+				logrus.Errorf("Failed to infer: %v", err)
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = inferCmd.Flags()
+	f.StringArrayVarP(&opts.inputs, "input", "i", nil, "input as [name=]path, may be repeated")
+	f.StringArrayVarP(&opts.outputs, "output", "o", nil, "output name, may be repeated")
+	f.StringVarP(&opts.config, "config", "c", "", "config string passed to the model")
+	f.StringArrayVarP(&opts.dtypes, "dtype", "", nil, "dtype of an input as name=dtype, e.g. x=float32")
+	f.StringArrayVarP(&opts.shapes, "shape", "", nil, "shape of an input as name=dims, e.g. x=1,224,224,3")
+	f.StringVarP(&opts.outputDir, "output-dir", "", "", "write outputs to files in this directory instead of printing them")
+	f.StringVarP(&opts.outputFormat, "output-format", "", "npy", "format of written outputs (npy, npz, json or raw)")
+	f.BoolVarP(&opts.json, "json", "j", false, "print outputs as json")
+	cmd.AddCommand(inferCmd)
+
+	cmd.Execute()
+	os.Exit(cmdExitCode)
+}
+
+func newClient(opts options) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(opts.timeout) * time.Second,
+	}
+}
+
+func metadata(opts options, uri string) error {
+	meta, err := graphpipe.Metadata(newClient(opts), uri)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(os.Stdout, meta)
+	}
+	printMetadata(os.Stdout, meta)
+	return nil
+}
+
+func infer(opts options, uri string) error {
+	client := newClient(opts)
+	specs, err := parseInputSpecs(opts)
+	if err != nil {
+		return err
+	}
+
+	var meta *graphpipe.NativeMetadataResponse
+	if needsMetadata(specs) {
+		meta, err = graphpipe.Metadata(client, uri)
+		if err != nil {
+			logrus.Warnf("Could not get metadata to fill in dtypes and shapes: %v", err)
+		}
+	}
+
+	req := graphpipe.NewInferRequest().Config(opts.config).Output(opts.outputs...)
+	for _, spec := range specs {
+		if spec.format() == "npz" {
+			tensors, err := loadNpz(spec)
+			if err != nil {
+				return fmt.Errorf("could not load input '%s': %v", spec.path, err)
+			}
+			names := make([]string, 0, len(tensors))
+			for name := range tensors {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				req.Input(name, tensors[name])
+			}
+			continue
+		}
+		nt, err := loadInput(spec, meta)
+		if err != nil {
+			return fmt.Errorf("could not load input '%s': %v", spec.path, err)
+		}
+		req.Input(spec.name, nt)
+	}
+
+	named, err := req.Send(client, uri)
+	if err != nil {
+		return err
+	}
+	names, outputs, err := selectOutputs(named, opts.outputs)
+	if err != nil {
+		return err
+	}
+
+	if opts.outputDir != "" {
+		return writeOutputs(opts.outputDir, opts.outputFormat, names, outputs)
+	}
+	if opts.json {
+		return printOutputsJSON(os.Stdout, names, outputs)
+	}
+	return printOutputs(os.Stdout, names, outputs)
+}
+
+// selectOutputs returns the outputs named by --output in order, or all of
+// them sorted by name if none were named.
+func selectOutputs(named map[string]*graphpipe.NativeTensor, names []string) ([]string, []*graphpipe.NativeTensor, error) {
+	if len(names) == 0 {
+		for name := range named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	outputs := make([]*graphpipe.NativeTensor, len(names))
+	for i, name := range names {
+		nt, ok := named[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("output '%s' is missing from the response", name)
+		}
+		outputs[i] = nt
+	}
+	return names, outputs, nil
+}
@@ -0,0 +1,229 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+const (
+	// print at most this many elements before summarizing
+	summaryThreshold = 1000
+	// number of leading and trailing items shown in a summarized dimension
+	edgeItems = 3
+)
+
+func printJSON(w io.Writer, val interface{}) error {
+	js, err := json.MarshalIndent(val, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", js)
+	return nil
+}
+
+func formatShape(shape []int64) string {
+	dims := make([]string, len(shape))
+	for i, d := range shape {
+		if d < 0 {
+			dims[i] = "?"
+		} else {
+			dims[i] = fmt.Sprintf("%d", d)
+		}
+	}
+	return "[" + strings.Join(dims, ", ") + "]"
+}
+
+func printMetadata(w io.Writer, meta *graphpipe.NativeMetadataResponse) {
+	fmt.Fprintf(w, "Name:        %s\n", meta.Name)
+	fmt.Fprintf(w, "Version:     %s\n", meta.Version)
+	fmt.Fprintf(w, "Server:      %s\n", meta.Server)
+	fmt.Fprintf(w, "Description: %s\n", meta.Description)
+	printIOMetadata(w, "Inputs", meta.Inputs)
+	printIOMetadata(w, "Outputs", meta.Outputs)
+}
+
+func printIOMetadata(w io.Writer, title string, ios []graphpipe.NativeIOMetadata) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  NAME\tTYPE\tSHAPE\tDESCRIPTION\n")
+	for _, io := range ios {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", io.Name, dtypeName(io.Type), formatShape(io.Shape), io.Description)
+	}
+	tw.Flush()
+}
+
+func printOutputs(w io.Writer, names []string, outputs []*graphpipe.NativeTensor) error {
+	for i, nt := range outputs {
+		native, err := graphpipe.NativeTensorToNative(nt)
+		if err != nil {
+			return fmt.Errorf("could not convert output '%s': %v", names[i], err)
+		}
+		fmt.Fprintf(w, "%s: %s%s\n", names[i], dtypeName(nt.Type), formatShape(nt.Shape))
+		elems := int64(1)
+		for _, d := range nt.Shape {
+			elems *= d
+		}
+		buf := &bytes.Buffer{}
+		formatValue(buf, reflect.ValueOf(native), 0, elems > summaryThreshold)
+		fmt.Fprintf(w, "%s\n", buf.String())
+	}
+	return nil
+}
+
+// formatValue writes nested slices numpy style, with one innermost row per
+// line. If summarize is set, long dimensions are shortened to their first
+// and last few items.
+func formatValue(w *bytes.Buffer, val reflect.Value, depth int, summarize bool) {
+	if val.Kind() != reflect.Slice {
+		if val.Kind() == reflect.String {
+			fmt.Fprintf(w, "%q", val.String())
+		} else {
+			fmt.Fprintf(w, "%v", val.Interface())
+		}
+		return
+	}
+	n := val.Len()
+	nested := n > 0 && val.Index(0).Kind() == reflect.Slice
+	w.WriteString("[")
+	for i := 0; i < n; i++ {
+		if summarize && n > 2*edgeItems && i == edgeItems {
+			if nested {
+				w.WriteString("\n" + strings.Repeat(" ", depth+1) + "...,\n" + strings.Repeat(" ", depth+1))
+			} else {
+				w.WriteString("..., ")
+			}
+			i = n - edgeItems
+		}
+		formatValue(w, val.Index(i), depth+1, summarize)
+		if i < n-1 {
+			if nested {
+				w.WriteString(",\n" + strings.Repeat(" ", depth+1))
+			} else {
+				w.WriteString(", ")
+			}
+		}
+	}
+	w.WriteString("]")
+}
+
+type jsonTensor struct {
+	Type  string      `json:"type"`
+	Shape []int64     `json:"shape"`
+	Data  interface{} `json:"data"`
+}
+
+func toJSONTensor(nt *graphpipe.NativeTensor) (*jsonTensor, error) {
+	native, err := graphpipe.NativeTensorToNative(nt)
+	if err != nil {
+		return nil, err
+	}
+	if nt.Type == graphpipefb.TypeUint8 {
+		// keep byte slices from being base64 encoded
+		native = byteSliceToInts(reflect.ValueOf(native)).Interface()
+	}
+	return &jsonTensor{dtypeName(nt.Type), nt.Shape, native}, nil
+}
+
+func byteSliceToInts(val reflect.Value) reflect.Value {
+	if val.Type().Elem().Kind() == reflect.Uint8 {
+		ints := make([]int, val.Len())
+		for i := range ints {
+			ints[i] = int(val.Index(i).Uint())
+		}
+		return reflect.ValueOf(ints)
+	}
+	out := make([]interface{}, val.Len())
+	for i := range out {
+		out[i] = byteSliceToInts(val.Index(i)).Interface()
+	}
+	return reflect.ValueOf(out)
+}
+
+func printOutputsJSON(w io.Writer, names []string, outputs []*graphpipe.NativeTensor) error {
+	res := map[string]*jsonTensor{}
+	for i, nt := range outputs {
+		jt, err := toJSONTensor(nt)
+		if err != nil {
+			return fmt.Errorf("could not convert output '%s': %v", names[i], err)
+		}
+		res[names[i]] = jt
+	}
+	return printJSON(w, res)
+}
+
+// fileName turns a tensor name like "loss/Softmax:0" into something
+// that is safe to use as a file name.
+func fileName(name string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "\\", "_").Replace(name)
+}
+
+func writeOutputs(dir string, format string, names []string, outputs []*graphpipe.NativeTensor) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if format == "npz" {
+		// all outputs go in one archive
+		path := filepath.Join(dir, "outputs.npz")
+		tensors := map[string]*graphpipe.NativeTensor{}
+		for i, nt := range outputs {
+			tensors[names[i]] = nt
+		}
+		buf := &bytes.Buffer{}
+		if err := graphpipe.WriteNpz(buf, tensors); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		logrus.Infof("Wrote %d outputs to %s", len(outputs), path)
+		return nil
+	}
+	for i, nt := range outputs {
+		path := filepath.Join(dir, fileName(names[i])+"."+format)
+		buf := &bytes.Buffer{}
+		switch format {
+		case "npy":
+			if err := graphpipe.WriteNpy(buf, nt); err != nil {
+				return err
+			}
+		case "json":
+			jt, err := toJSONTensor(nt)
+			if err != nil {
+				return err
+			}
+			if err := printJSON(buf, jt.Data); err != nil {
+				return err
+			}
+		case "raw":
+			if nt.Type == graphpipefb.TypeString {
+				return fmt.Errorf("string output '%s' can not be written as raw", names[i])
+			}
+			buf.Write(nt.Data)
+		default:
+			return fmt.Errorf("unknown output format '%s'", format)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		logrus.Infof("Wrote %s%s output '%s' to %s", dtypeName(nt.Type), formatShape(nt.Shape), names[i], path)
+	}
+	return nil
+}
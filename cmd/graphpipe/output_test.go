@@ -0,0 +1,140 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+)
+
+func mustTensor(t *testing.T, v interface{}) *graphpipe.NativeTensor {
+	nt := &graphpipe.NativeTensor{}
+	if err := nt.InitSimple(v); err != nil {
+		t.Fatal(err)
+	}
+	return nt
+}
+
+func TestSelectOutputs(t *testing.T) {
+	a := mustTensor(t, []int32{1})
+	b := mustTensor(t, []int32{2})
+	named := map[string]*graphpipe.NativeTensor{"b": b, "a": a}
+
+	tests := []struct {
+		requested []string
+		names     []string
+		outputs   []*graphpipe.NativeTensor
+	}{
+		{nil, []string{"a", "b"}, []*graphpipe.NativeTensor{a, b}},
+		{[]string{"b", "a"}, []string{"b", "a"}, []*graphpipe.NativeTensor{b, a}},
+		{[]string{"a", "c"}, nil, nil},
+	}
+	for i, test := range tests {
+		names, outputs, err := selectOutputs(named, test.requested)
+		if test.names == nil {
+			if err == nil || !strings.Contains(err.Error(), "'c'") {
+				t.Errorf("Test %d: expected an error naming the missing output, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(outputs, test.outputs) {
+			t.Errorf("Test %d: got %v %v", i, names, outputs)
+		}
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	floats := mustTensor(t, [][]float32{{1, 2}, {3, 4}})
+	bytesOut := mustTensor(t, []uint8{5, 6})
+	names := []string{"loss/Softmax:0", "bytes"}
+	outputs := []*graphpipe.NativeTensor{floats, bytesOut}
+
+	tests := []struct {
+		format string
+		files  map[string]string
+	}{
+		{"json", map[string]string{
+			"loss_Softmax_0.json": "[\n    [\n        1,\n        2\n    ],\n    [\n        3,\n        4\n    ]\n]\n",
+			"bytes.json":          "[\n    5,\n    6\n]\n",
+		}},
+		{"raw", map[string]string{
+			"loss_Softmax_0.raw": string(floats.Data),
+			"bytes.raw":          "\x05\x06",
+		}},
+	}
+	for _, test := range tests {
+		sub := filepath.Join(dir, test.format)
+		if err := writeOutputs(sub, test.format, names, outputs); err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range test.files {
+			data, err := ioutil.ReadFile(filepath.Join(sub, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expected {
+				t.Errorf("Expected %s to hold %q, got %q", name, expected, data)
+			}
+		}
+	}
+
+	sub := filepath.Join(dir, "npy")
+	if err := writeOutputs(sub, "npy", names, outputs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sub, "loss_Softmax_0.npy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt, err := graphpipe.ReadNpy(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nt, floats) {
+		t.Errorf("Expected the npy output to read back the same, got %v", nt)
+	}
+
+	sub = filepath.Join(dir, "npz")
+	if err := writeOutputs(sub, "npz", names, outputs); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(sub, "outputs.npz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tensors, err := graphpipe.ReadNpz(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tensors, map[string]*graphpipe.NativeTensor{names[0]: floats, names[1]: bytesOut}) {
+		t.Errorf("Expected the npz outputs to read back the same, got %v", tensors)
+	}
+
+	strs := mustTensor(t, []string{"a"})
+	if err := writeOutputs(dir, "raw", []string{"s"}, []*graphpipe.NativeTensor{strs}); err == nil {
+		t.Errorf("Expected an error writing strings as raw")
+	}
+	if err := writeOutputs(dir, "csv", names, outputs); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
@@ -49,6 +49,11 @@ func TestConversion(t *testing.T) {
 	testConvert(t, [][]int32{{1}, {2}, {3}})
 	testConvert(t, []float32{1.0, 2.0, 3.0})
 	testConvert(t, [][]float32{{1.0}, {2.0}, {3.0}})
+	testConvert(t, []Float16{0x3c00, 0x4000, 0x4200})
+	testConvert(t, [][]BFloat16{{0x3f80}, {0x4000}, {0x4040}})
+	testConvert(t, [][]bool{{true, false}, {false, true}})
+	testConvert(t, []complex64{1 + 2i, 3 - 4i})
+	testConvert(t, [][]complex128{{1 + 2i}, {3 - 4i}})
 }
 
 func testConvert(t *testing.T, val interface{}) {
@@ -0,0 +1,355 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// errFlightAbandoned is returned to the duplicates of a computation that
+// ended without a result, for example because apply panicked.
+var errFlightAbandoned = errors.New("Coalesced computation was abandoned")
+
+// flightGroup coalesces identical computations that are in flight at the
+// same time, so that duplicates wait for the first one and share its
+// result instead of running the model again.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+	// hashed counts the flights of uncached requests that are registered
+	// under their full key, by their shape key
+	hashed map[string]int
+}
+
+// flight is a computation that duplicates can wait for. retry is set when
+// it failed because of the request that started it, for example because
+// the client went away, so that the duplicates try again themselves.
+type flight struct {
+	done  chan struct{}
+	val   interface{}
+	err   error
+	retry bool
+	dups  int
+	// shape is the shape key of an uncached request, which it is
+	// registered under if ownsShape is set. full is its full key if it is
+	// registered under that too, which is only once requests overlap.
+	shape     string
+	ownsShape bool
+	full      string
+	// keyMu guards key and hash, which computes key the first time it is
+	// needed and is cleared once the inputs it reads are no longer valid
+	keyMu sync.Mutex
+	key   string
+	hash  func() string
+}
+
+// join returns the flight for key, and true if the caller started it and
+// must finish and forget it.
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls == nil {
+		g.calls = map[string]*flight{}
+	}
+	if f, ok := g.calls[key]; ok {
+		f.dups++
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	return f, true
+}
+
+// forget removes the flight for key so that later callers start a new one,
+// and returns how many duplicates joined it.
+func (g *flightGroup) forget(key string, f *flight) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == f {
+		delete(g.calls, key)
+	}
+	return f.dups
+}
+
+// fullKey returns the key of the request that started f, hashing it the
+// first time. It returns false if the request is done with its inputs
+// before they were hashed.
+func (f *flight) fullKey() (string, bool) {
+	f.keyMu.Lock()
+	defer f.keyMu.Unlock()
+	if f.key == "" && f.hash != nil {
+		f.key = f.hash()
+	}
+	return f.key, f.key != ""
+}
+
+// release stops the inputs of f from being hashed, waiting for a hash in
+// progress to end.
+func (f *flight) release() {
+	f.keyMu.Lock()
+	f.hash = nil
+	f.keyMu.Unlock()
+}
+
+// joinRequest returns the flight for an uncached request, and true if the
+// caller started it and must finish it and call forgetRequest. Requests are
+// first matched by shapeKey, which is cheap, and only hashed with hash once
+// they overlap with a request of the same shape, so that a request alone
+// in flight is never hashed.
+func (g *flightGroup) joinRequest(shapeKey string, hash func() string) (*flight, bool) {
+	shapeKey = "request shape\x00" + shapeKey
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flight{}
+	}
+	if g.hashed == nil {
+		g.hashed = map[string]int{}
+	}
+	other := g.calls[shapeKey]
+	if other == nil && g.hashed[shapeKey] == 0 {
+		f := &flight{done: make(chan struct{}), shape: shapeKey, ownsShape: true, hash: hash}
+		g.calls[shapeKey] = f
+		g.mu.Unlock()
+		return f, true
+	}
+	g.mu.Unlock()
+
+	// hash outside the lock, since the inputs can be large
+	key := hash()
+	otherKey, hashed := "", false
+	if other != nil {
+		otherKey, hashed = other.fullKey()
+	}
+	full := "request\x00" + key
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if hashed && otherKey == key && g.calls[shapeKey] == other {
+		other.dups++
+		return other, false
+	}
+	if f, ok := g.calls[full]; ok {
+		f.dups++
+		return f, false
+	}
+	f := &flight{done: make(chan struct{}), shape: shapeKey, full: full, key: key}
+	g.calls[full] = f
+	g.hashed[shapeKey]++
+	if g.calls[shapeKey] == nil {
+		// take the free slot, so that later requests of this shape are
+		// compared with this one first
+		f.ownsShape = true
+		g.calls[shapeKey] = f
+	}
+	return f, true
+}
+
+// forgetRequest removes the flight of an uncached request so that later
+// requests start a new one, and returns how many duplicates joined it.
+func (g *flightGroup) forgetRequest(f *flight) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f.ownsShape && g.calls[f.shape] == f {
+		delete(g.calls, f.shape)
+	}
+	if f.full != "" && g.calls[f.full] == f {
+		delete(g.calls, f.full)
+		if g.hashed[f.shape]--; g.hashed[f.shape] == 0 {
+			delete(g.hashed, f.shape)
+		}
+	}
+	return f.dups
+}
+
+// finish stores the result and wakes up the duplicates.
+func (f *flight) finish(val interface{}, err error) {
+	f.val, f.err = val, err
+	close(f.done)
+}
+
+func (f *flight) wait() (interface{}, error) {
+	<-f.done
+	return f.val, f.err
+}
+
+// rowResult is a row computed by another request, with the type and shape
+// and data of each output.
+type rowResult struct {
+	typeShape [][]byte
+	data      [][]byte
+}
+
+// fillRow copies a row computed by another request into data. It returns
+// false if the row does not match the outputs that were already found, in
+// which case it must be computed again.
+func fillRow(res *rowResult, typeShape [][]byte, data [][][]byte, row, numChunks int) bool {
+	for i := range typeShape {
+		if res.typeShape[i] == nil || res.data[i] == nil {
+			return false
+		}
+		if typeShape[i] != nil && string(typeShape[i]) != string(res.typeShape[i]) {
+			return false
+		}
+	}
+	for i := range typeShape {
+		if typeShape[i] == nil {
+			typeShape[i] = res.typeShape[i]
+			allocOutput(data[i], typeShape[i], numChunks)
+		}
+		if data[i][row] == nil {
+			data[i][row] = res.data[i]
+		} else {
+			copy(data[i][row], res.data[i])
+		}
+	}
+	return true
+}
+
+// requestKey identifies an uncached request by everything that apply is
+// called with.
+func requestKey(c *appContext, config string, inputs map[string]*NativeTensor, outputNames []string) string {
+	h := keyHash(c)()
+	h.Write(keySalt(c.modelID, config))
+	b := make([]byte, 8)
+	write := func(p []byte) {
+		binary.LittleEndian.PutUint64(b, uint64(len(p)))
+		h.Write(b)
+		h.Write(p)
+	}
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nt := inputs[name]
+		write([]byte(name))
+		write([]byte{nt.Type})
+		for _, dim := range nt.Shape {
+			binary.LittleEndian.PutUint64(b, uint64(dim))
+			h.Write(b)
+		}
+		if nt.Type == graphpipefb.TypeString {
+			for _, s := range nt.StringVals {
+				write([]byte(s))
+			}
+		} else {
+			write(nt.Data)
+		}
+	}
+	for _, name := range outputNames {
+		write([]byte(name))
+	}
+	return string(h.Sum(nil))
+}
+
+// requestShapeKey describes an uncached request by its config, the names,
+// types and sizes of its inputs and its outputs, which is enough to tell
+// most different requests apart without reading their data.
+func requestShapeKey(config string, inputs map[string]*NativeTensor, outputNames []string) string {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := []byte(config)
+	for _, name := range names {
+		nt := inputs[name]
+		b = append(b, 0)
+		b = append(b, name...)
+		b = append(b, 0, nt.Type)
+		for _, dim := range nt.Shape {
+			b = strconv.AppendInt(append(b, ' '), dim, 10)
+		}
+		b = strconv.AppendInt(append(b, ' '), int64(len(nt.Data)), 10)
+	}
+	for _, name := range outputNames {
+		b = append(b, 0)
+		b = append(b, name...)
+	}
+	return string(b)
+}
+
+// cloneTensors copies the results of apply for duplicate requests, since
+// the memory of the originals may be released by their CleanupFunc.
+func cloneTensors(tensors []*NativeTensor) []*NativeTensor {
+	clones := make([]*NativeTensor, len(tensors))
+	for i, nt := range tensors {
+		if nt == nil {
+			continue
+		}
+		clones[i] = &NativeTensor{
+			Type:       nt.Type,
+			Shape:      copyShape(nt.Shape),
+			StringVals: append([]string(nil), nt.StringVals...),
+			Data:       copyBytes(nt.Data),
+		}
+	}
+	return clones
+}
+
+// applyCoalesced calls apply, unless an identical request is already doing
+// so, in which case it waits for and shares that result. Requests are only
+// hashed to find duplicates once they overlap with a request of the same
+// shape.
+func applyCoalesced(c *appContext, requestContext *RequestContext, config string, inputs map[string]*NativeTensor, outputNames []string) ([]*NativeTensor, error) {
+	shapeKey := requestShapeKey(config, inputs, outputNames)
+	key := ""
+	hash := func() string {
+		// a retry hashes the request again otherwise
+		if key == "" {
+			key = requestKey(c, config, inputs, outputNames)
+		}
+		return key
+	}
+	for {
+		f, leader := c.flights.joinRequest(shapeKey, hash)
+		if leader {
+			return leadFlight(c, f, requestContext, config, inputs, outputNames)
+		}
+		logrus.Debugf("Waiting for an identical request in flight")
+		val, err := f.wait()
+		if err == nil {
+			return val.([]*NativeTensor), nil
+		}
+		if !f.retry {
+			return nil, err
+		}
+		logrus.Debugf("Retrying because the identical request was aborted: %v", err)
+	}
+}
+
+// leadFlight calls apply for the flight f and shares the result with the
+// duplicates that joined it.
+func leadFlight(c *appContext, f *flight, requestContext *RequestContext, config string, inputs map[string]*NativeTensor, outputNames []string) (results []*NativeTensor, err error) {
+	finished := false
+	defer func() {
+		// the inputs may be released once we return
+		f.release()
+		if !finished {
+			c.flights.forgetRequest(f)
+			f.finish(nil, errFlightAbandoned)
+		}
+	}()
+	results, err = c.apply(requestContext, config, inputs, outputNames)
+	// nobody can join once the flight is forgotten, so the duplicates
+	// are known before the results are shared
+	shared := results
+	if c.flights.forgetRequest(f) > 0 && err == nil {
+		shared = cloneTensors(results)
+	}
+	f.retry = err != nil && requestContext != nil && !requestContext.IsAlive()
+	finished = true
+	f.finish(shared, err)
+	return results, err
+}
@@ -0,0 +1,281 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// waitForDups waits until n duplicates have joined the flights of g. Zero
+// waits for every flight to end.
+func waitForDups(t *testing.T, g *flightGroup, n int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		// a flight can be registered under two keys
+		flights := map[*flight]bool{}
+		for _, f := range g.calls {
+			flights[f] = true
+		}
+		dups, calls := 0, len(flights)
+		for f := range flights {
+			dups += f.dups
+		}
+		g.mu.Unlock()
+		if dups == n && (n > 0 || calls == 0) {
+			return
+		}
+	}
+	t.Errorf("Timed out waiting for %d duplicates", n)
+}
+
+// runConcurrently runs get for n identical requests once the first one is
+// in apply and the rest have joined it.
+func runConcurrently(t *testing.T, c *appContext, n, rows int, get func(*appContext, *RequestContext, *graphpipefb.InferRequest) ([]*NativeTensor, error)) ([][]*NativeTensor, []error) {
+	tp := makeTensor(rows, 0, graphpipefb.TypeFloat32)
+	req := makeRequestRaw(tp)
+	results := make([][]*NativeTensor, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			rc := &RequestContext{builder: fb.NewBuilder(1024)}
+			results[i], errs[i] = get(c, rc, req)
+		}(i)
+	}
+	wg.Wait()
+	for i := range results {
+		if errs[i] == nil && !bytes.Equal(results[i][0].Data, tp.Data) {
+			t.Errorf("Request %d got the wrong results", i)
+		}
+	}
+	return results, errs
+}
+
+func blockingApply(t *testing.T, c *appContext, calls *int32, dups int, fail error) {
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		if atomic.AddInt32(calls, 1) == 1 {
+			waitForDups(t, &c.flights, dups)
+			if fail != nil {
+				return nil, fail
+			}
+		}
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+}
+
+// gatedApply holds every apply until dups duplicates have joined a flight.
+func gatedApply(t *testing.T, c *appContext, calls *int32, dups int, fail error) {
+	gate := make(chan struct{})
+	go func() {
+		waitForDups(t, &c.flights, dups)
+		close(gate)
+	}()
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		atomic.AddInt32(calls, 1)
+		<-gate
+		if fail != nil {
+			return nil, fail
+		}
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+}
+
+func TestCoalescedResults(t *testing.T) {
+	c := &appContext{}
+	calls := int32(0)
+	gatedApply(t, c, &calls, 4, nil)
+	_, errs := runConcurrently(t, c, 5, 3, getResults)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 apply, got %d", calls)
+	}
+	if len(c.flights.calls) != 0 || len(c.flights.hashed) != 0 {
+		t.Errorf("Expected no flights to be left, got %d", len(c.flights.calls))
+	}
+
+	// duplicates share the error of the request they joined
+	calls = 0
+	fail := errors.New("failed")
+	gatedApply(t, c, &calls, 4, fail)
+	_, errs = runConcurrently(t, c, 5, 3, getResults)
+	for _, err := range errs {
+		if err != fail {
+			t.Errorf("Expected the shared error, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 apply, got %d", calls)
+	}
+}
+
+func TestCoalescedFirstRequest(t *testing.T) {
+	c := &appContext{}
+	calls := int32(0)
+	// the first request is in apply before the second one arrives
+	blockingApply(t, c, &calls, 1, nil)
+	_, errs := runConcurrently(t, c, 2, 3, getResults)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 apply, got %d", calls)
+	}
+}
+
+func TestCoalescedSameShape(t *testing.T) {
+	c := &appContext{}
+	// requests of the same shape but different data are not coalesced
+	var both sync.WaitGroup
+	both.Add(2)
+	calls := int32(0)
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		atomic.AddInt32(&calls, 1)
+		both.Done()
+		both.Wait()
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+	tps := []*NativeTensor{makeTensor(3, 0, graphpipefb.TypeFloat32), makeTensor(3, 0, graphpipefb.TypeFloat32)}
+	results := make([][]*NativeTensor, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := range tps {
+		go func(i int) {
+			defer wg.Done()
+			rc := &RequestContext{builder: fb.NewBuilder(1024)}
+			results[i], errs[i] = getResults(c, rc, makeRequestRaw(tps[i]))
+		}(i)
+	}
+	wg.Wait()
+	for i := range tps {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !bytes.Equal(results[i][0].Data, tps[i].Data) {
+			t.Errorf("Request %d got the wrong results", i)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 applies, got %d", calls)
+	}
+}
+
+func TestCoalescedAbortedLeader(t *testing.T) {
+	c := &appContext{}
+	aborted := errors.New("aborted")
+	calls := int32(0)
+	c.apply = func(rc *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			waitForDups(t, &c.flights, 1)
+			rc.SetDead()
+			return nil, aborted
+		}
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+	tp := makeTensor(2, 0, graphpipefb.TypeFloat32)
+	req := makeRequestRaw(tp)
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := getResults(c, &RequestContext{builder: fb.NewBuilder(1024)}, req)
+		leaderErr <- err
+	}()
+	for start := time.Now(); atomic.LoadInt32(&calls) == 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the duplicate runs apply itself rather than sharing the error
+	results, err := getResults(c, &RequestContext{builder: fb.NewBuilder(1024)}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(results[0].Data, tp.Data) {
+		t.Errorf("Results are not the same as the input")
+	}
+	if err := <-leaderErr; err != aborted {
+		t.Errorf("Expected the leader to be aborted, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 applies, got %d", calls)
+	}
+}
+
+func TestCoalescedCachedResults(t *testing.T) {
+	c := &appContext{cache: NewMemoryCache(1 << 20)}
+	calls := int32(0)
+	// each of the 3 rows has its own flight
+	blockingApply(t, c, &calls, 3*4, nil)
+	_, errs := runConcurrently(t, c, 5, 3, getResultsCached)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 apply, got %d", calls)
+	}
+
+	// when the first request fails, the duplicates compute the rows
+	waitForDups(t, &c.flights, 0)
+	c.cache = NewMemoryCache(1 << 20)
+	calls = 0
+	fail := errors.New("failed")
+	blockingApply(t, c, &calls, 3*4, fail)
+	_, errs = runConcurrently(t, c, 5, 3, getResultsCached)
+	failed := 0
+	for _, err := range errs {
+		if err == fail {
+			failed++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if failed != 1 || calls != 5 {
+		t.Errorf("Expected 1 failure in 5 applies, got %d in %d", failed, calls)
+	}
+}
+
+func TestCoalescedDuplicateRows(t *testing.T) {
+	c := &appContext{cache: NewMemoryCache(1 << 20)}
+	applied := []int64{}
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		in := inputs["some/input/name:0"]
+		applied = append(applied, in.Shape[0])
+		return []*NativeTensor{in, in}, nil
+	}
+	tp := makeTensor(1, 0, graphpipefb.TypeFloat32)
+	twice, _ := Concat([]*NativeTensor{tp, tp})
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	results, err := getResultsCached(c, rc, makeRequestRaw(twice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(results[1].Data, twice.Data) {
+		t.Errorf("Results are not the same as the input")
+	}
+	if len(applied) != 1 || applied[0] != 1 {
+		t.Errorf("Expected the repeated row to be computed once, got %v", applied)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"math"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// Float16 is an IEEE 754 half precision float. Go has no native half
+// type, so tensors of TypeFloat16 convert to and from []Float16.
+type Float16 uint16
+
+// BFloat16 is a brain float: the top 16 bits of a float32. Tensors of
+// TypeBFloat16 convert to and from []BFloat16.
+type BFloat16 uint16
+
+// Float32ToFloat16 converts a float32 to the nearest Float16, rounding
+// half to even. Values too large for a half become infinity.
+func Float32ToFloat16(f float32) Float16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int32(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+
+	if exp == 0xff {
+		if mant != 0 {
+			// keep nans quiet
+			return Float16(sign | 0x7e00)
+		}
+		return Float16(sign | 0x7c00)
+	}
+
+	exp = exp - 127 + 15
+	if exp >= 0x1f {
+		return Float16(sign | 0x7c00)
+	}
+	if exp <= 0 {
+		// too small for a normal half, so make a subnormal
+		if exp < -10 {
+			return Float16(sign)
+		}
+		mant |= 0x800000
+		shift := uint32(14 - exp)
+		half := mant >> shift
+		rem := mant & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if rem > halfway || (rem == halfway && half&1 == 1) {
+			half++
+		}
+		return Float16(sign | uint16(half))
+	}
+
+	// rounding up can carry into the exponent, which is still correct
+	half := uint32(exp)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return Float16(sign | uint16(half))
+}
+
+// Float32 converts a Float16 to a float32. This is exact.
+func (h Float16) Float32() float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		// normalize the subnormal
+		exp = 127 - 15 + 1
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+		mant &= 0x3ff
+		return math.Float32frombits(sign | exp<<23 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
+
+// Float32ToBFloat16 converts a float32 to the nearest BFloat16, rounding
+// half to even.
+func Float32ToBFloat16(f float32) BFloat16 {
+	bits := math.Float32bits(f)
+	if bits&0x7fffffff > 0x7f800000 {
+		// keep nans quiet, since truncating could turn them into infinity
+		return BFloat16(bits>>16 | 0x40)
+	}
+	bits += 0x7fff + (bits>>16)&1
+	return BFloat16(bits >> 16)
+}
+
+// Float32 converts a BFloat16 to a float32. This is exact.
+func (b BFloat16) Float32() float32 {
+	return math.Float32frombits(uint32(b) << 16)
+}
+
+func isFloatType(dt uint8) bool {
+	switch dt {
+	case graphpipefb.TypeFloat16, graphpipefb.TypeBFloat16,
+		graphpipefb.TypeFloat32, graphpipefb.TypeFloat64:
+		return true
+	}
+	return false
+}
+
+// floatsFromData widens the data of a float tensor to float64.
+func floatsFromData(data []byte, dt uint8) []float64 {
+	n := len(data) / int(types[dt].size)
+	vals := make([]float64, n)
+	if n == 0 {
+		return vals
+	}
+	switch src := types[dt].conv(data).(type) {
+	case []Float16:
+		for i := range vals {
+			vals[i] = float64(src[i].Float32())
+		}
+	case []BFloat16:
+		for i := range vals {
+			vals[i] = float64(src[i].Float32())
+		}
+	case []float32:
+		for i := range vals {
+			vals[i] = float64(src[i])
+		}
+	case []float64:
+		copy(vals, src)
+	}
+	return vals
+}
+
+// dataFromFloats narrows float64 values to the data of a float tensor.
+func dataFromFloats(vals []float64, dt uint8) []byte {
+	data := make([]byte, len(vals)*int(types[dt].size))
+	if len(vals) == 0 {
+		return data
+	}
+	switch dst := types[dt].conv(data).(type) {
+	case []Float16:
+		for i := range vals {
+			dst[i] = Float32ToFloat16(float32(vals[i]))
+		}
+	case []BFloat16:
+		for i := range vals {
+			dst[i] = Float32ToBFloat16(float32(vals[i]))
+		}
+	case []float32:
+		for i := range vals {
+			dst[i] = float32(vals[i])
+		}
+	case []float64:
+		copy(dst, vals)
+	}
+	return data
+}
@@ -0,0 +1,142 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+func TestFloat16(t *testing.T) {
+	cases := []struct {
+		f float32
+		h Float16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.5, 0x3800},
+		{65504, 0x7bff},                     // largest half
+		{float32(math.Pow(2, -14)), 0x0400}, // smallest normal
+		{float32(math.Pow(2, -24)), 0x0001}, // smallest subnormal
+		{float32(math.Inf(1)), 0x7c00},
+		{float32(math.Inf(-1)), 0xfc00},
+	}
+	for _, c := range cases {
+		if h := Float32ToFloat16(c.f); h != c.h {
+			t.Errorf("Float32ToFloat16(%v) = %#04x, expected %#04x", c.f, h, c.h)
+		}
+		if f := c.h.Float32(); f != c.f {
+			t.Errorf("Float16(%#04x).Float32() = %v, expected %v", c.h, f, c.f)
+		}
+	}
+
+	rounding := []struct {
+		f float32
+		h Float16
+	}{
+		{65520, 0x7c00},                         // overflows to infinity
+		{1 + float32(math.Pow(2, -11)), 0x3c00}, // halfway rounds to even
+		{1 + 3*float32(math.Pow(2, -11)), 0x3c02},
+		{float32(math.Pow(2, -25)), 0x0000},
+		{float32(math.Pow(2, -26)), 0x0000},
+		{1.5 * float32(math.Pow(2, -24)), 0x0002},
+	}
+	for _, c := range rounding {
+		if h := Float32ToFloat16(c.f); h != c.h {
+			t.Errorf("Float32ToFloat16(%v) = %#04x, expected %#04x", c.f, h, c.h)
+		}
+	}
+
+	nan := Float32ToFloat16(float32(math.NaN()))
+	if !math.IsNaN(float64(nan.Float32())) {
+		t.Errorf("Expected nan, got %v", nan.Float32())
+	}
+
+	// every half survives a round trip through float32
+	for i := 0; i < 0x10000; i++ {
+		h := Float16(i)
+		f := h.Float32()
+		if math.IsNaN(float64(f)) {
+			continue
+		}
+		if back := Float32ToFloat16(f); back != h {
+			t.Fatalf("Float16 %#04x round tripped to %#04x", h, back)
+		}
+	}
+}
+
+func TestBFloat16(t *testing.T) {
+	cases := []struct {
+		f float32
+		b BFloat16
+	}{
+		{0, 0x0000},
+		{1, 0x3f80},
+		{-2, 0xc000},
+		{float32(math.Inf(1)), 0x7f80},
+		{1 + float32(math.Pow(2, -8)), 0x3f80}, // halfway rounds to even
+		{1 + 3*float32(math.Pow(2, -8)), 0x3f82},
+	}
+	for _, c := range cases {
+		if b := Float32ToBFloat16(c.f); b != c.b {
+			t.Errorf("Float32ToBFloat16(%v) = %#04x, expected %#04x", c.f, b, c.b)
+		}
+	}
+	nan := Float32ToBFloat16(math.Float32frombits(0x7f800001))
+	if !math.IsNaN(float64(nan.Float32())) {
+		t.Errorf("Expected nan, got %v", nan.Float32())
+	}
+}
+
+func TestHalfTensors(t *testing.T) {
+	nt := &NativeTensor{}
+	if err := nt.InitSimple([][]Float16{{0x3c00, 0x4000}, {0x4200, 0x4400}}); err != nil {
+		t.Fatal(err)
+	}
+	if nt.Type != graphpipefb.TypeFloat16 {
+		t.Fatalf("Expected TypeFloat16, got %d", nt.Type)
+	}
+	native, err := NativeTensorToNative(nt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]Float16{{0x3c00, 0x4000}, {0x4200, 0x4400}}
+	if !reflect.DeepEqual(native, expected) {
+		t.Errorf("Expected %v, got %v", expected, native)
+	}
+
+	plain := &NativeTensor{}
+	plain.InitSimple([]uint16{1, 2})
+	if plain.Type != graphpipefb.TypeUint16 {
+		t.Errorf("Expected []uint16 to stay TypeUint16, got %d", plain.Type)
+	}
+}
+
+func TestCastFloat(t *testing.T) {
+	nt := &NativeTensor{}
+	nt.InitSimple([][]float32{{1, 2}, {3, 4}})
+	for _, dt := range []uint8{graphpipefb.TypeFloat16, graphpipefb.TypeBFloat16, graphpipefb.TypeFloat64} {
+		cast, err := nt.Cast(dt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cast.Type != dt || !reflect.DeepEqual(cast.Shape, nt.Shape) {
+			t.Fatalf("Bad cast to %d: %v", dt, cast)
+		}
+		back, err := cast.Cast(graphpipefb.TypeFloat32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(back, nt) {
+			t.Errorf("Cast through %d did not round trip: %v", dt, back)
+		}
+	}
+}
@@ -66,8 +66,25 @@ func (rcv *InferResponse) ErrorsLength() int {
 	return 0
 }
 
+func (rcv *InferResponse) OutputNames(j int) []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.ByteVector(a + flatbuffers.UOffsetT(j*4))
+	}
+	return nil
+}
+
+func (rcv *InferResponse) OutputNamesLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
 func InferResponseStart(builder *flatbuffers.Builder) {
-	builder.StartObject(2)
+	builder.StartObject(3)
 }
 func InferResponseAddOutputTensors(builder *flatbuffers.Builder, outputTensors flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(outputTensors), 0)
@@ -81,6 +98,12 @@ func InferResponseAddErrors(builder *flatbuffers.Builder, errors flatbuffers.UOf
 func InferResponseStartErrorsVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(4, numElems, 4)
 }
+func InferResponseAddOutputNames(builder *flatbuffers.Builder, outputNames flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(2, flatbuffers.UOffsetT(outputNames), 0)
+}
+func InferResponseStartOutputNamesVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(4, numElems, 4)
+}
 func InferResponseEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
@@ -16,6 +16,10 @@ const (
 	TypeFloat32 = 10
 	TypeFloat64 = 11
 	TypeString = 12
+	TypeBFloat16 = 13
+	TypeBool = 14
+	TypeComplex64 = 15
+	TypeComplex128 = 16
 )
 
 var EnumNamesType = map[int]string{
@@ -32,5 +36,9 @@ var EnumNamesType = map[int]string{
 	TypeFloat32:"Float32",
 	TypeFloat64:"Float64",
 	TypeString:"String",
+	TypeBFloat16:"BFloat16",
+	TypeBool:"Bool",
+	TypeComplex64:"Complex64",
+	TypeComplex128:"Complex128",
 }
 
@@ -7,7 +7,6 @@ package graphpipe
 
 import (
 	"fmt"
-	"math"
 	"reflect"
 	"unsafe"
 
@@ -22,30 +21,62 @@ func Serialize(b *fb.Builder, obj fb.UOffsetT) []byte {
 	return b.FinishedBytes()
 }
 
-// TensorToNativeTensor is a converter between the flatbuffer Tensor
-// objects and the easier to use NativeTensor objects.
-func TensorToNativeTensor(t *graphpipefb.Tensor) *NativeTensor {
+// recoverMalformed turns the panic from reading a flatbuffer that is cut
+// short or has bad offsets into an error. It must be deferred.
+func recoverMalformed(err *error) {
+	if r := recover(); r != nil {
+		*err = &TensorError{Err: ErrMalformedTensor, Detail: fmt.Sprint(r)}
+	}
+}
+
+// tensorShape copies the shape out of a flatbuffer Tensor.
+func tensorShape(t *graphpipefb.Tensor) []int64 {
 	shape := make([]int64, t.ShapeLength())
-	for i := 0; i < t.ShapeLength(); i++ {
+	for i := 0; i < len(shape); i++ {
 		shape[i] = t.Shape(i)
 	}
+	return shape
+}
+
+// TensorToNativeTensor is a converter between the flatbuffer Tensor
+// objects and the easier to use NativeTensor objects. The tensor is checked
+// first, so it is safe to use on tensors from untrusted sources. The error is
+// a *TensorError if the tensor is invalid or the flatbuffer is malformed.
+func TensorToNativeTensor(t *graphpipefb.Tensor) (_ *NativeTensor, err error) {
+	defer recoverMalformed(&err)
+	dt := t.Type()
+	if int(dt) >= len(types) || dt == graphpipefb.TypeNull {
+		return nil, &TensorError{Err: ErrUnknownType, Detail: fmt.Sprintf("%d", dt)}
+	}
+	shape := tensorShape(t)
+	// check the shape before allocating anything based on it
+	elems, err := checkShape(shape, types[dt].size)
+	if err != nil {
+		return nil, err
+	}
 	nt := &NativeTensor{}
-	if t.Type() == graphpipefb.TypeString {
-		vals := make([]string, t.StringValLength())
+	if dt == graphpipefb.TypeString {
+		if int64(t.StringValLength()) != elems {
+			return nil, &TensorError{Err: ErrDataLength, Detail: fmt.Sprintf("shape %v needs %d strings but there are %d", shape, elems, t.StringValLength())}
+		}
+		vals := make([]string, elems)
 		for i := 0; i < len(vals); i++ {
 			vals[i] = string(t.StringVal(i))
 		}
-		nt.InitWithStringVals(vals, shape)
+		err = nt.InitWithStringVals(vals, shape)
 	} else {
-		nt.InitWithData(t.DataBytes(), shape, t.Type())
+		err = nt.InitWithData(t.DataBytes(), shape, dt)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return nt
+	return nt, nil
 }
 
 // NativeTensorToNative is a converter between NativeTensors and raw
 // arrays of arrays (of arrays of arrays) of numbers.
 func NativeTensorToNative(t *NativeTensor) (interface{}, error) {
-	if int(t.Type) > len(types) {
+	if int(t.Type) >= len(types) {
 		return nil, fmt.Errorf("Unknown type: %d", t.Type)
 	}
 
@@ -93,7 +124,7 @@ func NativeTensorToNative(t *NativeTensor) (interface{}, error) {
 // cast to a proper type. For example:
 // x := TensorToNative(t).([][]float32)
 func TensorToNative(t *graphpipefb.Tensor) (interface{}, error) {
-	if int(t.Type()) > len(types) {
+	if int(t.Type()) >= len(types) {
 		return nil, fmt.Errorf("Unknown type: %d", t.Type())
 	}
 
@@ -195,53 +226,105 @@ func BuildStringTensorRaw(b *fb.Builder, strs []string, shape []int64) fb.UOffse
 
 type converter func([]byte) interface{}
 
+// castBytes points the slice header at out to the data in b, as elements of
+// size bytes. The slice is left nil if b holds no whole elements.
+func castBytes(b []byte, size int, out unsafe.Pointer) {
+	n := len(b) / size
+	if n == 0 {
+		return
+	}
+	h := (*reflect.SliceHeader)(out)
+	h.Data = uintptr(unsafe.Pointer(&b[0]))
+	h.Len = n
+	h.Cap = n
+}
+
 func toUint8(b []byte) interface{} {
 	return b
 }
 
 func toInt8(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]int8)(ptr))[:len(b)]
+	var s []int8
+	castBytes(b, 1, unsafe.Pointer(&s))
+	return s
 }
 
 func toUint16(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]uint16)(ptr))[:len(b)/2]
+	var s []uint16
+	castBytes(b, 2, unsafe.Pointer(&s))
+	return s
 }
 
 func toInt16(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]int16)(ptr))[:len(b)/2]
+	var s []int16
+	castBytes(b, 2, unsafe.Pointer(&s))
+	return s
 }
 
 func toUint32(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]uint32)(ptr))[:len(b)/4]
+	var s []uint32
+	castBytes(b, 4, unsafe.Pointer(&s))
+	return s
 }
 
 func toInt32(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]int32)(ptr))[:len(b)/4]
+	var s []int32
+	castBytes(b, 4, unsafe.Pointer(&s))
+	return s
 }
 
 func toUint64(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]uint64)(ptr))[:len(b)/8]
+	var s []uint64
+	castBytes(b, 8, unsafe.Pointer(&s))
+	return s
 }
 
 func toInt64(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]int64)(ptr))[:len(b)/8]
+	var s []int64
+	castBytes(b, 8, unsafe.Pointer(&s))
+	return s
+}
+
+func toFloat16(b []byte) interface{} {
+	var s []Float16
+	castBytes(b, 2, unsafe.Pointer(&s))
+	return s
+}
+
+func toBFloat16(b []byte) interface{} {
+	var s []BFloat16
+	castBytes(b, 2, unsafe.Pointer(&s))
+	return s
 }
 
 func toFloat32(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]float32)(ptr))[:len(b)/4]
+	var s []float32
+	castBytes(b, 4, unsafe.Pointer(&s))
+	return s
 }
 
 func toFloat64(b []byte) interface{} {
-	ptr := unsafe.Pointer(&b[0])
-	return (*(*[math.MaxUint32]float64)(ptr))[:len(b)/8]
+	var s []float64
+	castBytes(b, 8, unsafe.Pointer(&s))
+	return s
+}
+
+func toBool(b []byte) interface{} {
+	var s []bool
+	castBytes(b, 1, unsafe.Pointer(&s))
+	return s
+}
+
+func toComplex64(b []byte) interface{} {
+	var s []complex64
+	castBytes(b, 8, unsafe.Pointer(&s))
+	return s
+}
+
+func toComplex128(b []byte) interface{} {
+	var s []complex128
+	castBytes(b, 16, unsafe.Pointer(&s))
+	return s
 }
 
 var types = []struct {
@@ -258,10 +341,14 @@ var types = []struct {
 	{reflect.TypeOf(int32(0)), 4, toInt32},
 	{reflect.TypeOf(uint64(0)), 8, toUint64},
 	{reflect.TypeOf(int64(0)), 8, toInt64},
-	{reflect.TypeOf(struct{}{}), 2, nil}, // no native float16
+	{reflect.TypeOf(Float16(0)), 2, toFloat16},
 	{reflect.TypeOf(float32(0)), 4, toFloat32},
 	{reflect.TypeOf(float64(0)), 8, toFloat64},
 	{reflect.TypeOf(""), -1, nil},
+	{reflect.TypeOf(BFloat16(0)), 2, toBFloat16},
+	{reflect.TypeOf(false), 1, toBool},
+	{reflect.TypeOf(complex64(0)), 8, toComplex64},
+	{reflect.TypeOf(complex128(0)), 16, toComplex128},
 }
 
 func sliceData(typ reflect.Type, data reflect.Value, shape []int) reflect.Value {
@@ -302,8 +389,15 @@ func ShapeType(val reflect.Value) (shape []int64, num int64, size int64, dt uint
 	if len(shape) == 0 {
 		num = 0
 	}
+	// named types like Float16 need an exact match, since their kind is
+	// shared with a plain type
+	for dt, t := range types {
+		if typ == t.typ {
+			return shape, num, t.size, uint8(dt), nil
+		}
+	}
 	for dt, t := range types {
-		if typ.Kind() == t.typ.Kind() {
+		if dt != graphpipefb.TypeNull && typ.Kind() == t.typ.Kind() {
 			return shape, num, t.size, uint8(dt), nil
 		}
 	}
@@ -327,42 +421,57 @@ func extractStrs(val reflect.Value, out []string) {
 }
 
 // pointerToData  gets a pointer to the underlying data of a slice
-// or array
+// or array. Arrays are only read in place if they are addressable, so
+// callers should pass addressable values to avoid copies.
 func pointerToData(val reflect.Value) unsafe.Pointer {
+	if !val.CanAddr() {
+		x := reflect.New(val.Type())
+		x.Elem().Set(val)
+		val = x.Elem()
+	}
 	typ := val.Type()
-	for typ.Kind() == reflect.Slice {
+	for typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
 		typ = typ.Elem()
 		if val.Len() > 0 {
 			val = val.Index(0)
 		} else {
-			val = reflect.Zero(typ)
+			val = reflect.New(typ).Elem()
 		}
 		if typ.Kind() == reflect.Interface {
 			val = reflect.ValueOf(val.Interface())
 			typ = val.Type()
+			if !val.CanAddr() {
+				x := reflect.New(typ)
+				x.Elem().Set(val)
+				val = x.Elem()
+			}
 		}
 	}
-	if typ.Kind() == reflect.Array {
-		x := reflect.New(typ)
-		x.Elem().Set(val)
-		val = x
-	} else {
-		val = val.Addr()
+	return unsafe.Pointer(val.Addr().Pointer())
+}
+
+// indirectInterface returns the value held by an interface.
+func indirectInterface(val reflect.Value) reflect.Value {
+	if val.Kind() == reflect.Interface {
+		return val.Elem()
 	}
-	return unsafe.Pointer(val.Pointer())
+	return val
+}
+
+func isNested(val reflect.Value) bool {
+	return val.Kind() == reflect.Slice || val.Kind() == reflect.Array
 }
 
 // fillContiguous fills a contiguous byte array from nested values
 func fillContiguous(val reflect.Value, out []byte) {
-	nestedKind := val.Index(0).Type().Kind()
-	nested := nestedKind == reflect.Slice
+	nested := isNested(indirectInterface(val.Index(0)))
 	outLen := len(out)
 	rows := val.Len()
 	cols := outLen / rows
 	for i := 0; i < rows; i++ {
 		o := i * cols
 		if nested {
-			fillContiguous(val.Index(i), out[o:o+cols])
+			fillContiguous(indirectInterface(val.Index(i)), out[o:o+cols])
 		} else {
 			data, _ := getDataContiguous(val.Index(i), cols)
 			copy(out[o:o+cols], data)
@@ -378,24 +487,32 @@ func checkData(val reflect.Value, size int) (bool, error) {
 	}
 	rows := val.Len()
 	cols := size / rows
+	if val.Index(0).Kind() == reflect.Interface && !isNested(val.Index(0).Elem()) {
+		// each value is boxed on its own
+		return false, nil
+	}
 	contiguous := true
-	if val.Index(0).Type().Kind() == reflect.Slice {
-		num := val.Index(0).Len()
+	first := indirectInterface(val.Index(0))
+	if isNested(first) {
+		num := first.Len()
 		var base uintptr
 		if cols != 0 {
 			base = uintptr(pointerToData(val))
 		}
 		for i := 0; i < rows; i++ {
-			if num != val.Index(i).Len() {
+			row := indirectInterface(val.Index(i))
+			if !isNested(row) || num != row.Len() {
 				return false, fmt.Errorf("Nested slice is the wrong size")
 			}
-			var err error
-			contiguous, err = checkData(val.Index(i), cols)
+			c, err := checkData(row, cols)
 			if err != nil {
 				return false, err
 			}
+			if !c {
+				contiguous = false
+			}
 			if base != 0 {
-				ptr := uintptr(pointerToData(val.Index(i)))
+				ptr := uintptr(pointerToData(row))
 				if ptr-base != uintptr(i*cols) {
 					contiguous = false
 				}
@@ -409,8 +526,11 @@ func getDataContiguous(val reflect.Value, size int) ([]byte, error) {
 	if size == 0 {
 		return []byte{}, nil
 	}
-	ptr := pointerToData(val)
-	data := (*(*[math.MaxUint32]byte)(ptr))[:size]
+	var data []byte
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	h.Data = uintptr(pointerToData(val))
+	h.Len = size
+	h.Cap = size
 	return data, nil
 }
 
@@ -421,6 +541,12 @@ func getDataNonContiguous(val reflect.Value, size int) ([]byte, error) {
 }
 
 func getDataSafe(val reflect.Value, size int) ([]byte, error) {
+	if !val.CanAddr() && val.Kind() == reflect.Array {
+		// copy arrays once, so that their nested data can be read in place
+		x := reflect.New(val.Type())
+		x.Elem().Set(val)
+		val = x.Elem()
+	}
 	contiguous, err := checkData(val, size)
 	if err != nil {
 		return nil, err
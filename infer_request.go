@@ -0,0 +1,257 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// InferRequest collects the inputs, outputs and config for a remote model
+// request. It is built up with chained calls:
+//
+//	req := NewInferRequest().Input("x", tensor).Output("y").Config(cfg)
+//
+// Problems like duplicate names or mismatched batch dimensions are recorded
+// as they are found and returned by Err, Build, Serialize and Send.
+type InferRequest struct {
+	config      string
+	inputs      []*NativeTensor
+	inputNames  []string
+	outputNames []string
+	rows        int64
+	err         error
+}
+
+// NewInferRequest creates an empty InferRequest.
+func NewInferRequest() *InferRequest {
+	return &InferRequest{rows: -1}
+}
+
+// Input adds an input tensor. An empty name means the server default input
+// at the same position is used, in which case no input may be named.
+func (r *InferRequest) Input(name string, nt *NativeTensor) *InferRequest {
+	if r.err != nil {
+		return r
+	}
+	if nt == nil {
+		r.err = fmt.Errorf("Input %d ('%s') is nil", len(r.inputs), name)
+		return r
+	}
+	if len(r.inputs) > 0 && (name != "") != (len(r.inputNames) > 0) {
+		r.err = fmt.Errorf("Either all or none of the inputs must be named")
+		return r
+	}
+	for _, other := range r.inputNames {
+		if other == name {
+			r.err = fmt.Errorf("Duplicate input name '%s'", name)
+			return r
+		}
+	}
+	if len(nt.Shape) > 0 {
+		if r.rows >= 0 && nt.Shape[0] != r.rows {
+			r.err = fmt.Errorf("Input %d ('%s') has %d rows but previous inputs have %d", len(r.inputs), name, nt.Shape[0], r.rows)
+			return r
+		}
+		r.rows = nt.Shape[0]
+	}
+	r.inputs = append(r.inputs, nt)
+	if name != "" {
+		r.inputNames = append(r.inputNames, name)
+	}
+	return r
+}
+
+// Output adds the names of requested outputs. If no outputs are added the
+// server defaults are returned.
+func (r *InferRequest) Output(names ...string) *InferRequest {
+	if r.err != nil {
+		return r
+	}
+	for _, name := range names {
+		if name == "" {
+			r.err = fmt.Errorf("Output name can not be empty")
+			return r
+		}
+		for _, other := range r.outputNames {
+			if other == name {
+				r.err = fmt.Errorf("Duplicate output name '%s'", name)
+				return r
+			}
+		}
+		r.outputNames = append(r.outputNames, name)
+	}
+	return r
+}
+
+// Config sets the config string that is passed to the model.
+func (r *InferRequest) Config(config string) *InferRequest {
+	r.config = config
+	return r
+}
+
+// Err returns the first problem found while building the request.
+func (r *InferRequest) Err() error {
+	if r.err == nil && len(r.inputs) == 0 {
+		return fmt.Errorf("Request has no inputs")
+	}
+	return r.err
+}
+
+// Rows returns the batch dimension shared by the inputs, or -1 if
+// no input has a shape.
+func (r *InferRequest) Rows() int64 {
+	return r.rows
+}
+
+// Build builds the flatbuffer InferRequest using b.
+func (r *InferRequest) Build(b *fb.Builder) (fb.UOffsetT, error) {
+	if err := r.Err(); err != nil {
+		return 0, err
+	}
+	return buildInferRequest(b, r.config, r.inputs, r.inputNames, r.outputNames), nil
+}
+
+// Serialize encodes the request as a complete flatbuffer Request, ready to
+// be posted to a server.
+func (r *InferRequest) Serialize() ([]byte, error) {
+	b := fb.NewBuilder(1024)
+	inferRequestOffset, err := r.Build(b)
+	if err != nil {
+		return nil, err
+	}
+	graphpipefb.RequestStart(b)
+	graphpipefb.RequestAddReqType(b, graphpipefb.ReqInferRequest)
+	graphpipefb.RequestAddReq(b, inferRequestOffset)
+	requestOffset := graphpipefb.RequestEnd(b)
+	return Serialize(b, requestOffset), nil
+}
+
+// Send sends the request to a remote model and returns the outputs keyed
+// by name, like MultiRemoteRawMap.
+func (r *InferRequest) Send(client *http.Client, uri string) (map[string]*NativeTensor, error) {
+	buf, err := r.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	outputs, names, err := sendInferRequest(client, uri, buf)
+	if err != nil {
+		return nil, err
+	}
+	return nameOutputs(client, uri, outputs, names, r.outputNames)
+}
+
+// SendRaw sends the request to a remote model and returns the outputs in
+// order, like MultiRemoteRaw.
+func (r *InferRequest) SendRaw(client *http.Client, uri string) ([]*NativeTensor, error) {
+	buf, err := r.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	outputs, _, err := sendInferRequest(client, uri, buf)
+	return outputs, err
+}
+
+type jsonInput struct {
+	Name   string       `json:"name"`
+	Tensor NativeTensor `json:"tensor"`
+}
+
+type jsonInferRequest struct {
+	Config  string      `json:"config"`
+	Inputs  []jsonInput `json:"inputs"`
+	Outputs []string    `json:"outputs"`
+}
+
+// MarshalJSON encodes the request as json in the form:
+//
+//	{"config": "", "inputs": [{"name": "x", "tensor": {...}}], "outputs": ["y"]}
+func (r *InferRequest) MarshalJSON() ([]byte, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	jr := jsonInferRequest{
+		Config:  r.config,
+		Inputs:  make([]jsonInput, len(r.inputs)),
+		Outputs: r.outputNames,
+	}
+	for i := range r.inputs {
+		if len(r.inputNames) > 0 {
+			jr.Inputs[i].Name = r.inputNames[i]
+		}
+		jr.Inputs[i].Tensor = *r.inputs[i]
+	}
+	return json.Marshal(jr)
+}
+
+// UnmarshalJSON decodes a request encoded by MarshalJSON, validating it
+// like the builder methods do.
+func (r *InferRequest) UnmarshalJSON(data []byte) error {
+	jr := jsonInferRequest{}
+	if err := json.Unmarshal(data, &jr); err != nil {
+		return err
+	}
+	*r = *NewInferRequest()
+	r.Config(jr.Config)
+	for i := range jr.Inputs {
+		r.Input(jr.Inputs[i].Name, &jr.Inputs[i].Tensor)
+	}
+	r.Output(jr.Outputs...)
+	return r.Err()
+}
+
+func buildInferRequest(b *fb.Builder, config string, inputs []*NativeTensor, inputNames, outputNames []string) fb.UOffsetT {
+	inStrs := make([]fb.UOffsetT, len(inputNames))
+	outStrs := make([]fb.UOffsetT, len(outputNames))
+
+	for i := range inStrs {
+		inStrs[i] = b.CreateString(inputNames[i])
+	}
+
+	for i := range outStrs {
+		outStrs[i] = b.CreateString(outputNames[i])
+	}
+
+	graphpipefb.InferRequestStartInputNamesVector(b, len(inStrs))
+	for i := len(inStrs) - 1; i >= 0; i-- {
+		offset := inStrs[i]
+		b.PrependUOffsetT(offset)
+	}
+
+	inputNamesOffset := b.EndVector(len(inStrs))
+
+	graphpipefb.InferRequestStartOutputNamesVector(b, len(outStrs))
+	for i := len(outStrs) - 1; i >= 0; i-- {
+		offset := outStrs[i]
+		b.PrependUOffsetT(offset)
+	}
+	outputNamesOffset := b.EndVector(len(outStrs))
+
+	inputOffsets := make([]fb.UOffsetT, len(inputs))
+	for i := 0; i < len(inputs); i++ {
+		inputOffsets[i] = inputs[i].Build(b)
+	}
+
+	graphpipefb.InferRequestStartInputTensorsVector(b, len(inputs))
+	for i := len(inputOffsets) - 1; i >= 0; i-- {
+		offset := inputOffsets[i]
+		b.PrependUOffsetT(offset)
+	}
+	inputTensors := b.EndVector(len(inputs))
+
+	configString := b.CreateString(config)
+
+	graphpipefb.InferRequestStart(b)
+	graphpipefb.InferRequestAddInputNames(b, inputNamesOffset)
+	graphpipefb.InferRequestAddOutputNames(b, outputNamesOffset)
+	graphpipefb.InferRequestAddInputTensors(b, inputTensors)
+	graphpipefb.InferRequestAddConfig(b, configString)
+	return graphpipefb.InferRequestEnd(b)
+}
@@ -0,0 +1,98 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+func mustTensor(t *testing.T, val interface{}) *NativeTensor {
+	nt := &NativeTensor{}
+	if err := nt.InitSimple(val); err != nil {
+		t.Fatal(err)
+	}
+	return nt
+}
+
+func TestInferRequestBuild(t *testing.T) {
+	x := mustTensor(t, [][]float32{{1, 2}, {3, 4}})
+	s := mustTensor(t, []string{"a", "b"})
+	req := NewInferRequest().Input("x", x).Input("s", s).Output("y", "z").Config("cfg")
+	b := fb.NewBuilder(1024)
+	offset, err := req.Build(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir := graphpipefb.GetRootAsInferRequest(Serialize(b, offset), 0)
+	if string(ir.Config()) != "cfg" {
+		t.Errorf("Expected config 'cfg', got '%s'", ir.Config())
+	}
+	if ir.InputNamesLength() != 2 || string(ir.InputNames(1)) != "s" {
+		t.Errorf("Wrong input names")
+	}
+	if ir.OutputNamesLength() != 2 || string(ir.OutputNames(1)) != "z" {
+		t.Errorf("Wrong output names")
+	}
+	tensor := &graphpipefb.Tensor{}
+	ir.InputTensors(tensor, 0)
+	if nt, err := TensorToNativeTensor(tensor); err != nil || !reflect.DeepEqual(nt, x) {
+		t.Errorf("Input tensor did not round trip")
+	}
+	if req.Rows() != 2 {
+		t.Errorf("Expected 2 rows, got %d", req.Rows())
+	}
+}
+
+func TestInferRequestValidation(t *testing.T) {
+	x := mustTensor(t, [][]float32{{1, 2}, {3, 4}})
+	y := mustTensor(t, []float32{1, 2, 3})
+	bad := map[string]*InferRequest{
+		"duplicate input":  NewInferRequest().Input("x", x).Input("x", x),
+		"duplicate output": NewInferRequest().Input("x", x).Output("y", "y"),
+		"mixed names":      NewInferRequest().Input("x", x).Input("", x),
+		"batch mismatch":   NewInferRequest().Input("x", x).Input("y", y),
+		"nil input":        NewInferRequest().Input("x", nil),
+		"no inputs":        NewInferRequest().Output("y"),
+	}
+	for name, req := range bad {
+		if req.Err() == nil {
+			t.Errorf("Expected error for %s", name)
+		}
+		if _, err := req.Serialize(); err == nil {
+			t.Errorf("Expected serialize error for %s", name)
+		}
+	}
+	if err := NewInferRequest().Input("", x).Input("", x).Err(); err != nil {
+		t.Errorf("Unexpected error for unnamed inputs: %v", err)
+	}
+}
+
+func TestInferRequestJSON(t *testing.T) {
+	x := mustTensor(t, [][]float32{{1, 2}, {3, 4}})
+	s := mustTensor(t, []string{"a", "b"})
+	req := NewInferRequest().Input("x", x).Input("s", s).Output("y").Config("cfg")
+	js, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &InferRequest{}
+	if err := json.Unmarshal(js, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(req, decoded) {
+		t.Errorf("Expected %v, got %v", req, decoded)
+	}
+
+	js = []byte(`{"inputs": [{"name": "x", "tensor": {"Type": 9, "Shape": [1]}}, {"name": "x", "tensor": {"Type": 9, "Shape": [1]}}]}`)
+	if err := json.Unmarshal(js, decoded); err == nil {
+		t.Errorf("Expected duplicate input error")
+	}
+}
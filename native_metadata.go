@@ -93,3 +93,39 @@ func (meta *NativeMetadataResponse) Build(b *fb.Builder) fb.UOffsetT {
 	graphpipefb.MetadataResponseAddOutputs(b, outputs)
 	return graphpipefb.MetadataResponseEnd(b)
 }
+
+// MetadataResponseToNative is a converter between the flatbuffer
+// MetadataResponse and the easier to use NativeMetadataResponse.
+func MetadataResponseToNative(res *graphpipefb.MetadataResponse) *NativeMetadataResponse {
+	meta := &NativeMetadataResponse{
+		Name:        string(res.Name()),
+		Version:     string(res.Version()),
+		Server:      string(res.Server()),
+		Description: string(res.Description()),
+	}
+	io := &graphpipefb.IOMetadata{}
+	for i := 0; i < res.InputsLength(); i++ {
+		if res.Inputs(io, i) {
+			meta.Inputs = append(meta.Inputs, ioMetadataToNative(io))
+		}
+	}
+	for i := 0; i < res.OutputsLength(); i++ {
+		if res.Outputs(io, i) {
+			meta.Outputs = append(meta.Outputs, ioMetadataToNative(io))
+		}
+	}
+	return meta
+}
+
+func ioMetadataToNative(io *graphpipefb.IOMetadata) NativeIOMetadata {
+	shape := make([]int64, io.ShapeLength())
+	for i := range shape {
+		shape[i] = io.Shape(i)
+	}
+	return NativeIOMetadata{
+		Name:        string(io.Name()),
+		Description: string(io.Description()),
+		Shape:       shape,
+		Type:        io.Type(),
+	}
+}
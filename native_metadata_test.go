@@ -6,6 +6,7 @@
 package graphpipe
 
 import (
+	"reflect"
 	"testing"
 
 	fb "github.com/google/flatbuffers/go"
@@ -35,3 +36,21 @@ func TestNativeMetadataResponse(t *testing.T) {
 	b := fb.NewBuilder(1024)
 	resp.Build(b)
 }
+
+func TestMetadataResponseToNative(t *testing.T) {
+	resp := &NativeMetadataResponse{}
+	resp.Name = "name"
+	resp.Version = "0.01"
+	resp.Server = "servy"
+	resp.Description = "mydesc"
+	resp.Inputs = append(resp.Inputs, createIOMeta("input0"))
+	resp.Outputs = append(resp.Outputs, createIOMeta("output0"))
+	resp.Outputs = append(resp.Outputs, createIOMeta("output1"))
+	b := fb.NewBuilder(1024)
+	buf := Serialize(b, resp.Build(b))
+
+	meta := MetadataResponseToNative(graphpipefb.GetRootAsMetadataResponse(buf, 0))
+	if !reflect.DeepEqual(meta, resp) {
+		t.Fatalf("metadata %v and %v are not equal", meta, resp)
+	}
+}
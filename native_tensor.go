@@ -7,6 +7,7 @@ package graphpipe
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 
 	fb "github.com/google/flatbuffers/go"
@@ -42,34 +43,22 @@ func (nt *NativeTensor) InitSimple(val interface{}) error {
 // InitWithData is a more explicit initialization and expects
 // the data to already be in the correct format.
 func (nt *NativeTensor) InitWithData(data []byte, shape []int64, dt uint8) error {
-	totalBytes := 1
-	meta := types[dt]
-	for _, v := range shape {
-		totalBytes *= int(v)
+	t := NativeTensor{Type: dt, Shape: shape, Data: data}
+	if err := t.Validate(); err != nil {
+		return err
 	}
-	totalBytes *= int(meta.size)
-	if totalBytes != len(data) {
-		return errors.New("Data length does not match shape/dtype")
-	}
-	nt.Shape = shape
-	nt.Type = dt
-	nt.Data = data
+	*nt = t
 	return nil
 }
 
 // InitWithStringVals is a more explicit initialization and expects
 // the data to already be in the correct format (for stringvals).
 func (nt *NativeTensor) InitWithStringVals(stringVals []string, shape []int64) error {
-	totalItems := 1
-	for _, v := range shape {
-		totalItems *= int(v)
+	t := NativeTensor{Type: graphpipefb.TypeString, Shape: shape, StringVals: stringVals}
+	if err := t.Validate(); err != nil {
+		return err
 	}
-	if len(stringVals) != totalItems {
-		return errors.New("Data length does not match shape/dtype")
-	}
-	nt.Shape = shape
-	nt.Type = graphpipefb.TypeString
-	nt.StringVals = stringVals
+	*nt = t
 	return nil
 }
 
@@ -81,3 +70,105 @@ func (nt *NativeTensor) Build(b *fb.Builder) fb.UOffsetT {
 
 	return BuildDataTensorRaw(b, nt.Data, nt.Shape, nt.Type)
 }
+
+// These are the reasons a tensor can fail Validate. They are wrapped in a
+// TensorError.
+var (
+	ErrUnknownType       = errors.New("Unknown type")
+	ErrNegativeDimension = errors.New("Negative dimension")
+	ErrShapeOverflow     = errors.New("Too many elements")
+	ErrDataLength        = errors.New("Data length does not match shape/dtype")
+	ErrMalformedTensor   = errors.New("Malformed tensor")
+	ErrInvalidBool       = errors.New("Bool data must be 0 or 1")
+)
+
+// TensorError describes an invalid tensor. Err is one of the Err values
+// above, so callers can tell the reasons apart.
+type TensorError struct {
+	Name   string // name of the tensor, if known
+	Err    error
+	Detail string
+}
+
+// Error returns the error message.
+func (e *TensorError) Error() string {
+	msg := e.Err.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Name != "" {
+		msg = "Tensor '" + e.Name + "': " + msg
+	}
+	return msg
+}
+
+// Unwrap returns the reason for the error.
+func (e *TensorError) Unwrap() error {
+	return e.Err
+}
+
+// withTensorName adds the name of a tensor to a TensorError.
+func withTensorName(err error, name string) error {
+	if te, ok := err.(*TensorError); ok && te.Name == "" {
+		te.Name = name
+	}
+	return err
+}
+
+const maxInt = int64(^uint(0) >> 1)
+
+// Validate checks that the tensor has a known type, that its shape has no
+// negative dimensions and that its data holds exactly as many elements as
+// the shape. Bool data must be all 0 and 1 bytes, since any other byte is
+// not a valid go bool. Tensors that come from the network should be
+// validated before their data is used. The error is a *TensorError.
+func (nt *NativeTensor) Validate() error {
+	if int(nt.Type) >= len(types) || nt.Type == graphpipefb.TypeNull {
+		return &TensorError{Err: ErrUnknownType, Detail: fmt.Sprintf("%d", nt.Type)}
+	}
+	elems, err := checkShape(nt.Shape, types[nt.Type].size)
+	if err != nil {
+		return err
+	}
+	if nt.Type == graphpipefb.TypeString {
+		if int64(len(nt.StringVals)) != elems {
+			return &TensorError{Err: ErrDataLength, Detail: fmt.Sprintf("shape %v needs %d strings but there are %d", nt.Shape, elems, len(nt.StringVals))}
+		}
+		return nil
+	}
+	if int64(len(nt.Data)) != elems*types[nt.Type].size {
+		return &TensorError{Err: ErrDataLength, Detail: fmt.Sprintf("shape %v needs %d bytes of %s but there are %d", nt.Shape, elems*types[nt.Type].size, typeName(nt.Type), len(nt.Data))}
+	}
+	if nt.Type == graphpipefb.TypeBool {
+		for i, b := range nt.Data {
+			if b > 1 {
+				return &TensorError{Err: ErrInvalidBool, Detail: fmt.Sprintf("byte %d is %d", i, b)}
+			}
+		}
+	}
+	return nil
+}
+
+// checkShape returns the number of elements in shape, making sure that the
+// elements, each size bytes, fit in memory.
+func checkShape(shape []int64, size int64) (int64, error) {
+	for _, d := range shape {
+		if d < 0 {
+			return 0, &TensorError{Err: ErrNegativeDimension, Detail: fmt.Sprintf("shape %v", shape)}
+		}
+		if d == 0 {
+			return 0, nil
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	elems := int64(1)
+	for _, d := range shape {
+		if elems > maxInt/size/d {
+			return 0, &TensorError{Err: ErrShapeOverflow, Detail: fmt.Sprintf("shape %v", shape)}
+		}
+		elems *= d
+	}
+	return elems, nil
+}
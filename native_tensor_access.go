@@ -0,0 +1,230 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"fmt"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// The typed accessors below return the data of a tensor as a slice of the
+// matching go type without copying or using reflection. The slices share
+// memory with nt.Data, so writes to them change the tensor. They return an
+// error if the tensor holds a different type or its data does not match its
+// shape, and a nil slice if the tensor is empty.
+
+func (nt *NativeTensor) checkView(dt uint8) error {
+	if nt.Type != dt {
+		return fmt.Errorf("Tensor is %s, not %s", typeName(nt.Type), typeName(dt))
+	}
+	return nt.Validate()
+}
+
+// Uint8s returns the data of a TypeUint8 tensor.
+func (nt *NativeTensor) Uint8s() ([]uint8, error) {
+	if err := nt.checkView(graphpipefb.TypeUint8); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return nt.Data, nil
+}
+
+// Int8s returns the data of a TypeInt8 tensor.
+func (nt *NativeTensor) Int8s() ([]int8, error) {
+	if err := nt.checkView(graphpipefb.TypeInt8); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toInt8(nt.Data).([]int8), nil
+}
+
+// Uint16s returns the data of a TypeUint16 tensor.
+func (nt *NativeTensor) Uint16s() ([]uint16, error) {
+	if err := nt.checkView(graphpipefb.TypeUint16); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toUint16(nt.Data).([]uint16), nil
+}
+
+// Int16s returns the data of a TypeInt16 tensor.
+func (nt *NativeTensor) Int16s() ([]int16, error) {
+	if err := nt.checkView(graphpipefb.TypeInt16); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toInt16(nt.Data).([]int16), nil
+}
+
+// Uint32s returns the data of a TypeUint32 tensor.
+func (nt *NativeTensor) Uint32s() ([]uint32, error) {
+	if err := nt.checkView(graphpipefb.TypeUint32); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toUint32(nt.Data).([]uint32), nil
+}
+
+// Int32s returns the data of a TypeInt32 tensor.
+func (nt *NativeTensor) Int32s() ([]int32, error) {
+	if err := nt.checkView(graphpipefb.TypeInt32); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toInt32(nt.Data).([]int32), nil
+}
+
+// Uint64s returns the data of a TypeUint64 tensor.
+func (nt *NativeTensor) Uint64s() ([]uint64, error) {
+	if err := nt.checkView(graphpipefb.TypeUint64); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toUint64(nt.Data).([]uint64), nil
+}
+
+// Int64s returns the data of a TypeInt64 tensor.
+func (nt *NativeTensor) Int64s() ([]int64, error) {
+	if err := nt.checkView(graphpipefb.TypeInt64); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toInt64(nt.Data).([]int64), nil
+}
+
+// Float16s returns the data of a TypeFloat16 tensor.
+func (nt *NativeTensor) Float16s() ([]Float16, error) {
+	if err := nt.checkView(graphpipefb.TypeFloat16); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toFloat16(nt.Data).([]Float16), nil
+}
+
+// BFloat16s returns the data of a TypeBFloat16 tensor.
+func (nt *NativeTensor) BFloat16s() ([]BFloat16, error) {
+	if err := nt.checkView(graphpipefb.TypeBFloat16); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toBFloat16(nt.Data).([]BFloat16), nil
+}
+
+// Float32s returns the data of a TypeFloat32 tensor.
+func (nt *NativeTensor) Float32s() ([]float32, error) {
+	if err := nt.checkView(graphpipefb.TypeFloat32); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toFloat32(nt.Data).([]float32), nil
+}
+
+// Float64s returns the data of a TypeFloat64 tensor.
+func (nt *NativeTensor) Float64s() ([]float64, error) {
+	if err := nt.checkView(graphpipefb.TypeFloat64); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toFloat64(nt.Data).([]float64), nil
+}
+
+// Bools returns the data of a TypeBool tensor.
+func (nt *NativeTensor) Bools() ([]bool, error) {
+	if err := nt.checkView(graphpipefb.TypeBool); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toBool(nt.Data).([]bool), nil
+}
+
+// Complex64s returns the data of a TypeComplex64 tensor.
+func (nt *NativeTensor) Complex64s() ([]complex64, error) {
+	if err := nt.checkView(graphpipefb.TypeComplex64); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toComplex64(nt.Data).([]complex64), nil
+}
+
+// Complex128s returns the data of a TypeComplex128 tensor.
+func (nt *NativeTensor) Complex128s() ([]complex128, error) {
+	if err := nt.checkView(graphpipefb.TypeComplex128); err != nil || len(nt.Data) == 0 {
+		return nil, err
+	}
+	return toComplex128(nt.Data).([]complex128), nil
+}
+
+// Strings returns the values of a TypeString tensor.
+func (nt *NativeTensor) Strings() ([]string, error) {
+	if err := nt.checkView(graphpipefb.TypeString); err != nil || len(nt.StringVals) == 0 {
+		return nil, err
+	}
+	return nt.StringVals, nil
+}
+
+// offset is the position of the element at idx in the row major data of a
+// tensor with the given shape.
+func offset(shape []int64, idx []int) (int, error) {
+	if len(idx) != len(shape) {
+		return 0, fmt.Errorf("Index %v does not match shape %v", idx, shape)
+	}
+	off := 0
+	for i, d := range shape {
+		if idx[i] < 0 || int64(idx[i]) >= d {
+			return 0, fmt.Errorf("Index %v is out of range for shape %v", idx, shape)
+		}
+		off = off*int(d) + idx[i]
+	}
+	return off, nil
+}
+
+// Offset returns the position of the element at idx in the slice returned by
+// the typed accessor of the tensor, so that for example
+//
+//	vals[off]
+//
+// is the element at idx of a float32 tensor, where vals comes from Float32s
+// and off from Offset. There must be one index per dimension.
+func (nt *NativeTensor) Offset(idx ...int) (int, error) {
+	return offset(nt.Shape, idx)
+}
+
+// At returns the element at idx, with one index per dimension. The value has
+// the go type of the tensor, so a float32 tensor returns a float32. Prefer
+// the typed accessors with Offset when reading many elements.
+func (nt *NativeTensor) At(idx ...int) (interface{}, error) {
+	if err := nt.Validate(); err != nil {
+		return nil, err
+	}
+	off, err := offset(nt.Shape, idx)
+	if err != nil {
+		return nil, err
+	}
+	if nt.Type == graphpipefb.TypeString {
+		return nt.StringVals[off], nil
+	}
+	size := int(types[nt.Type].size)
+	switch v := types[nt.Type].conv(nt.Data[off*size : (off+1)*size]).(type) {
+	case []uint8:
+		return v[0], nil
+	case []int8:
+		return v[0], nil
+	case []uint16:
+		return v[0], nil
+	case []int16:
+		return v[0], nil
+	case []uint32:
+		return v[0], nil
+	case []int32:
+		return v[0], nil
+	case []uint64:
+		return v[0], nil
+	case []int64:
+		return v[0], nil
+	case []Float16:
+		return v[0], nil
+	case []BFloat16:
+		return v[0], nil
+	case []float32:
+		return v[0], nil
+	case []float64:
+		return v[0], nil
+	case []bool:
+		return v[0], nil
+	case []complex64:
+		return v[0], nil
+	case []complex128:
+		return v[0], nil
+	}
+	return nil, fmt.Errorf("Unsupported type %s", typeName(nt.Type))
+}
@@ -0,0 +1,67 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypedAccessors(t *testing.T) {
+	nt := mustTensor(t, [][]float32{{1, 2, 3}, {4, 5, 6}})
+	vals, err := nt.Float32s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []float32{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("Unexpected values %v", vals)
+	}
+	// the view shares memory with the tensor
+	vals[4] = 50
+	v, err := nt.At(1, 1)
+	if err != nil || v != float32(50) {
+		t.Fatalf("Expected 50, got %v (%v)", v, err)
+	}
+	off, err := nt.Offset(1, 2)
+	if err != nil || off != 5 {
+		t.Fatalf("Expected offset 5, got %d (%v)", off, err)
+	}
+
+	if _, err := nt.Int64s(); err == nil {
+		t.Errorf("Expected error reading float32 tensor as int64")
+	}
+	for _, idx := range [][]int{{2, 0}, {0, 3}, {-1, 0}, {1}} {
+		if _, err := nt.At(idx...); err == nil {
+			t.Errorf("Expected error for index %v", idx)
+		}
+	}
+	bad := &NativeTensor{Type: nt.Type, Shape: []int64{2, 3}, Data: nt.Data[:8]}
+	if _, err := bad.Float32s(); err == nil {
+		t.Errorf("Expected error for short data")
+	}
+
+	bools, err := mustTensor(t, []bool{true, false}).Bools()
+	if err != nil || !reflect.DeepEqual(bools, []bool{true, false}) {
+		t.Fatalf("Unexpected bools %v (%v)", bools, err)
+	}
+	c, err := mustTensor(t, [][]complex128{{1 + 2i}, {3 - 4i}}).At(1, 0)
+	if err != nil || c != complex128(3-4i) {
+		t.Fatalf("Unexpected complex %v (%v)", c, err)
+	}
+	s, err := mustTensor(t, [][]string{{"a", "b"}, {"c", "d"}}).At(1, 0)
+	if err != nil || s != "c" {
+		t.Fatalf("Unexpected string %v (%v)", s, err)
+	}
+
+	empty := &NativeTensor{}
+	if err := empty.InitWithData([]byte{}, []int64{0, 3}, nt.Type); err != nil {
+		t.Fatal(err)
+	}
+	vals, err = empty.Float32s()
+	if err != nil || len(vals) != 0 {
+		t.Fatalf("Unexpected values %v (%v)", vals, err)
+	}
+}
@@ -0,0 +1,515 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"fmt"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// numElements is the product of the dimensions of shape.
+func numElements(shape []int64) int64 {
+	elems := int64(1)
+	for _, d := range shape {
+		elems *= d
+	}
+	return elems
+}
+
+func typeName(dt uint8) string {
+	if name, ok := graphpipefb.EnumNamesType[int(dt)]; ok {
+		return name
+	}
+	return fmt.Sprintf("Type(%d)", dt)
+}
+
+// newTensorLike allocates an empty tensor of the same type as nt.
+func newTensorLike(nt *NativeTensor, shape []int64) *NativeTensor {
+	out := &NativeTensor{Type: nt.Type, Shape: shape}
+	elems := numElements(shape)
+	if nt.Type == graphpipefb.TypeString {
+		out.StringVals = make([]string, elems)
+	} else {
+		out.Data = make([]byte, elems*types[nt.Type].size)
+	}
+	return out
+}
+
+// copyElements copies n elements from src at srcOff to dst at dstOff.
+func copyElements(dst *NativeTensor, dstOff int64, src *NativeTensor, srcOff int64, n int64) {
+	if src.Type == graphpipefb.TypeString {
+		copy(dst.StringVals[dstOff:dstOff+n], src.StringVals[srcOff:srcOff+n])
+		return
+	}
+	size := types[src.Type].size
+	copy(dst.Data[dstOff*size:(dstOff+n)*size], src.Data[srcOff*size:(srcOff+n)*size])
+}
+
+func copyShape(shape []int64) []int64 {
+	out := make([]int64, len(shape))
+	copy(out, shape)
+	return out
+}
+
+// Reshape returns a tensor with the same data and a new shape. One
+// dimension may be -1, in which case it is inferred from the number of
+// elements. The data is shared with nt.
+func (nt *NativeTensor) Reshape(shape ...int64) (*NativeTensor, error) {
+	if err := nt.Validate(); err != nil {
+		return nil, err
+	}
+	elems := numElements(nt.Shape)
+	newShape := copyShape(shape)
+	unknown := -1
+	known := int64(1)
+	for i, d := range newShape {
+		switch {
+		case d == -1 && unknown >= 0:
+			return nil, fmt.Errorf("Only one dimension of %v can be -1", shape)
+		case d == -1:
+			unknown = i
+		case d < 0:
+			return nil, fmt.Errorf("Invalid shape %v", shape)
+		default:
+			known *= d
+		}
+	}
+	if unknown >= 0 {
+		if known == 0 || elems%known != 0 {
+			return nil, fmt.Errorf("Can not reshape %v to %v", nt.Shape, shape)
+		}
+		newShape[unknown] = elems / known
+	}
+	if numElements(newShape) != elems {
+		return nil, fmt.Errorf("Can not reshape %v to %v", nt.Shape, shape)
+	}
+	return &NativeTensor{
+		Type:       nt.Type,
+		Shape:      newShape,
+		StringVals: nt.StringVals,
+		Data:       nt.Data,
+	}, nil
+}
+
+func (nt *NativeTensor) checkAxis(axis int) error {
+	if axis < 0 || axis >= len(nt.Shape) {
+		return fmt.Errorf("Axis %d is out of range for shape %v", axis, nt.Shape)
+	}
+	return nil
+}
+
+// Gather returns a copy of the entries at indexes along axis. Indexes may
+// repeat.
+func (nt *NativeTensor) Gather(axis int, indexes []int) (*NativeTensor, error) {
+	if err := nt.Validate(); err != nil {
+		return nil, err
+	}
+	if err := nt.checkAxis(axis); err != nil {
+		return nil, err
+	}
+	dim := nt.Shape[axis]
+	for _, idx := range indexes {
+		if idx < 0 || int64(idx) >= dim {
+			return nil, fmt.Errorf("Index %d is out of range for axis %d of size %d", idx, axis, dim)
+		}
+	}
+	outer := numElements(nt.Shape[:axis])
+	inner := numElements(nt.Shape[axis+1:])
+	shape := copyShape(nt.Shape)
+	shape[axis] = int64(len(indexes))
+	out := newTensorLike(nt, shape)
+	o := int64(0)
+	for i := int64(0); i < outer; i++ {
+		for _, idx := range indexes {
+			copyElements(out, o, nt, (i*dim+int64(idx))*inner, inner)
+			o += inner
+		}
+	}
+	return out, nil
+}
+
+// Slice returns a copy of the entries from start up to end along axis.
+func (nt *NativeTensor) Slice(axis int, start, end int64) (*NativeTensor, error) {
+	if err := nt.checkAxis(axis); err != nil {
+		return nil, err
+	}
+	if start < 0 || end < start || end > nt.Shape[axis] {
+		return nil, fmt.Errorf("Slice [%d:%d] is out of range for axis %d of size %d", start, end, axis, nt.Shape[axis])
+	}
+	indexes := make([]int, end-start)
+	for i := range indexes {
+		indexes[i] = int(start) + i
+	}
+	return nt.Gather(axis, indexes)
+}
+
+// Concat joins tensors along the first axis. The tensors must have the
+// same type and the same shape apart from the first dimension.
+func Concat(tensors []*NativeTensor) (*NativeTensor, error) {
+	if len(tensors) == 0 {
+		return nil, fmt.Errorf("Nothing to concat")
+	}
+	first := tensors[0]
+	shape := copyShape(first.Shape)
+	if len(shape) == 0 {
+		return nil, fmt.Errorf("Can not concat scalars")
+	}
+	shape[0] = 0
+	for i, t := range tensors {
+		if err := t.Validate(); err != nil {
+			return nil, fmt.Errorf("Tensor %d: %v", i, err)
+		}
+		if t.Type != first.Type {
+			return nil, fmt.Errorf("Tensor %d is %s, expected %s", i, typeName(t.Type), typeName(first.Type))
+		}
+		if len(t.Shape) != len(first.Shape) {
+			return nil, fmt.Errorf("Tensor %d has shape %v, expected %v", i, t.Shape, first.Shape)
+		}
+		for j := 1; j < len(t.Shape); j++ {
+			if t.Shape[j] != first.Shape[j] {
+				return nil, fmt.Errorf("Tensor %d has shape %v, expected %v", i, t.Shape, first.Shape)
+			}
+		}
+		shape[0] += t.Shape[0]
+	}
+	out := newTensorLike(first, shape)
+	o := int64(0)
+	for _, t := range tensors {
+		n := numElements(t.Shape)
+		copyElements(out, o, t, 0, n)
+		o += n
+	}
+	return out, nil
+}
+
+// Split divides a tensor along the first axis into tensors with the given
+// number of rows, which must add up to the first dimension. The data of the
+// parts is shared with nt.
+func (nt *NativeTensor) Split(rows []int64) ([]*NativeTensor, error) {
+	if err := nt.Validate(); err != nil {
+		return nil, err
+	}
+	if err := nt.checkAxis(0); err != nil {
+		return nil, err
+	}
+	total := int64(0)
+	for _, r := range rows {
+		if r < 0 {
+			return nil, fmt.Errorf("Invalid split %v", rows)
+		}
+		total += r
+	}
+	if total != nt.Shape[0] {
+		return nil, fmt.Errorf("Split %v does not add up to %d rows", rows, nt.Shape[0])
+	}
+	inner := numElements(nt.Shape[1:])
+	size := int64(0)
+	if nt.Type != graphpipefb.TypeString {
+		size = types[nt.Type].size
+	}
+	parts := make([]*NativeTensor, len(rows))
+	start := int64(0)
+	for i, r := range rows {
+		shape := copyShape(nt.Shape)
+		shape[0] = r
+		end := start + r*inner
+		part := &NativeTensor{Type: nt.Type, Shape: shape}
+		if nt.Type == graphpipefb.TypeString {
+			part.StringVals = nt.StringVals[start:end]
+		} else {
+			part.Data = nt.Data[start*size : end*size]
+		}
+		parts[i] = part
+		start = end
+	}
+	return parts, nil
+}
+
+// Transpose returns a copy of the tensor with its axes permuted, so that
+// axis i of the result is axis perm[i] of nt. With no perm the axes are
+// reversed.
+func (nt *NativeTensor) Transpose(perm ...int) (*NativeTensor, error) {
+	if err := nt.Validate(); err != nil {
+		return nil, err
+	}
+	dims := len(nt.Shape)
+	if len(perm) == 0 {
+		perm = make([]int, dims)
+		for i := range perm {
+			perm[i] = dims - 1 - i
+		}
+	}
+	if len(perm) != dims {
+		return nil, fmt.Errorf("Permutation %v does not match shape %v", perm, nt.Shape)
+	}
+	seen := make([]bool, dims)
+	for _, p := range perm {
+		if p < 0 || p >= dims || seen[p] {
+			return nil, fmt.Errorf("Invalid permutation %v", perm)
+		}
+		seen[p] = true
+	}
+
+	strides := make([]int64, dims)
+	stride := int64(1)
+	for i := dims - 1; i >= 0; i-- {
+		strides[i] = stride
+		stride *= nt.Shape[i]
+	}
+	shape := make([]int64, dims)
+	srcStrides := make([]int64, dims)
+	for i, p := range perm {
+		shape[i] = nt.Shape[p]
+		srcStrides[i] = strides[p]
+	}
+	out := newTensorLike(nt, shape)
+	elems := numElements(shape)
+	index := make([]int64, dims)
+	src := int64(0)
+	for o := int64(0); o < elems; o++ {
+		copyElements(out, o, nt, src, 1)
+		// step the output index like an odometer, tracking the source offset
+		for i := dims - 1; i >= 0; i-- {
+			index[i]++
+			src += srcStrides[i]
+			if index[i] < shape[i] {
+				break
+			}
+			src -= index[i] * srcStrides[i]
+			index[i] = 0
+		}
+	}
+	return out, nil
+}
+
+func isComplexType(dt uint8) bool {
+	return dt == graphpipefb.TypeComplex64 || dt == graphpipefb.TypeComplex128
+}
+
+func isIntegerType(dt uint8) bool {
+	switch dt {
+	case graphpipefb.TypeUint8, graphpipefb.TypeInt8,
+		graphpipefb.TypeUint16, graphpipefb.TypeInt16,
+		graphpipefb.TypeUint32, graphpipefb.TypeInt32,
+		graphpipefb.TypeUint64, graphpipefb.TypeInt64,
+		graphpipefb.TypeBool:
+		return true
+	}
+	return false
+}
+
+// Cast converts a tensor to another numeric type, for example to send
+// float32 data to a model that takes TypeFloat16. Conversions follow go
+// conversion rules, and any non-zero value becomes true for TypeBool.
+// Real tensors can be cast to complex types but not the other way around.
+// If the tensor is already of type dt it is returned as is.
+func (nt *NativeTensor) Cast(dt uint8) (*NativeTensor, error) {
+	if nt.Type == dt {
+		return nt, nil
+	}
+	if err := nt.Validate(); err != nil {
+		return nil, err
+	}
+	if int(dt) >= len(types) || types[dt].conv == nil ||
+		nt.Type == graphpipefb.TypeString || (isComplexType(nt.Type) && !isComplexType(dt)) {
+		return nil, fmt.Errorf("Can not cast %s to %s", typeName(nt.Type), typeName(dt))
+	}
+
+	var data []byte
+	switch {
+	case isComplexType(dt):
+		data = dataFromComplex(complexFromData(nt.Data, nt.Type), dt)
+	case isIntegerType(nt.Type) && isIntegerType(dt):
+		// stay in integers so large values do not lose precision
+		data = dataFromInts(intsFromData(nt.Data, nt.Type), dt)
+	default:
+		data = dataFromReals(realsFromData(nt.Data, nt.Type), dt)
+	}
+	out := &NativeTensor{}
+	if err := out.InitWithData(data, copyShape(nt.Shape), dt); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// realsFromData widens the data of any real tensor to float64.
+func realsFromData(data []byte, dt uint8) []float64 {
+	if isFloatType(dt) {
+		return floatsFromData(data, dt)
+	}
+	ints := intsFromData(data, dt)
+	vals := make([]float64, len(ints))
+	for i, v := range ints {
+		if dt == graphpipefb.TypeUint64 {
+			vals[i] = float64(uint64(v))
+		} else {
+			vals[i] = float64(v)
+		}
+	}
+	return vals
+}
+
+// dataFromReals narrows float64 values to the data of any real tensor.
+// Integers are truncated toward zero, and any non-zero value is true.
+func dataFromReals(vals []float64, dt uint8) []byte {
+	if isFloatType(dt) {
+		return dataFromFloats(vals, dt)
+	}
+	ints := make([]int64, len(vals))
+	for i, v := range vals {
+		switch {
+		case dt == graphpipefb.TypeBool:
+			if v != 0 {
+				ints[i] = 1
+			}
+		case dt == graphpipefb.TypeUint64:
+			ints[i] = int64(uint64(v))
+		default:
+			ints[i] = int64(v)
+		}
+	}
+	return dataFromInts(ints, dt)
+}
+
+// intsFromData widens the data of an integer or bool tensor to int64.
+// Large uint64 values wrap, but come back unchanged in dataFromInts.
+func intsFromData(data []byte, dt uint8) []int64 {
+	n := len(data) / int(types[dt].size)
+	vals := make([]int64, n)
+	if n == 0 {
+		return vals
+	}
+	switch src := types[dt].conv(data).(type) {
+	case []uint8:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []int8:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []uint16:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []int16:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []uint32:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []int32:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []uint64:
+		for i, v := range src {
+			vals[i] = int64(v)
+		}
+	case []int64:
+		copy(vals, src)
+	case []bool:
+		for i, v := range src {
+			if v {
+				vals[i] = 1
+			}
+		}
+	}
+	return vals
+}
+
+// dataFromInts narrows int64 values to the data of an integer or bool
+// tensor.
+func dataFromInts(vals []int64, dt uint8) []byte {
+	data := make([]byte, len(vals)*int(types[dt].size))
+	if len(vals) == 0 {
+		return data
+	}
+	switch dst := types[dt].conv(data).(type) {
+	case []uint8:
+		for i, v := range vals {
+			dst[i] = uint8(v)
+		}
+	case []int8:
+		for i, v := range vals {
+			dst[i] = int8(v)
+		}
+	case []uint16:
+		for i, v := range vals {
+			dst[i] = uint16(v)
+		}
+	case []int16:
+		for i, v := range vals {
+			dst[i] = int16(v)
+		}
+	case []uint32:
+		for i, v := range vals {
+			dst[i] = uint32(v)
+		}
+	case []int32:
+		for i, v := range vals {
+			dst[i] = int32(v)
+		}
+	case []uint64:
+		for i, v := range vals {
+			dst[i] = uint64(v)
+		}
+	case []int64:
+		copy(dst, vals)
+	case []bool:
+		for i, v := range vals {
+			dst[i] = v != 0
+		}
+	}
+	return data
+}
+
+// complexFromData widens the data of any numeric tensor to complex128.
+func complexFromData(data []byte, dt uint8) []complex128 {
+	if !isComplexType(dt) {
+		reals := realsFromData(data, dt)
+		vals := make([]complex128, len(reals))
+		for i, v := range reals {
+			vals[i] = complex(v, 0)
+		}
+		return vals
+	}
+	n := len(data) / int(types[dt].size)
+	vals := make([]complex128, n)
+	if n == 0 {
+		return vals
+	}
+	switch src := types[dt].conv(data).(type) {
+	case []complex64:
+		for i, v := range src {
+			vals[i] = complex128(v)
+		}
+	case []complex128:
+		copy(vals, src)
+	}
+	return vals
+}
+
+// dataFromComplex narrows complex128 values to the data of a complex
+// tensor.
+func dataFromComplex(vals []complex128, dt uint8) []byte {
+	data := make([]byte, len(vals)*int(types[dt].size))
+	if len(vals) == 0 {
+		return data
+	}
+	switch dst := types[dt].conv(data).(type) {
+	case []complex64:
+		for i, v := range vals {
+			dst[i] = complex64(v)
+		}
+	case []complex128:
+		copy(dst, vals)
+	}
+	return data
+}
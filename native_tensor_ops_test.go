@@ -0,0 +1,147 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+func checkNative(t *testing.T, nt *NativeTensor, err error, expected interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := NativeTensorToNative(nt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(native, expected) {
+		t.Fatalf("Expected %v, got %v", expected, native)
+	}
+}
+
+func TestReshape(t *testing.T) {
+	nt := mustTensor(t, [][]int32{{1, 2, 3}, {4, 5, 6}})
+	r, err := nt.Reshape(3, -1)
+	checkNative(t, r, err, [][]int32{{1, 2}, {3, 4}, {5, 6}})
+	r, err = nt.Reshape(-1)
+	checkNative(t, r, err, []int32{1, 2, 3, 4, 5, 6})
+
+	s := mustTensor(t, []string{"a", "b", "c", "d"})
+	r, err = s.Reshape(-1, 2)
+	checkNative(t, r, err, [][]string{{"a", "b"}, {"c", "d"}})
+
+	for _, bad := range [][]int64{{4, 2}, {-1, -1}, {4, -1}, {-2, 3}} {
+		if _, err := nt.Reshape(bad...); err == nil {
+			t.Errorf("Expected error reshaping to %v", bad)
+		}
+	}
+}
+
+func TestSliceGather(t *testing.T) {
+	nt := mustTensor(t, [][]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}})
+	r, err := nt.Slice(0, 1, 3)
+	checkNative(t, r, err, [][]float32{{4, 5, 6}, {7, 8, 9}})
+	r, err = nt.Slice(1, 0, 2)
+	checkNative(t, r, err, [][]float32{{1, 2}, {4, 5}, {7, 8}})
+	r, err = nt.Gather(0, []int{2, 0, 2})
+	checkNative(t, r, err, [][]float32{{7, 8, 9}, {1, 2, 3}, {7, 8, 9}})
+	r, err = nt.Gather(1, []int{2})
+	checkNative(t, r, err, [][]float32{{3}, {6}, {9}})
+
+	s := mustTensor(t, [][]string{{"a", "b"}, {"c", "d"}})
+	r, err = s.Gather(1, []int{1, 0})
+	checkNative(t, r, err, [][]string{{"b", "a"}, {"d", "c"}})
+
+	if _, err := nt.Gather(0, []int{3}); err == nil {
+		t.Errorf("Expected out of range index error")
+	}
+	if _, err := nt.Slice(2, 0, 1); err == nil {
+		t.Errorf("Expected out of range axis error")
+	}
+	if _, err := nt.Slice(0, 2, 1); err == nil {
+		t.Errorf("Expected bad slice error")
+	}
+}
+
+func TestConcatSplit(t *testing.T) {
+	a := mustTensor(t, [][]int64{{1, 2}})
+	b := mustTensor(t, [][]int64{{3, 4}, {5, 6}})
+	c, err := Concat([]*NativeTensor{a, b})
+	checkNative(t, c, err, [][]int64{{1, 2}, {3, 4}, {5, 6}})
+
+	parts, err := c.Split([]int64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNative(t, parts[0], nil, [][]int64{{1, 2}})
+	checkNative(t, parts[1], nil, [][]int64{{3, 4}, {5, 6}})
+
+	s, err := Concat([]*NativeTensor{mustTensor(t, []string{"a"}), mustTensor(t, []string{"b", "c"})})
+	checkNative(t, s, err, []string{"a", "b", "c"})
+	parts, err = s.Split([]int64{2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNative(t, parts[1], nil, []string{"c"})
+
+	if _, err := Concat([]*NativeTensor{a, mustTensor(t, [][]int64{{1, 2, 3}})}); err == nil {
+		t.Errorf("Expected shape mismatch error")
+	}
+	if _, err := Concat([]*NativeTensor{a, mustTensor(t, [][]int32{{1, 2}})}); err == nil {
+		t.Errorf("Expected type mismatch error")
+	}
+	if _, err := c.Split([]int64{1, 1}); err == nil {
+		t.Errorf("Expected bad split error")
+	}
+}
+
+func TestTranspose(t *testing.T) {
+	nt := mustTensor(t, [][]int16{{1, 2, 3}, {4, 5, 6}})
+	r, err := nt.Transpose()
+	checkNative(t, r, err, [][]int16{{1, 4}, {2, 5}, {3, 6}})
+
+	cube := mustTensor(t, [][][]string{{{"a", "b"}, {"c", "d"}}, {{"e", "f"}, {"g", "h"}}})
+	r, err = cube.Transpose(1, 2, 0)
+	checkNative(t, r, err, [][][]string{{{"a", "e"}, {"b", "f"}}, {{"c", "g"}, {"d", "h"}}})
+
+	if _, err := nt.Transpose(0, 0); err == nil {
+		t.Errorf("Expected bad permutation error")
+	}
+}
+
+func TestCast(t *testing.T) {
+	nt := mustTensor(t, []float32{-1.5, 0, 2.7})
+	r, err := nt.Cast(graphpipefb.TypeInt32)
+	checkNative(t, r, err, []int32{-1, 0, 2})
+	r, err = nt.Cast(graphpipefb.TypeBool)
+	checkNative(t, r, err, []bool{true, false, true})
+	r, err = nt.Cast(graphpipefb.TypeComplex64)
+	checkNative(t, r, err, []complex64{-1.5, 0, 2.7})
+
+	big := mustTensor(t, []int64{math.MaxInt64, -1})
+	r, err = big.Cast(graphpipefb.TypeUint64)
+	checkNative(t, r, err, []uint64{math.MaxInt64, math.MaxUint64})
+	r, err = r.Cast(graphpipefb.TypeInt64)
+	checkNative(t, r, err, []int64{math.MaxInt64, -1})
+
+	b := mustTensor(t, [][]bool{{true}, {false}})
+	r, err = b.Cast(graphpipefb.TypeUint8)
+	checkNative(t, r, err, [][]uint8{{1}, {0}})
+
+	c := mustTensor(t, []complex128{1 + 1i})
+	if _, err := c.Cast(graphpipefb.TypeFloat32); err == nil {
+		t.Errorf("Expected an error casting complex to real")
+	}
+	s := mustTensor(t, []string{"a", "b"})
+	if _, err := s.Cast(graphpipefb.TypeFloat16); err == nil {
+		t.Errorf("Expected an error casting strings")
+	}
+}
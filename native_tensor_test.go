@@ -119,3 +119,60 @@ func TestInitWithInvalidStringVals(t *testing.T) {
 		t.Fatal("Expecting an error to be returned for mis-shaped data")
 	}
 }
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		nt     NativeTensor
+		reason error
+	}{
+		{NativeTensor{Type: 200, Shape: []int64{1}, Data: []byte{0}}, ErrUnknownType},
+		{NativeTensor{Type: graphpipefb.TypeNull}, ErrUnknownType},
+		{NativeTensor{Type: graphpipefb.TypeInt8, Shape: []int64{-1, -2}, Data: []byte{0, 0}}, ErrNegativeDimension},
+		{NativeTensor{Type: graphpipefb.TypeFloat32, Shape: []int64{1 << 40, 1 << 40}}, ErrShapeOverflow},
+		{NativeTensor{Type: graphpipefb.TypeFloat32, Shape: []int64{2}, Data: make([]byte, 7)}, ErrDataLength},
+		{NativeTensor{Type: graphpipefb.TypeString, Shape: []int64{2}, StringVals: []string{"a"}}, ErrDataLength},
+		{NativeTensor{Type: graphpipefb.TypeBool, Shape: []int64{3}, Data: []byte{0, 1, 2}}, ErrInvalidBool},
+	}
+	for i, test := range tests {
+		err := test.nt.Validate()
+		te, ok := err.(*TensorError)
+		if !ok || te.Err != test.reason {
+			t.Errorf("Test %d: expected %v, got %v", i, test.reason, err)
+		}
+	}
+
+	ok := &NativeTensor{Type: graphpipefb.TypeFloat32, Shape: []int64{2, 0, 1 << 62}}
+	if err := ok.Validate(); err != nil {
+		t.Errorf("Unexpected error for empty tensor: %v", err)
+	}
+	bools := &NativeTensor{Type: graphpipefb.TypeBool, Shape: []int64{2}, Data: []byte{1, 0}}
+	if err := bools.Validate(); err != nil {
+		t.Errorf("Unexpected error for bools: %v", err)
+	}
+}
+
+func TestTensorToNativeTensor(t *testing.T) {
+	b := fb.NewBuilder(1024)
+	// 3 bytes of data can't hold two float32s
+	tensor := graphpipefb.GetRootAsTensor(Serialize(b, BuildDataTensorRaw(b, []byte{1, 2, 3}, []int64{2}, graphpipefb.TypeFloat32)), 0)
+	if _, err := TensorToNativeTensor(tensor); err == nil || err.(*TensorError).Err != ErrDataLength {
+		t.Errorf("Expected data length error, got %v", err)
+	}
+
+	b = fb.NewBuilder(1024)
+	buf := Serialize(b, BuildStringTensorRaw(b, []string{"a", "b"}, []int64{-1, 2}))
+	tensor = graphpipefb.GetRootAsTensor(buf, 0)
+	if _, err := TensorToNativeTensor(tensor); err == nil || err.(*TensorError).Err != ErrNegativeDimension {
+		t.Errorf("Expected negative dimension error, got %v", err)
+	}
+
+	tensor = graphpipefb.GetRootAsTensor(buf[:len(buf)/2], 0)
+	if _, err := TensorToNativeTensor(tensor); err == nil || err.(*TensorError).Err != ErrMalformedTensor {
+		t.Errorf("Expected malformed tensor error, got %v", err)
+	}
+
+	b = fb.NewBuilder(1024)
+	tensor = graphpipefb.GetRootAsTensor(Serialize(b, BuildStringTensorRaw(b, []string{"a", "b"}, []int64{2, 1})), 0)
+	nt, err := TensorToNativeTensor(tensor)
+	checkNative(t, nt, err, [][]string{{"a"}, {"b"}})
+}
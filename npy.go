@@ -0,0 +1,320 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+var npyMagic = []byte("\x93NUMPY")
+
+// npyDescrs maps numpy type codes to tensor types. Numpy has no bfloat16,
+// so it is stored as a 2 byte void type, which is what ml_dtypes writes.
+var npyDescrs = map[string]uint8{
+	"u1":  graphpipefb.TypeUint8,
+	"i1":  graphpipefb.TypeInt8,
+	"u2":  graphpipefb.TypeUint16,
+	"i2":  graphpipefb.TypeInt16,
+	"u4":  graphpipefb.TypeUint32,
+	"i4":  graphpipefb.TypeInt32,
+	"u8":  graphpipefb.TypeUint64,
+	"i8":  graphpipefb.TypeInt64,
+	"f2":  graphpipefb.TypeFloat16,
+	"V2":  graphpipefb.TypeBFloat16,
+	"f4":  graphpipefb.TypeFloat32,
+	"f8":  graphpipefb.TypeFloat64,
+	"b1":  graphpipefb.TypeBool,
+	"c8":  graphpipefb.TypeComplex64,
+	"c16": graphpipefb.TypeComplex128,
+}
+
+var (
+	npyDescrRe   = regexp.MustCompile(`'descr'\s*:\s*'([<>|=])([a-zA-Z])([0-9]+)'`)
+	npyFortranRe = regexp.MustCompile(`'fortran_order'\s*:\s*(True|False)`)
+	npyShapeRe   = regexp.MustCompile(`'shape'\s*:\s*\(([0-9,\sL]*)\)`)
+)
+
+// ReadNpy reads a numpy array in the .npy format. All numeric types are
+// supported in either byte order, as are fixed width unicode ('U') and
+// byte ('S') strings. Fortran ordered arrays are reordered to row major.
+// Object arrays are not supported since they need python to read.
+func ReadNpy(r io.Reader) (*NativeTensor, error) {
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix[:6], npyMagic) {
+		return nil, errors.New("Not a npy file")
+	}
+	var headerLen int
+	switch prefix[6] {
+	case 1:
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		headerLen = int(binary.LittleEndian.Uint16(buf))
+	case 2, 3:
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		headerLen = int(binary.LittleEndian.Uint32(buf))
+	default:
+		return nil, fmt.Errorf("Unsupported npy version %d", prefix[6])
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	m := npyDescrRe.FindSubmatch(header)
+	if m == nil {
+		return nil, fmt.Errorf("Unsupported npy dtype in header %s", header)
+	}
+	bigEndian := string(m[1]) == ">"
+	kind := string(m[2])
+	width, err := strconv.Atoi(string(m[3]))
+	if err != nil || width <= 0 {
+		return nil, fmt.Errorf("Unsupported npy dtype '%s%s'", m[2], m[3])
+	}
+	dt, ok := npyDescrs[kind+string(m[3])]
+	// size and unit are the bytes per element and per byte swapped word
+	size, unit := width, width
+	switch {
+	case kind == "U":
+		dt, size, unit = graphpipefb.TypeString, width*4, 4
+	case kind == "S":
+		dt, unit = graphpipefb.TypeString, 1
+	case !ok:
+		return nil, fmt.Errorf("Unsupported npy dtype '%s%s'", m[2], m[3])
+	case kind == "c":
+		unit = width / 2
+	}
+	f := npyFortranRe.FindSubmatch(header)
+	if f == nil {
+		return nil, fmt.Errorf("Could not find fortran_order in header %s", header)
+	}
+	fortran := string(f[1]) == "True"
+	s := npyShapeRe.FindSubmatch(header)
+	if s == nil {
+		return nil, fmt.Errorf("Could not find shape in header %s", header)
+	}
+	shape := []int64{}
+	for _, d := range strings.Split(string(s[1]), ",") {
+		d = strings.TrimSuffix(strings.TrimSpace(d), "L")
+		if d == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid shape in header %s", header)
+		}
+		shape = append(shape, v)
+	}
+	if fortran {
+		// the data is row major for the reversed shape
+		for i, j := 0, len(shape)-1; i < j; i, j = i+1, j-1 {
+			shape[i], shape[j] = shape[j], shape[i]
+		}
+	}
+
+	elems, err := checkShape(shape, int64(size))
+	if err != nil {
+		return nil, err
+	}
+	length := elems * int64(size)
+	data, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, &TensorError{Err: ErrDataLength, Detail: fmt.Sprintf("shape %v needs %d bytes but the npy data has %d", shape, length, len(data))}
+	}
+	if bigEndian && unit > 1 {
+		swapBytes(data, unit)
+	}
+
+	nt := &NativeTensor{}
+	if dt == graphpipefb.TypeString {
+		err = nt.InitWithStringVals(npyStrings(data, kind, size), shape)
+	} else {
+		err = nt.InitWithData(data, shape, dt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fortran && len(shape) > 1 {
+		return nt.Transpose()
+	}
+	return nt, nil
+}
+
+// swapBytes reverses the byte order of each unit sized word in data.
+func swapBytes(data []byte, unit int) {
+	for i := 0; i+unit <= len(data); i += unit {
+		for j := 0; j < unit/2; j++ {
+			data[i+j], data[i+unit-1-j] = data[i+unit-1-j], data[i+j]
+		}
+	}
+}
+
+// npyStrings splits fixed width numpy strings, which are padded with zeros.
+func npyStrings(data []byte, kind string, size int) []string {
+	strs := make([]string, len(data)/size)
+	for i := range strs {
+		b := data[i*size : (i+1)*size]
+		if kind == "S" {
+			strs[i] = string(bytes.TrimRight(b, "\x00"))
+			continue
+		}
+		runes := make([]rune, 0, size/4)
+		for j := 0; j < size; j += 4 {
+			c := rune(binary.LittleEndian.Uint32(b[j:]))
+			if c == 0 {
+				break
+			}
+			runes = append(runes, c)
+		}
+		strs[i] = string(runes)
+	}
+	return strs
+}
+
+// WriteNpy writes a tensor in the .npy format, little endian and row
+// major. String tensors are written as fixed width unicode strings.
+func WriteNpy(w io.Writer, nt *NativeTensor) error {
+	if err := nt.Validate(); err != nil {
+		return err
+	}
+	descr := ""
+	data := nt.Data
+	if nt.Type == graphpipefb.TypeString {
+		width := 1
+		for _, s := range nt.StringVals {
+			if n := utf8.RuneCountInString(s); n > width {
+				width = n
+			}
+		}
+		descr = fmt.Sprintf("<U%d", width)
+		data = make([]byte, len(nt.StringVals)*width*4)
+		for i, s := range nt.StringVals {
+			o := i * width * 4
+			for _, c := range s {
+				binary.LittleEndian.PutUint32(data[o:], uint32(c))
+				o += 4
+			}
+		}
+	} else {
+		for d, dt := range npyDescrs {
+			if dt == nt.Type {
+				descr = d
+			}
+		}
+		if descr == "" {
+			return fmt.Errorf("Can not write %s tensors as npy", typeName(nt.Type))
+		}
+		if types[nt.Type].size == 1 {
+			descr = "|" + descr
+		} else {
+			descr = "<" + descr
+		}
+	}
+
+	dims := make([]string, len(nt.Shape))
+	for i, d := range nt.Shape {
+		dims[i] = strconv.FormatInt(d, 10)
+	}
+	shape := strings.Join(dims, ", ")
+	if len(dims) == 1 {
+		shape += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, shape)
+
+	// pad so that the data starts on a 64 byte boundary, using version 2
+	// for headers too long for a 2 byte length
+	version, lenSize := byte(1), 2
+	if len(header) > 65000 {
+		version, lenSize = 2, 4
+	}
+	total := len(npyMagic) + 2 + lenSize + len(header) + 1
+	header += strings.Repeat(" ", (64-total%64)%64) + "\n"
+
+	buf := &bytes.Buffer{}
+	buf.Write(npyMagic)
+	buf.Write([]byte{version, 0})
+	if version == 1 {
+		binary.Write(buf, binary.LittleEndian, uint16(len(header)))
+	} else {
+		binary.Write(buf, binary.LittleEndian, uint32(len(header)))
+	}
+	buf.WriteString(header)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadNpz reads the arrays of a .npz archive, as written by numpy.savez or
+// numpy.savez_compressed, keyed by name.
+func ReadNpz(r io.ReaderAt, size int64) (map[string]*NativeTensor, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	tensors := map[string]*NativeTensor{}
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".npy") {
+			return nil, fmt.Errorf("Unexpected file '%s' in npz archive", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		nt, err := ReadNpy(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read '%s': %v", f.Name, err)
+		}
+		tensors[strings.TrimSuffix(f.Name, ".npy")] = nt
+	}
+	return tensors, nil
+}
+
+// WriteNpz writes tensors as an uncompressed .npz archive, like
+// numpy.savez, so that numpy.load returns them by name.
+func WriteNpz(w io.Writer, tensors map[string]*NativeTensor) error {
+	names := make([]string, 0, len(tensors))
+	for name := range tensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if err := WriteNpy(fw, tensors[name]); err != nil {
+			return fmt.Errorf("Could not write '%s': %v", name, err)
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,131 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// rawNpy builds a version 1 npy file by hand.
+func rawNpy(header string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(npyMagic)
+	buf.Write([]byte{1, 0})
+	binary.Write(buf, binary.LittleEndian, uint16(len(header)+1))
+	buf.WriteString(header + "\n")
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestNpyRoundTrip(t *testing.T) {
+	vals := []interface{}{
+		[][]uint8{{1, 2}, {3, 4}},
+		[]int8{-1, 2},
+		[]uint16{1, 65535},
+		[][]int16{{-300}, {300}},
+		[]uint32{1 << 31},
+		[]int32{-5, 6, 7},
+		[]uint64{1 << 63},
+		[][][]int64{{{1, -2}}, {{3, 4}}},
+		[]Float16{0x3c00, 0xc000},
+		[]BFloat16{0x3f80},
+		[]float32{1.5, -2.25},
+		[][]float64{{3.125}},
+		[]bool{true, false, true},
+		[]complex64{1 + 2i},
+		[]complex128{3 - 4i, 0},
+		[][]string{{"a", "héllo"}, {"", "xyz"}},
+	}
+	for _, val := range vals {
+		nt := mustTensor(t, val)
+		buf := &bytes.Buffer{}
+		if err := WriteNpy(buf, nt); err != nil {
+			t.Fatalf("%T: %v", val, err)
+		}
+		if buf.Len() < 64 || bytes.IndexByte(buf.Bytes(), '\n')%64 != 63 {
+			t.Errorf("%T: data does not start on a 64 byte boundary", val)
+		}
+		back, err := ReadNpy(buf)
+		checkNative(t, back, err, val)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteNpy(buf, mustTensor(t, [][]int32{{1, 2, 3}, {4, 5, 6}})); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "{'descr': '<i4', 'fortran_order': False, 'shape': (2, 3), }") {
+		t.Errorf("Unexpected header %q", buf.String()[:64])
+	}
+}
+
+func TestReadNpyVariants(t *testing.T) {
+	// big endian int16
+	nt, err := ReadNpy(bytes.NewReader(rawNpy("{'descr': '>i2', 'fortran_order': False, 'shape': (2,), }", []byte{0x01, 0x02, 0xff, 0xfe})))
+	checkNative(t, nt, err, []int16{0x0102, -2})
+
+	// big endian complex64 swaps each half separately
+	data := []byte{0x3f, 0x80, 0, 0, 0x40, 0, 0, 0}
+	nt, err = ReadNpy(bytes.NewReader(rawNpy("{'descr': '>c8', 'fortran_order': False, 'shape': (1,), }", data)))
+	checkNative(t, nt, err, []complex64{1 + 2i})
+
+	// fortran order is column major
+	nt, err = ReadNpy(bytes.NewReader(rawNpy("{'descr': '|u1', 'fortran_order': True, 'shape': (2, 3), }", []byte{1, 4, 2, 5, 3, 6})))
+	checkNative(t, nt, err, [][]uint8{{1, 2, 3}, {4, 5, 6}})
+
+	// byte strings are padded with zeros
+	nt, err = ReadNpy(bytes.NewReader(rawNpy("{'descr': '|S3', 'fortran_order': False, 'shape': (2,), }", []byte("ab\x00xyz"))))
+	checkNative(t, nt, err, []string{"ab", "xyz"})
+
+	// big endian unicode strings
+	nt, err = ReadNpy(bytes.NewReader(rawNpy("{'descr': '>U2', 'fortran_order': False, 'shape': (1,), }", []byte{0, 0, 0, 'h', 0, 0, 0, 'i'})))
+	checkNative(t, nt, err, []string{"hi"})
+
+	// scalars have an empty shape
+	nt, err = ReadNpy(bytes.NewReader(rawNpy("{'descr': '<f8', 'fortran_order': False, 'shape': (), }", make([]byte, 8))))
+	if err != nil || len(nt.Shape) != 0 || nt.Type != graphpipefb.TypeFloat64 {
+		t.Errorf("Unexpected scalar %v (%v)", nt, err)
+	}
+
+	for _, bad := range [][]byte{
+		[]byte("not numpy at all"),
+		rawNpy("{'descr': '|O', 'fortran_order': False, 'shape': (1,), }", make([]byte, 8)),
+		rawNpy("{'descr': '<f4', 'fortran_order': False, 'shape': (3,), }", make([]byte, 8)),
+		rawNpy("{'descr': '<f4', 'fortran_order': False, 'shape': (4611686018427387904, 4), }", nil),
+	} {
+		if _, err := ReadNpy(bytes.NewReader(bad)); err == nil {
+			t.Errorf("Expected error reading %q", bad)
+		}
+	}
+}
+
+func TestNpz(t *testing.T) {
+	tensors := map[string]*NativeTensor{
+		"x":      mustTensor(t, [][]float32{{1, 2}, {3, 4}}),
+		"labels": mustTensor(t, []string{"cat", "dog"}),
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteNpz(buf, tensors); err != nil {
+		t.Fatal(err)
+	}
+	back, err := ReadNpz(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 2 {
+		t.Fatalf("Expected 2 tensors, got %d", len(back))
+	}
+	for name, nt := range tensors {
+		if !reflect.DeepEqual(back[name], nt) {
+			t.Errorf("Tensor '%s': expected %v, got %v", name, nt, back[name])
+		}
+	}
+}
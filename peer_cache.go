@@ -0,0 +1,539 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// peerPath is where peers serve their part of a PeerCache.
+	peerPath = "/control/cache/peer/"
+	// peerReplicas is how many points each peer has on the hash ring.
+	peerReplicas = 128
+	// maxPeerFields bounds the number of outputs and keys in a request
+	maxPeerFields = 1 << 20
+	// defaultMaxPeerRequest bounds the size of a request between peers
+	defaultMaxPeerRequest = 64 << 20
+)
+
+// ErrNoPeerToken is returned when a PeerCache has no token, since anyone
+// could then write rows into the cache of every replica.
+var ErrNoPeerToken = errors.New("Sharing the cache needs a token")
+
+// PeerCacheOptions configure how a PeerCache finds and talks to its peers.
+type PeerCacheOptions struct {
+	// Self is the url of this server as it appears in the peers.
+	Self string
+	// Peers are the urls of the servers sharing the cache, including
+	// this one.
+	Peers []string
+	// PeersFile lists the peers one per line instead. It is read again
+	// when it changes.
+	PeersFile string
+	// Token is sent to peers and required from them as a bearer token.
+	// It must be set.
+	Token string
+	// MaxRequestBytes bounds the size of a request from a peer. It
+	// defaults to 64 MiB.
+	MaxRequestBytes int64
+	// Timeout bounds each request to a peer. It defaults to 2 seconds.
+	Timeout time.Duration
+	// RetryAfter is how long a peer that failed is skipped for. It
+	// defaults to 10 seconds.
+	RetryAfter time.Duration
+	// WatchInterval is how often PeersFile is checked. It defaults to 5
+	// seconds.
+	WatchInterval time.Duration
+}
+
+// PeerCache shares cached results between replicas. Each peer owns the
+// keys that consistent hashing assigns to it, and rows are fetched from
+// and stored on their owner over http. While a peer is down its keys are
+// cached locally, so requests fall back to computing them here. Stats,
+// Purge and Each only cover the local part of the cache.
+type PeerCache struct {
+	local   Cache
+	self    string
+	opts    PeerCacheOptions
+	client  *http.Client
+	mu      sync.RWMutex
+	ring    []uint64
+	owners  map[uint64]string
+	down    map[string]time.Time
+	modTime time.Time
+	stop    chan bool
+}
+
+// NewPeerCache shares local with the peers in opts. Each peer must serve
+// the returned cache under /control/cache/peer/, which ServeRaw does. The
+// peers must share a token.
+func NewPeerCache(local Cache, opts *PeerCacheOptions) (*PeerCache, error) {
+	pc := &PeerCache{
+		local: local,
+		down:  map[string]time.Time{},
+		stop:  make(chan bool),
+	}
+	if opts != nil {
+		pc.opts = *opts
+	}
+	if pc.opts.Token == "" {
+		return nil, ErrNoPeerToken
+	}
+	if pc.opts.MaxRequestBytes == 0 {
+		pc.opts.MaxRequestBytes = defaultMaxPeerRequest
+	}
+	if pc.opts.Timeout == 0 {
+		pc.opts.Timeout = 2 * time.Second
+	}
+	if pc.opts.RetryAfter == 0 {
+		pc.opts.RetryAfter = 10 * time.Second
+	}
+	if pc.opts.WatchInterval == 0 {
+		pc.opts.WatchInterval = 5 * time.Second
+	}
+	pc.self = strings.TrimRight(pc.opts.Self, "/")
+	pc.client = &http.Client{Timeout: pc.opts.Timeout}
+	if pc.opts.PeersFile == "" {
+		pc.SetPeers(pc.opts.Peers)
+		return pc, nil
+	}
+	if err := pc.readPeers(); err != nil {
+		return nil, err
+	}
+	go pc.watch()
+	return pc, nil
+}
+
+// SetPeers replaces the peers sharing the cache.
+func (pc *PeerCache) SetPeers(peers []string) {
+	ring := []uint64{}
+	owners := map[uint64]string{}
+	for _, peer := range peers {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			continue
+		}
+		for i := 0; i < peerReplicas; i++ {
+			point := peerHash([]byte(peer + "#" + strconv.Itoa(i)))
+			if _, ok := owners[point]; !ok {
+				ring = append(ring, point)
+			}
+			owners[point] = peer
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+	pc.mu.Lock()
+	pc.ring, pc.owners = ring, owners
+	pc.mu.Unlock()
+	logrus.Infof("Sharing the cache with %d peers", len(peers))
+}
+
+func peerHash(b []byte) uint64 {
+	sum := sha256.Sum256(b)
+	return binary.LittleEndian.Uint64(sum[:8])
+}
+
+func (pc *PeerCache) readPeers() error {
+	info, err := os.Stat(pc.opts.PeersFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(pc.modTime) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(pc.opts.PeersFile)
+	if err != nil {
+		return err
+	}
+	peers := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			peers = append(peers, line)
+		}
+	}
+	pc.modTime = info.ModTime()
+	pc.SetPeers(peers)
+	return nil
+}
+
+func (pc *PeerCache) watch() {
+	ticker := time.NewTicker(pc.opts.WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pc.readPeers(); err != nil {
+				logrus.Errorf("Could not read peers from '%s': %v", pc.opts.PeersFile, err)
+			}
+		case <-pc.stop:
+			return
+		}
+	}
+}
+
+// owner returns the peer that owns key, or "" if it is cached locally.
+func (pc *PeerCache) owner(key []byte, now time.Time) string {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	if len(pc.ring) == 0 {
+		return ""
+	}
+	point := peerHash(key)
+	i := sort.Search(len(pc.ring), func(i int) bool { return pc.ring[i] >= point })
+	if i == len(pc.ring) {
+		i = 0
+	}
+	peer := pc.owners[pc.ring[i]]
+	if peer == pc.self || now.Before(pc.down[peer]) {
+		return ""
+	}
+	return peer
+}
+
+func (pc *PeerCache) failed(peer string, err error) {
+	logrus.Errorf("Cache peer %s failed, caching its rows locally: %v", peer, err)
+	pc.mu.Lock()
+	pc.down[peer] = time.Now().Add(pc.opts.RetryAfter)
+	pc.mu.Unlock()
+}
+
+// byOwner groups the indexes of keys by the peer that owns them.
+func (pc *PeerCache) byOwner(keys [][]byte) map[string][]int {
+	now := time.Now()
+	groups := map[string][]int{}
+	for j, key := range keys {
+		peer := pc.owner(key, now)
+		groups[peer] = append(groups[peer], j)
+	}
+	return groups
+}
+
+func pick(keys [][]byte, indexes []int) [][]byte {
+	picked := make([][]byte, len(indexes))
+	for j, ix := range indexes {
+		picked[j] = keys[ix]
+	}
+	return picked
+}
+
+// Get gets each row from the peer that owns it. Rows of peers that fail
+// are missing, so that they are computed again.
+func (pc *PeerCache) Get(outputs []string, keys [][]byte) ([][]byte, [][][]byte, error) {
+	typeShapes := make([][]byte, len(outputs))
+	data := make([][][]byte, len(outputs))
+	for i := range outputs {
+		data[i] = make([][]byte, len(keys))
+	}
+	for peer, indexes := range pc.byOwner(keys) {
+		var ts [][]byte
+		var rows [][][]byte
+		var err error
+		if peer == "" {
+			ts, rows, err = pc.local.Get(outputs, pick(keys, indexes))
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			ts, rows, err = pc.peerGet(peer, outputs, pick(keys, indexes))
+			if err != nil {
+				pc.failed(peer, err)
+				continue
+			}
+		}
+		for i := range outputs {
+			if ts[i] == nil {
+				continue
+			}
+			if typeShapes[i] == nil {
+				typeShapes[i] = ts[i]
+			}
+			for j, ix := range indexes {
+				data[i][ix] = rows[i][j]
+			}
+		}
+	}
+	return typeShapes, data, nil
+}
+
+// Put stores each row on the peer that owns it, or locally if the peer
+// fails.
+func (pc *PeerCache) Put(outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	var localErr error
+	for peer, indexes := range pc.byOwner(keys) {
+		rows := make([][][]byte, len(outputs))
+		for i := range outputs {
+			rows[i] = pick(data[i], indexes)
+		}
+		if peer != "" {
+			err := pc.peerPut(peer, outputs, typeShapes, pick(keys, indexes), rows)
+			if err == nil {
+				continue
+			}
+			pc.failed(peer, err)
+		}
+		if err := pc.local.Put(outputs, typeShapes, pick(keys, indexes), rows); err != nil {
+			localErr = err
+		}
+	}
+	return localErr
+}
+
+// Stats returns the stats of the local part of the cache.
+func (pc *PeerCache) Stats() (map[string]CacheStats, error) {
+	return pc.local.Stats()
+}
+
+// Purge purges the local part of the cache.
+func (pc *PeerCache) Purge(outputs []string) error {
+	return pc.local.Purge(outputs)
+}
+
+// Each calls fn for every row in the local part of the cache.
+func (pc *PeerCache) Each(fn func(output string, typeShape, key, data []byte) error) error {
+	return pc.local.Each(fn)
+}
+
+// Close stops watching the peers and closes the local cache.
+func (pc *PeerCache) Close() error {
+	select {
+	case <-pc.stop:
+	default:
+		close(pc.stop)
+	}
+	return pc.local.Close()
+}
+
+// The requests between peers hold fields written with writeField, and
+// rows that may be missing are preceded by a byte that is 0 if they are.
+
+func writeOptField(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteByte(0)
+		return
+	}
+	w.WriteByte(1)
+	writeField(w, b)
+}
+
+func readOptField(r *bufio.Reader, max uint64) ([]byte, error) {
+	present, err := r.ReadByte()
+	if err != nil || present == 0 {
+		return nil, err
+	}
+	return readField(r, max)
+}
+
+func writeFields(w *bufio.Writer, fields [][]byte) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutUvarint(buf, uint64(len(fields)))])
+	for _, f := range fields {
+		writeField(w, f)
+	}
+}
+
+func readFields(r *bufio.Reader, max uint64) ([][]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxPeerFields {
+		return nil, fmt.Errorf("Peer request is corrupt")
+	}
+	fields := make([][]byte, n)
+	for i := range fields {
+		if fields[i], err = readField(r, max); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+// maxField bounds each field read from a peer, so that a field can not make
+// us allocate more than a request may hold.
+func (pc *PeerCache) maxField() uint64 {
+	return uint64(pc.opts.MaxRequestBytes)
+}
+
+func stringFields(strs []string) [][]byte {
+	fields := make([][]byte, len(strs))
+	for i, s := range strs {
+		fields[i] = []byte(s)
+	}
+	return fields
+}
+
+func fieldStrings(fields [][]byte) []string {
+	strs := make([]string, len(fields))
+	for i, f := range fields {
+		strs[i] = string(f)
+	}
+	return strs
+}
+
+func (pc *PeerCache) post(peer, op string, body []byte) (*bufio.Reader, func(), error) {
+	req, err := http.NewRequest("POST", peer+peerPath+op, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+pc.opts.Token)
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }, nil
+}
+
+func (pc *PeerCache) peerGet(peer string, outputs []string, keys [][]byte) ([][]byte, [][][]byte, error) {
+	buf := &bytes.Buffer{}
+	bw := bufio.NewWriter(buf)
+	writeFields(bw, stringFields(outputs))
+	writeFields(bw, keys)
+	bw.Flush()
+	br, done, err := pc.post(peer, "get", buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+	typeShapes := make([][]byte, len(outputs))
+	data := make([][][]byte, len(outputs))
+	for i := range outputs {
+		if typeShapes[i], err = readOptField(br, pc.maxField()); err != nil {
+			return nil, nil, err
+		}
+		data[i] = make([][]byte, len(keys))
+		for j := range keys {
+			if data[i][j], err = readOptField(br, pc.maxField()); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return typeShapes, data, nil
+}
+
+func (pc *PeerCache) peerPut(peer string, outputs []string, typeShapes [][]byte, keys [][]byte, data [][][]byte) error {
+	buf := &bytes.Buffer{}
+	bw := bufio.NewWriter(buf)
+	writeFields(bw, stringFields(outputs))
+	writeFields(bw, typeShapes)
+	writeFields(bw, keys)
+	for i := range outputs {
+		for j := range keys {
+			writeOptField(bw, data[i][j])
+		}
+	}
+	bw.Flush()
+	_, done, err := pc.post(peer, "put", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	done()
+	return nil
+}
+
+// ServeHTTP serves the local part of the cache to peers.
+func (pc *PeerCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pc.opts.Token == "" {
+		http.Error(w, "cache peers need a token", http.StatusForbidden)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(pc.opts.Token)) != 1 {
+		http.Error(w, "invalid peer token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "peer requests need a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	br := bufio.NewReader(http.MaxBytesReader(w, r.Body, pc.opts.MaxRequestBytes))
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, peerPath) {
+	case "get":
+		err = pc.serveGet(w, br)
+	case "put":
+		err = pc.servePut(br)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to serve cache peer: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (pc *PeerCache) serveGet(w http.ResponseWriter, br *bufio.Reader) error {
+	outputs, err := readFields(br, pc.maxField())
+	if err != nil {
+		return err
+	}
+	keys, err := readFields(br, pc.maxField())
+	if err != nil {
+		return err
+	}
+	typeShapes, data, err := pc.local.Get(fieldStrings(outputs), keys)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for i := range outputs {
+		writeOptField(bw, typeShapes[i])
+		for j := range keys {
+			writeOptField(bw, data[i][j])
+		}
+	}
+	return bw.Flush()
+}
+
+func (pc *PeerCache) servePut(br *bufio.Reader) error {
+	outputs, err := readFields(br, pc.maxField())
+	if err != nil {
+		return err
+	}
+	typeShapes, err := readFields(br, pc.maxField())
+	if err != nil {
+		return err
+	}
+	keys, err := readFields(br, pc.maxField())
+	if err != nil {
+		return err
+	}
+	if len(typeShapes) != len(outputs) {
+		return fmt.Errorf("Peer request is corrupt")
+	}
+	data := make([][][]byte, len(outputs))
+	for i := range outputs {
+		data[i] = make([][]byte, len(keys))
+		for j := range keys {
+			if data[i][j], err = readOptField(br, pc.maxField()); err != nil {
+				return err
+			}
+		}
+	}
+	return pc.local.Put(fieldStrings(outputs), typeShapes, keys, data)
+}
@@ -0,0 +1,251 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+type testPeers struct {
+	servers []*httptest.Server
+	caches  []*PeerCache
+	locals  []*MemoryCache
+	urls    []string
+}
+
+// newTestPeers starts n in-process servers that share a cache.
+func newTestPeers(t *testing.T, n int) *testPeers {
+	tp := &testPeers{caches: make([]*PeerCache, n)}
+	for i := 0; i < n; i++ {
+		i := i
+		tp.servers = append(tp.servers, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.caches[i].ServeHTTP(w, r)
+		})))
+		tp.urls = append(tp.urls, tp.servers[i].URL)
+	}
+	for i := 0; i < n; i++ {
+		local := NewMemoryCache(1 << 20)
+		pc, err := NewPeerCache(local, &PeerCacheOptions{Self: tp.urls[i], Peers: tp.urls, Token: "secret", RetryAfter: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tp.caches[i] = pc
+		tp.locals = append(tp.locals, local)
+	}
+	return tp
+}
+
+func (tp *testPeers) close() {
+	for i := range tp.servers {
+		tp.servers[i].Close()
+		tp.caches[i].Close()
+	}
+}
+
+func testKeys(n int) ([][]byte, [][][]byte) {
+	keys := make([][]byte, n)
+	data := [][][]byte{make([][]byte, n)}
+	for j := range keys {
+		keys[j] = []byte(fmt.Sprintf("key %d", j))
+		data[0][j] = []byte(fmt.Sprintf("row %d", j))
+	}
+	return keys, data
+}
+
+func TestPeerCache(t *testing.T) {
+	tp := newTestPeers(t, 3)
+	defer tp.close()
+
+	keys, data := testKeys(30)
+	ts := [][]byte{{1, 2}}
+	if err := tp.caches[0].Put([]string{"out"}, ts, keys, data); err != nil {
+		t.Fatal(err)
+	}
+	// the rows are spread over the peers
+	total := int64(0)
+	for i, local := range tp.locals {
+		stats, _ := local.Stats()
+		if stats["out"].Entries == 0 {
+			t.Errorf("Expected peer %d to own some rows", i)
+		}
+		total += stats["out"].Entries
+	}
+	if total != 30 {
+		t.Errorf("Expected 30 rows to be cached once, got %d", total)
+	}
+
+	// and every peer sees all of them
+	typeShapes, got, err := tp.caches[2].Get([]string{"out", "other"}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(typeShapes[0]) != string(ts[0]) || typeShapes[1] != nil {
+		t.Errorf("Unexpected type shapes %q", typeShapes)
+	}
+	for j := range keys {
+		if string(got[0][j]) != string(data[0][j]) {
+			t.Errorf("Expected %q for key %d, got %q", data[0][j], j, got[0][j])
+		}
+	}
+}
+
+func TestPeerCacheToken(t *testing.T) {
+	tp := newTestPeers(t, 2)
+	defer tp.close()
+	r := httptest.NewRequest("POST", peerPath+"get", nil)
+	w := httptest.NewRecorder()
+	tp.caches[0].ServeHTTP(w, r)
+	if w.Code != 401 {
+		t.Errorf("Expected a 401 without the token, got %d", w.Code)
+	}
+
+	if _, err := NewPeerCache(NewMemoryCache(1<<20), &PeerCacheOptions{Peers: tp.urls}); err != ErrNoPeerToken {
+		t.Errorf("Expected a token to be required, got %v", err)
+	}
+}
+
+func TestPeerCacheLimits(t *testing.T) {
+	pc, err := NewPeerCache(NewMemoryCache(1<<20), &PeerCacheOptions{Token: "secret", MaxRequestBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	put := func(body []byte) int {
+		r := httptest.NewRequest("POST", peerPath+"put", bytes.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		pc.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// one output whose name claims to be 1 GiB
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, 1)
+	n += binary.PutUvarint(buf[n:], 1<<30)
+	if code := put(buf[:n]); code != 400 {
+		t.Errorf("Expected a 400 for a huge field, got %d", code)
+	}
+
+	// ten rows that are each small enough, but too many together
+	b := &bytes.Buffer{}
+	bw := bufio.NewWriter(b)
+	keys, _ := testKeys(10)
+	writeFields(bw, [][]byte{[]byte("out")})
+	writeFields(bw, [][]byte{{1}})
+	writeFields(bw, keys)
+	for range keys {
+		writeOptField(bw, make([]byte, 200))
+	}
+	bw.Flush()
+	if code := put(b.Bytes()); code != 400 {
+		t.Errorf("Expected a 400 for a large request, got %d", code)
+	}
+}
+
+func TestPeerCacheDown(t *testing.T) {
+	tp := newTestPeers(t, 2)
+	defer tp.close()
+	keys, data := testKeys(20)
+	ts := [][]byte{{1}}
+	tp.caches[0].Put([]string{"out"}, ts, keys, data)
+	tp.servers[1].Close()
+
+	// the rows of the peer that is down are missing, not an error
+	_, got, err := tp.caches[0].Get([]string{"out"}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := 0
+	for j := range keys {
+		if got[0][j] == nil {
+			missing++
+		}
+	}
+	if missing == 0 || missing == len(keys) {
+		t.Errorf("Expected only the rows of the peer that is down to be missing, got %d", missing)
+	}
+
+	// and they are cached locally until it is back
+	tp.caches[0].Put([]string{"out"}, ts, keys, data)
+	stats, _ := tp.locals[0].Stats()
+	if stats["out"].Entries != 20 {
+		t.Errorf("Expected every row to be cached locally, got %d", stats["out"].Entries)
+	}
+}
+
+func TestPeerCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers")
+	ioutil.WriteFile(path, []byte("# peers\nhttp://self\n"), 0644)
+	pc, err := NewPeerCache(NewMemoryCache(1<<20), &PeerCacheOptions{Self: "http://self", PeersFile: path, Token: "secret", WatchInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	keys, _ := testKeys(20)
+	for _, key := range keys {
+		if owner := pc.owner(key, time.Now()); owner != "" {
+			t.Fatalf("Expected every key to be local, got %s", owner)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("http://self\nhttp://other/\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		remote := 0
+		for _, key := range keys {
+			if pc.owner(key, time.Now()) == "http://other" {
+				remote++
+			}
+		}
+		if remote > 0 && remote < len(keys) {
+			return
+		}
+	}
+	t.Errorf("Expected the keys to be shared after the peers file changed")
+}
+
+func TestPeerCachedResults(t *testing.T) {
+	tp := newTestPeers(t, 3)
+	defer tp.close()
+	applied := 0
+	apply := func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		applied++
+		in := inputs["some/input/name:0"]
+		return []*NativeTensor{in, in}, nil
+	}
+	req := makeRequestRaw(makeTensor(10, 0, graphpipefb.TypeFloat32))
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+
+	// rows computed by one replica are not computed by the others
+	for i, pc := range tp.caches {
+		c := &appContext{cache: pc, apply: apply}
+		if _, err := getResultsCached(c, rc, req); err != nil {
+			t.Fatal(err)
+		}
+		c.cacheWriter().close()
+		if applied != 1 {
+			t.Errorf("Expected replica %d to use the shared cache, got %d applies", i, applied)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package postprocess
+
+import (
+	"fmt"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// Activation is applied to the model output before picking classes.
+type Activation int
+
+const (
+	// None uses the output as is, for models that already return
+	// probabilities.
+	None Activation = iota
+	// SoftmaxActivation applies Softmax, for models that return logits.
+	SoftmaxActivation
+	// SigmoidActivation applies Sigmoid, for multi-label models.
+	SigmoidActivation
+)
+
+// Options describe the outputs that Applier adds to a model.
+type Options struct {
+	// Output is the model output holding the class scores.
+	Output     string
+	Activation Activation
+	// K is how many classes to return for each row. The zero value means 1.
+	K int
+	// Labels are the names of the classes. Without them there is no labels
+	// output.
+	Labels []string
+	// The names of the added outputs. They default to "labels", "scores"
+	// and "indexes".
+	LabelsOutput  string
+	ScoresOutput  string
+	IndexesOutput string
+}
+
+func (o *Options) k() int {
+	if o.K == 0 {
+		return 1
+	}
+	return o.K
+}
+
+func (o *Options) labelsOutput() string {
+	if o.LabelsOutput == "" {
+		return "labels"
+	}
+	return o.LabelsOutput
+}
+
+func (o *Options) scoresOutput() string {
+	if o.ScoresOutput == "" {
+		return "scores"
+	}
+	return o.ScoresOutput
+}
+
+func (o *Options) indexesOutput() string {
+	if o.IndexesOutput == "" {
+		return "indexes"
+	}
+	return o.IndexesOutput
+}
+
+// Classify applies the activation to a model output and picks the top
+// classes, returning their indexes, scores and, if there are labels, their
+// labels.
+func Classify(output *graphpipe.NativeTensor, opts *Options) (indexes, scores, labels *graphpipe.NativeTensor, err error) {
+	switch opts.Activation {
+	case SoftmaxActivation:
+		output, err = Softmax(output)
+	case SigmoidActivation:
+		output, err = Sigmoid(output)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	indexes, scores, err = TopK(output, opts.k())
+	if err != nil || len(opts.Labels) == 0 {
+		return indexes, scores, nil, err
+	}
+	labels, err = MapLabels(indexes, opts.Labels)
+	return indexes, scores, labels, err
+}
+
+// AddMetadata advertises the outputs added by Applier in the metadata of a
+// model.
+func AddMetadata(meta *graphpipe.NativeMetadataResponse, opts *Options) {
+	shape := []int64{-1, int64(opts.k())}
+	if len(opts.Labels) > 0 {
+		meta.Outputs = append(meta.Outputs, graphpipe.NativeIOMetadata{
+			Name:        opts.labelsOutput(),
+			Description: fmt.Sprintf("Labels of the top classes of %s", opts.Output),
+			Shape:       shape,
+			Type:        graphpipefb.TypeString,
+		})
+	}
+	meta.Outputs = append(meta.Outputs, graphpipe.NativeIOMetadata{
+		Name:        opts.scoresOutput(),
+		Description: fmt.Sprintf("Scores of the top classes of %s", opts.Output),
+		Shape:       shape,
+		Type:        graphpipefb.TypeFloat32,
+	}, graphpipe.NativeIOMetadata{
+		Name:        opts.indexesOutput(),
+		Description: fmt.Sprintf("Indexes of the top classes of %s", opts.Output),
+		Shape:       shape,
+		Type:        graphpipefb.TypeInt64,
+	})
+}
+
+// Applier wraps apply so that the model also has labels, scores and
+// indexes outputs, computed from opts.Output with Classify. Requests for
+// other outputs go to apply unchanged. Use AddMetadata to advertise the new
+// outputs.
+func Applier(opts *Options, apply graphpipe.Applier) graphpipe.Applier {
+	return func(requestContext *graphpipe.RequestContext, config string, inputs map[string]*graphpipe.NativeTensor, outputNames []string) ([]*graphpipe.NativeTensor, error) {
+		added := map[string]bool{
+			opts.scoresOutput():  true,
+			opts.indexesOutput(): true,
+		}
+		if len(opts.Labels) > 0 {
+			added[opts.labelsOutput()] = true
+		}
+
+		// ask the model for the outputs it has, plus the one we classify
+		modelOutputs := []string{}
+		classify := false
+		source := -1
+		for _, name := range outputNames {
+			if added[name] {
+				classify = true
+				continue
+			}
+			if name == opts.Output {
+				source = len(modelOutputs)
+			}
+			modelOutputs = append(modelOutputs, name)
+		}
+		if classify && source < 0 {
+			source = len(modelOutputs)
+			modelOutputs = append(modelOutputs, opts.Output)
+		}
+
+		outputs, err := apply(requestContext, config, inputs, modelOutputs)
+		if err != nil || !classify {
+			return outputs, err
+		}
+		if len(outputs) != len(modelOutputs) {
+			return nil, fmt.Errorf("Expected %d outputs, got %d", len(modelOutputs), len(outputs))
+		}
+		indexes, scores, labels, err := Classify(outputs[source], opts)
+		if err != nil {
+			return nil, fmt.Errorf("Could not classify %s: %v", opts.Output, err)
+		}
+
+		results := make([]*graphpipe.NativeTensor, len(outputNames))
+		j := 0
+		for i, name := range outputNames {
+			switch {
+			case !added[name]:
+				results[i] = outputs[j]
+				j++
+			case name == opts.labelsOutput():
+				results[i] = labels
+			case name == opts.scoresOutput():
+				results[i] = scores
+			default:
+				results[i] = indexes
+			}
+		}
+		return results, nil
+	}
+}
@@ -0,0 +1,186 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+// Package postprocess turns classifier outputs into answers: it applies
+// softmax or sigmoid, picks the top scoring classes and maps them to
+// labels. It works on the last axis of a tensor, so a [batch, classes]
+// output gives the top classes for each row, and it can run on the server
+// to add labels and scores outputs to a model.
+package postprocess
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// floats returns the values of a real tensor as float32, casting other types.
+func floats(nt *graphpipe.NativeTensor) ([]float32, error) {
+	if len(nt.Shape) == 0 {
+		return nil, fmt.Errorf("Expected a tensor with a class axis, got a scalar")
+	}
+	t, err := nt.Cast(graphpipefb.TypeFloat32)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := t.Float32s()
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// newTensor allocates a tensor of type dt, which must not be a string.
+func newTensor(shape []int64, dt uint8, size int) *graphpipe.NativeTensor {
+	elems := 1
+	for _, d := range shape {
+		elems *= int(d)
+	}
+	nt := &graphpipe.NativeTensor{}
+	nt.InitWithData(make([]byte, elems*size), shape, dt)
+	return nt
+}
+
+// Softmax normalizes the last axis of nt into probabilities that add up to
+// 1. The result is a float32 tensor of the same shape.
+func Softmax(nt *graphpipe.NativeTensor) (*graphpipe.NativeTensor, error) {
+	vals, err := floats(nt)
+	if err != nil {
+		return nil, err
+	}
+	out := newTensor(nt.Shape, graphpipefb.TypeFloat32, 4)
+	probs, _ := out.Float32s()
+	classes := int(nt.Shape[len(nt.Shape)-1])
+	for start := 0; start+classes <= len(vals) && classes > 0; start += classes {
+		row := vals[start : start+classes]
+		// subtract the max so exp can not overflow
+		max := row[0]
+		for _, v := range row {
+			if v > max {
+				max = v
+			}
+		}
+		sum := float64(0)
+		for i, v := range row {
+			e := math.Exp(float64(v - max))
+			probs[start+i] = float32(e)
+			sum += e
+		}
+		for i := range row {
+			probs[start+i] = float32(float64(probs[start+i]) / sum)
+		}
+	}
+	return out, nil
+}
+
+// Sigmoid maps each value of nt to between 0 and 1, for models that score
+// each class on its own. The result is a float32 tensor of the same shape.
+func Sigmoid(nt *graphpipe.NativeTensor) (*graphpipe.NativeTensor, error) {
+	vals, err := floats(nt)
+	if err != nil {
+		return nil, err
+	}
+	out := newTensor(nt.Shape, graphpipefb.TypeFloat32, 4)
+	probs, _ := out.Float32s()
+	for i, v := range vals {
+		probs[i] = float32(1 / (1 + math.Exp(-float64(v))))
+	}
+	return out, nil
+}
+
+// TopK finds the k highest values along the last axis of nt. It returns
+// an int64 tensor of their indexes and a float32 tensor of the values, both
+// with the last dimension replaced by k, highest first. Ties keep the lower
+// index first. If k is larger than the last dimension all values are
+// returned.
+func TopK(nt *graphpipe.NativeTensor, k int) (indexes, scores *graphpipe.NativeTensor, err error) {
+	if k < 1 {
+		return nil, nil, fmt.Errorf("k must be at least 1, got %d", k)
+	}
+	vals, err := floats(nt)
+	if err != nil {
+		return nil, nil, err
+	}
+	classes := int(nt.Shape[len(nt.Shape)-1])
+	if k > classes {
+		k = classes
+	}
+	shape := make([]int64, len(nt.Shape))
+	copy(shape, nt.Shape)
+	shape[len(shape)-1] = int64(k)
+	indexes = newTensor(shape, graphpipefb.TypeInt64, 8)
+	scores = newTensor(shape, graphpipefb.TypeFloat32, 4)
+	if k == 0 {
+		return indexes, scores, nil
+	}
+	idxOut, _ := indexes.Int64s()
+	scoreOut, _ := scores.Float32s()
+	order := make([]int, classes)
+	for r := 0; r*classes < len(vals); r++ {
+		row := vals[r*classes : (r+1)*classes]
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return row[order[i]] > row[order[j]] })
+		for i := 0; i < k; i++ {
+			idxOut[r*k+i] = int64(order[i])
+			scoreOut[r*k+i] = row[order[i]]
+		}
+	}
+	return indexes, scores, nil
+}
+
+// ReadLabels reads a labels file with one label per line, so that the
+// label of class i is on line i, counting from 0.
+func ReadLabels(r io.Reader) ([]string, error) {
+	labels := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		labels = append(labels, scanner.Text())
+	}
+	return labels, scanner.Err()
+}
+
+// LoadLabels reads a labels file from disk. See ReadLabels.
+func LoadLabels(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadLabels(f)
+}
+
+// MapLabels replaces the class indexes in an integer tensor, such as the
+// one from TopK, with their labels. The result is a string tensor of the
+// same shape.
+func MapLabels(indexes *graphpipe.NativeTensor, labels []string) (*graphpipe.NativeTensor, error) {
+	idx, err := indexes.Cast(graphpipefb.TypeInt64)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := idx.Int64s()
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		if v < 0 || v >= int64(len(labels)) {
+			return nil, fmt.Errorf("Class %d has no label, there are %d labels", v, len(labels))
+		}
+		strs[i] = labels[v]
+	}
+	out := &graphpipe.NativeTensor{}
+	if err := out.InitWithStringVals(strs, indexes.Shape); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
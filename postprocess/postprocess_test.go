@@ -0,0 +1,140 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package postprocess
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+)
+
+func mustTensor(t *testing.T, val interface{}) *graphpipe.NativeTensor {
+	t.Helper()
+	nt := &graphpipe.NativeTensor{}
+	if err := nt.InitSimple(val); err != nil {
+		t.Fatal(err)
+	}
+	return nt
+}
+
+func checkNative(t *testing.T, nt *graphpipe.NativeTensor, err error, expected interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := graphpipe.NativeTensorToNative(nt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(native, expected) {
+		t.Fatalf("Expected %v, got %v", expected, native)
+	}
+}
+
+func TestSoftmaxSigmoid(t *testing.T) {
+	nt := mustTensor(t, [][]float64{{1, 1, 1, 1}, {1000, 1000, 1000, 1000}})
+	sm, err := Softmax(nt)
+	checkNative(t, sm, err, [][]float32{{0.25, 0.25, 0.25, 0.25}, {0.25, 0.25, 0.25, 0.25}})
+	sm, err = Softmax(mustTensor(t, []float32{0, float32(math.Log(3))}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	probs, _ := sm.Float32s()
+	if math.Abs(float64(probs[0])-0.25) > 1e-6 || math.Abs(float64(probs[1])-0.75) > 1e-6 {
+		t.Errorf("Unexpected probabilities %v", probs)
+	}
+
+	sg, err := Sigmoid(mustTensor(t, []int32{0}))
+	checkNative(t, sg, err, []float32{0.5})
+
+	if _, err := Softmax(mustTensor(t, []string{"a"})); err == nil {
+		t.Errorf("Expected error for string tensor")
+	}
+}
+
+func TestTopK(t *testing.T) {
+	nt := mustTensor(t, [][]float32{{0.1, 0.5, 0.2, 0.5}, {0.9, 0, 0, 0.1}})
+	indexes, scores, err := TopK(nt, 2)
+	checkNative(t, indexes, err, [][]int64{{1, 3}, {0, 3}})
+	checkNative(t, scores, err, [][]float32{{0.5, 0.5}, {0.9, 0.1}})
+
+	indexes, _, err = TopK(nt, 10)
+	checkNative(t, indexes, err, [][]int64{{1, 3, 2, 0}, {0, 3, 1, 2}})
+
+	if _, _, err := TopK(nt, 0); err == nil {
+		t.Errorf("Expected error for k of 0")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	labels, err := ReadLabels(strings.NewReader("cat\ndog\n\nbird\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labels, []string{"cat", "dog", "", "bird"}) {
+		t.Fatalf("Unexpected labels %q", labels)
+	}
+	mapped, err := MapLabels(mustTensor(t, [][]int64{{3, 0}}), labels)
+	checkNative(t, mapped, err, [][]string{{"bird", "cat"}})
+	if _, err := MapLabels(mustTensor(t, []int64{4}), labels); err == nil {
+		t.Errorf("Expected error for class without a label")
+	}
+}
+
+func TestApplier(t *testing.T) {
+	var asked []string
+	apply := func(_ *graphpipe.RequestContext, _ string, _ map[string]*graphpipe.NativeTensor, outputNames []string) ([]*graphpipe.NativeTensor, error) {
+		asked = outputNames
+		outputs := make([]*graphpipe.NativeTensor, len(outputNames))
+		for i, name := range outputNames {
+			if name == "logits" {
+				outputs[i] = mustTensor(t, [][]float32{{1, 3, 2}})
+			} else {
+				outputs[i] = mustTensor(t, []string{name})
+			}
+		}
+		return outputs, nil
+	}
+	opts := &Options{
+		Output:     "logits",
+		Activation: SoftmaxActivation,
+		K:          2,
+		Labels:     []string{"a", "b", "c"},
+	}
+	wrapped := Applier(opts, apply)
+
+	outputs, err := wrapped(nil, "", nil, []string{"labels", "other", "indexes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []string{"other", "logits"}) {
+		t.Errorf("Unexpected model outputs %v", asked)
+	}
+	checkNative(t, outputs[0], nil, [][]string{{"b", "c"}})
+	checkNative(t, outputs[1], nil, []string{"other"})
+	checkNative(t, outputs[2], nil, [][]int64{{1, 2}})
+
+	outputs, err = wrapped(nil, "", nil, []string{"logits", "scores"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []string{"logits"}) || len(outputs) != 2 {
+		t.Fatalf("Unexpected model outputs %v", asked)
+	}
+	scores, _ := outputs[1].Float32s()
+	if len(scores) != 2 || math.Abs(float64(scores[0])-0.665) > 0.001 {
+		t.Errorf("Unexpected scores %v", scores)
+	}
+
+	meta := &graphpipe.NativeMetadataResponse{}
+	AddMetadata(meta, opts)
+	if len(meta.Outputs) != 3 || meta.Outputs[0].Name != "labels" {
+		t.Errorf("Unexpected metadata %+v", meta.Outputs)
+	}
+}
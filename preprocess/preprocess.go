@@ -0,0 +1,313 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+// Package preprocess turns images into graphpipe tensors for vision models.
+// It decodes jpeg, png and gif data, resizes, orders channels and
+// normalizes, and can do all of that on the server for models that take
+// encoded images as string inputs.
+package preprocess
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	// register the decoders used by image.Decode
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// Layout is the order of the dimensions of an image tensor.
+type Layout int
+
+const (
+	// NHWC is batch, height, width, channels, as used by tensorflow.
+	NHWC Layout = iota
+	// NCHW is batch, channels, height, width, as used by onnx and caffe2.
+	NCHW
+)
+
+// ResizeMode is how an image is fit to the requested width and height.
+type ResizeMode int
+
+const (
+	// ResizeStretch scales each axis separately, changing the aspect ratio.
+	ResizeStretch ResizeMode = iota
+	// ResizeCrop scales the image to cover the size and cuts off the
+	// overflow evenly from both sides.
+	ResizeCrop
+	// ResizePad scales the image to fit inside the size and fills the rest
+	// with black.
+	ResizePad
+	// ResizeNone leaves the image alone. All images in a batch must then
+	// have the same size.
+	ResizeNone
+)
+
+// Interpolation is how pixels are sampled when resizing.
+type Interpolation int
+
+const (
+	// Bilinear blends the four nearest pixels.
+	Bilinear Interpolation = iota
+	// Nearest takes the nearest pixel.
+	Nearest
+)
+
+// Options describe how images become a tensor. The zero value makes a
+// uint8 NHWC rgb tensor of images at their own size.
+type Options struct {
+	// Width and Height are the size of the images in the tensor. They
+	// must be set together, and if they are 0 images are not resized.
+	Width, Height int
+	Resize        ResizeMode
+	Interpolation Interpolation
+	Layout        Layout
+	// Type is graphpipefb.TypeUint8 or graphpipefb.TypeFloat32. The zero
+	// value means TypeUint8.
+	Type uint8
+	// BGR puts the channels in blue, green, red order.
+	BGR bool
+	// Grayscale makes a single channel of luma instead of three colors.
+	Grayscale bool
+	// Scale multiplies each value, for example by 1/255 to get values
+	// between 0 and 1. The zero value means 1.
+	Scale float32
+	// Mean and Std normalize each value as (value*Scale - Mean) / Std.
+	// They hold one value for every channel, in output order, or a single
+	// value for all channels.
+	Mean, Std []float32
+	// MaxPixels is the largest width times height of an image that will
+	// be decoded, so that a small file claiming to be huge can not use up
+	// the memory of the server. The zero value means DefaultMaxPixels.
+	MaxPixels int64
+}
+
+// DefaultMaxPixels is the largest image that is decoded unless Options say
+// otherwise, 4096x4096.
+const DefaultMaxPixels = 4096 * 4096
+
+var defaultOptions = Options{}
+
+func (o *Options) maxPixels() int64 {
+	if o.MaxPixels > 0 {
+		return o.MaxPixels
+	}
+	return DefaultMaxPixels
+}
+
+func (o *Options) channels() int {
+	if o.Grayscale {
+		return 1
+	}
+	return 3
+}
+
+func (o *Options) check() error {
+	if (o.Width > 0) != (o.Height > 0) || o.Width < 0 || o.Height < 0 {
+		return fmt.Errorf("Width and height must both be set, got %dx%d", o.Width, o.Height)
+	}
+	switch o.Type {
+	case graphpipefb.TypeNull, graphpipefb.TypeUint8:
+		if o.Scale != 0 || len(o.Mean) > 0 || len(o.Std) > 0 {
+			return fmt.Errorf("Scale, mean and std need a float32 tensor")
+		}
+	case graphpipefb.TypeFloat32:
+	default:
+		return fmt.Errorf("Images can only be uint8 or float32 tensors")
+	}
+	for _, vals := range [][]float32{o.Mean, o.Std} {
+		if len(vals) > 1 && len(vals) != o.channels() {
+			return fmt.Errorf("Mean and std need 1 or %d values, got %d", o.channels(), len(vals))
+		}
+	}
+	for _, s := range o.Std {
+		if s == 0 {
+			return fmt.Errorf("Std can not be 0")
+		}
+	}
+	return nil
+}
+
+// perChannel returns the value of a mean or std option for channel c.
+func perChannel(vals []float32, c int, def float32) float32 {
+	switch len(vals) {
+	case 0:
+		return def
+	case 1:
+		return vals[0]
+	}
+	return vals[c]
+}
+
+// Image converts a single image into a tensor with a batch dimension of 1.
+// If opts is nil the defaults are used.
+func Image(img image.Image, opts *Options) (*graphpipe.NativeTensor, error) {
+	return Images([]image.Image{img}, opts)
+}
+
+// Images converts images into a single batch tensor. If opts is nil the
+// defaults are used.
+func Images(imgs []image.Image, opts *Options) (*graphpipe.NativeTensor, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("No images to convert")
+	}
+
+	mode := opts.Resize
+	width, height := opts.Width, opts.Height
+	if width == 0 {
+		mode = ResizeNone
+	}
+	pics := make([]*rgb, len(imgs))
+	for i, img := range imgs {
+		b := img.Bounds()
+		if b.Empty() {
+			return nil, fmt.Errorf("Image %d is empty", i)
+		}
+		if mode == ResizeNone {
+			if i == 0 && width == 0 {
+				width, height = b.Dx(), b.Dy()
+			}
+			if b.Dx() != width || b.Dy() != height {
+				return nil, fmt.Errorf("Image %d is %dx%d, expected %dx%d", i, b.Dx(), b.Dy(), width, height)
+			}
+		}
+		pics[i] = resize(toRGB(img), width, height, mode, opts.Interpolation)
+	}
+
+	channels := opts.channels()
+	shape := []int64{int64(len(imgs)), int64(height), int64(width), int64(channels)}
+	if opts.Layout == NCHW {
+		shape = []int64{int64(len(imgs)), int64(channels), int64(height), int64(width)}
+	}
+	dt := opts.Type
+	if dt == graphpipefb.TypeNull {
+		dt = graphpipefb.TypeUint8
+	}
+	size := 1
+	if dt == graphpipefb.TypeFloat32 {
+		size = 4
+	}
+	nt := &graphpipe.NativeTensor{}
+	data := make([]byte, len(imgs)*height*width*channels*size)
+	if err := nt.InitWithData(data, shape, dt); err != nil {
+		return nil, err
+	}
+
+	// fill the tensor through a typed view of its data
+	var bytesOut []uint8
+	var floatsOut []float32
+	if dt == graphpipefb.TypeFloat32 {
+		floatsOut, _ = nt.Float32s()
+	} else {
+		bytesOut, _ = nt.Uint8s()
+	}
+	scale := opts.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	mean := make([]float32, channels)
+	std := make([]float32, channels)
+	for c := range mean {
+		mean[c] = perChannel(opts.Mean, c, 0)
+		std[c] = perChannel(opts.Std, c, 1)
+	}
+	pixels := width * height
+	px := make([]uint8, channels)
+	for n, pic := range pics {
+		for p := 0; p < pixels; p++ {
+			r, g, b := pic.pix[p*3], pic.pix[p*3+1], pic.pix[p*3+2]
+			switch {
+			case opts.Grayscale:
+				px[0] = uint8((299*uint32(r) + 587*uint32(g) + 114*uint32(b) + 500) / 1000)
+			case opts.BGR:
+				px[0], px[1], px[2] = b, g, r
+			default:
+				px[0], px[1], px[2] = r, g, b
+			}
+			for c, v := range px {
+				o := (n*pixels+p)*channels + c
+				if opts.Layout == NCHW {
+					o = (n*channels+c)*pixels + p
+				}
+				if floatsOut != nil {
+					floatsOut[o] = (float32(v)*scale - mean[c]) / std[c]
+				} else {
+					bytesOut[o] = v
+				}
+			}
+		}
+	}
+	return nt, nil
+}
+
+// Decode decodes a jpeg, png or gif image and converts it into a tensor
+// with a batch dimension of 1.
+func Decode(data []byte, opts *Options) (*graphpipe.NativeTensor, error) {
+	return DecodeAll([][]byte{data}, opts)
+}
+
+// DecodeAll decodes jpeg, png or gif images and converts them into a single
+// batch tensor. Images with more than opts.MaxPixels pixels are rejected
+// before they are decoded.
+func DecodeAll(data [][]byte, opts *Options) (*graphpipe.NativeTensor, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	imgs := make([]image.Image, len(data))
+	for i, d := range data {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(d))
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode image %d: %v", i, err)
+		}
+		if int64(cfg.Width)*int64(cfg.Height) > opts.maxPixels() {
+			return nil, fmt.Errorf("Image %d is %dx%d, which is more than %d pixels", i, cfg.Width, cfg.Height, opts.maxPixels())
+		}
+		img, _, err := image.Decode(bytes.NewReader(d))
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode image %d: %v", i, err)
+		}
+		imgs[i] = img
+	}
+	return Images(imgs, opts)
+}
+
+// Applier wraps apply so that string inputs holding encoded images are
+// decoded into image tensors before apply sees them. inputs maps the names
+// of those inputs to the options for converting them. Each string in the
+// input is one image of the batch. Inputs that are not strings, for
+// clients that send pixels themselves, are passed through unchanged.
+func Applier(inputs map[string]*Options, apply graphpipe.Applier) graphpipe.Applier {
+	return func(requestContext *graphpipe.RequestContext, config string, in map[string]*graphpipe.NativeTensor, outputNames []string) ([]*graphpipe.NativeTensor, error) {
+		converted := make(map[string]*graphpipe.NativeTensor, len(in))
+		for name, nt := range in {
+			opts, ok := inputs[name]
+			if !ok || nt.Type != graphpipefb.TypeString {
+				converted[name] = nt
+				continue
+			}
+			data := make([][]byte, len(nt.StringVals))
+			for i, s := range nt.StringVals {
+				data[i] = []byte(s)
+			}
+			t, err := DecodeAll(data, opts)
+			if err != nil {
+				return nil, fmt.Errorf("Input '%s': %v", name, err)
+			}
+			converted[name] = t
+		}
+		return apply(requestContext, config, converted, outputNames)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package preprocess
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+
+	graphpipe "github.com/oracle/graphpipe-go"
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// testImage is 4x2 with a red left half and a blue right half.
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			if x < 2 {
+				img.Set(x, y, color.RGBA{200, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 100, 255})
+			}
+		}
+	}
+	return img
+}
+
+func encode(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageNHWC(t *testing.T) {
+	nt, err := Image(testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nt.Type != graphpipefb.TypeUint8 || !reflect.DeepEqual(nt.Shape, []int64{1, 2, 4, 3}) {
+		t.Fatalf("Unexpected tensor %d %v", nt.Type, nt.Shape)
+	}
+	vals, _ := nt.Uint8s()
+	if !reflect.DeepEqual(vals[:3], []uint8{200, 0, 0}) || !reflect.DeepEqual(vals[9:12], []uint8{0, 0, 100}) {
+		t.Fatalf("Unexpected pixels %v", vals)
+	}
+}
+
+func TestImageNCHWNormalized(t *testing.T) {
+	opts := &Options{
+		Layout: NCHW,
+		Type:   graphpipefb.TypeFloat32,
+		BGR:    true,
+		Scale:  0.5,
+		Mean:   []float32{10, 0, 20},
+		Std:    []float32{2},
+	}
+	nt, err := Image(testImage(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nt.Shape, []int64{1, 3, 2, 4}) {
+		t.Fatalf("Unexpected shape %v", nt.Shape)
+	}
+	vals, _ := nt.Float32s()
+	// the first plane is blue: (0*0.5-10)/2 on the left, (100*0.5-10)/2 on the right
+	if !reflect.DeepEqual(vals[:4], []float32{-5, -5, 20, 20}) {
+		t.Fatalf("Unexpected blue plane %v", vals[:8])
+	}
+	// the last plane is red: (200*0.5-20)/2 and (0-20)/2
+	if !reflect.DeepEqual(vals[16:20], []float32{40, 40, -10, -10}) {
+		t.Fatalf("Unexpected red plane %v", vals[16:24])
+	}
+}
+
+func TestResizeModes(t *testing.T) {
+	img := testImage()
+	nt, err := Image(img, &Options{Width: 2, Height: 2, Resize: ResizeCrop, Interpolation: Nearest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, _ := nt.Uint8s()
+	// the crop keeps the middle, so a red column then a blue column
+	expected := []uint8{200, 0, 0, 0, 0, 100, 200, 0, 0, 0, 0, 100}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("Crop: expected %v, got %v", expected, vals)
+	}
+
+	nt, err = Image(img, &Options{Width: 4, Height: 4, Resize: ResizePad, Grayscale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, _ = nt.Uint8s()
+	if !reflect.DeepEqual(nt.Shape, []int64{1, 4, 4, 1}) {
+		t.Fatalf("Unexpected shape %v", nt.Shape)
+	}
+	// a black border above and below the image
+	expected = []uint8{0, 0, 0, 0, 60, 60, 11, 11, 60, 60, 11, 11, 0, 0, 0, 0}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("Pad: expected %v, got %v", expected, vals)
+	}
+
+	nt, err = Image(img, &Options{Width: 8, Height: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, _ = nt.Uint8s()
+	// bilinear stretch blends across the edge between the halves
+	if vals[0] != 200 || vals[3*3] != 150 || vals[4*3+2] != 75 || vals[7*3+2] != 100 {
+		t.Errorf("Stretch: unexpected pixels %v", vals[:24])
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	small := image.NewGray(image.Rect(0, 0, 2, 2))
+	data := [][]byte{encode(t, testImage()), encode(t, small)}
+	if _, err := DecodeAll(data, nil); err == nil {
+		t.Errorf("Expected error batching images of different sizes")
+	}
+	nt, err := DecodeAll(data, &Options{Width: 3, Height: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nt.Shape, []int64{2, 3, 3, 3}) {
+		t.Errorf("Unexpected shape %v", nt.Shape)
+	}
+	if _, err := Decode([]byte("not an image"), nil); err == nil {
+		t.Errorf("Expected error decoding garbage")
+	}
+	for _, bad := range []*Options{
+		{Width: 3},
+		{Mean: []float32{1}},
+		{Type: graphpipefb.TypeFloat32, Std: []float32{0}},
+		{Type: graphpipefb.TypeFloat32, Mean: []float32{1, 2}},
+		{Type: graphpipefb.TypeInt32},
+	} {
+		if _, err := DecodeAll(data, bad); err == nil {
+			t.Errorf("Expected error for options %+v", bad)
+		}
+	}
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	// rewrite the size in the header of a tiny png to 50000x50000
+	data := encode(t, testImage())
+	binary.BigEndian.PutUint32(data[16:], 50000)
+	binary.BigEndian.PutUint32(data[20:], 50000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	_, err := Decode(data, nil)
+	if err == nil || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("Expected the image to be too large, got %v", err)
+	}
+
+	if _, err := Decode(encode(t, testImage()), &Options{MaxPixels: 7}); err == nil {
+		t.Errorf("Expected an 8 pixel image to be too large")
+	}
+	if _, err := Decode(encode(t, testImage()), &Options{MaxPixels: 8}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplier(t *testing.T) {
+	var seen map[string]*graphpipe.NativeTensor
+	apply := func(_ *graphpipe.RequestContext, _ string, in map[string]*graphpipe.NativeTensor, _ []string) ([]*graphpipe.NativeTensor, error) {
+		seen = in
+		return nil, nil
+	}
+	wrapped := Applier(map[string]*Options{"image": {Width: 2, Height: 2}}, apply)
+
+	images := &graphpipe.NativeTensor{}
+	if err := images.InitWithStringVals([]string{string(encode(t, testImage()))}, []int64{1}); err != nil {
+		t.Fatal(err)
+	}
+	other := &graphpipe.NativeTensor{}
+	if err := other.InitSimple([]float32{1}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := wrapped(nil, "", map[string]*graphpipe.NativeTensor{"image": images, "other": other}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen["image"].Shape, []int64{1, 2, 2, 3}) || seen["other"] != other {
+		t.Errorf("Unexpected inputs %v", seen)
+	}
+
+	images.StringVals[0] = "garbage"
+	if _, err := wrapped(nil, "", map[string]*graphpipe.NativeTensor{"image": images}, nil); err == nil {
+		t.Errorf("Expected error for undecodable image")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package preprocess
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// rgb is an image as 8 bit rgb pixels, row by row.
+type rgb struct {
+	w, h int
+	pix  []uint8
+}
+
+// toRGB copies the pixels of img. Alpha is dropped, so transparent areas
+// come out as their premultiplied color, which is usually black.
+func toRGB(img image.Image) *rgb {
+	b := img.Bounds()
+	out := &rgb{w: b.Dx(), h: b.Dy(), pix: make([]uint8, b.Dx()*b.Dy()*3)}
+	i := 0
+	switch src := img.(type) {
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x := 0; x < out.w; x++ {
+				copy(out.pix[i:i+3], row[x*4:x*4+3])
+				i += 3
+			}
+		}
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):]
+			for x := 0; x < out.w; x++ {
+				out.pix[i], out.pix[i+1], out.pix[i+2] = row[x], row[x], row[x]
+				i += 3
+			}
+		}
+	case *image.YCbCr:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				yi, ci := src.YOffset(x, y), src.COffset(x, y)
+				out.pix[i], out.pix[i+1], out.pix[i+2] = color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				i += 3
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				out.pix[i], out.pix[i+1], out.pix[i+2] = uint8(r>>8), uint8(g>>8), uint8(bl>>8)
+				i += 3
+			}
+		}
+	}
+	return out
+}
+
+// rect is an area of an image in floating point pixel coordinates.
+type rect struct {
+	x, y, w, h float64
+}
+
+// placement works out which part of a w by h source image is drawn to which
+// part of a width by height destination for the resize mode.
+func placement(mode ResizeMode, w, h, width, height int) (src, dst rect) {
+	src = rect{0, 0, float64(w), float64(h)}
+	dst = rect{0, 0, float64(width), float64(height)}
+	sx := float64(width) / float64(w)
+	sy := float64(height) / float64(h)
+	switch mode {
+	case ResizeCrop:
+		// cover the destination, cutting the overflow from both sides
+		scale := math.Max(sx, sy)
+		src.w = float64(width) / scale
+		src.h = float64(height) / scale
+		src.x = (float64(w) - src.w) / 2
+		src.y = (float64(h) - src.h) / 2
+	case ResizePad:
+		// fit inside the destination, leaving a border on two sides
+		scale := math.Min(sx, sy)
+		dst.w = math.Round(float64(w) * scale)
+		dst.h = math.Round(float64(h) * scale)
+		dst.x = math.Floor((float64(width) - dst.w) / 2)
+		dst.y = math.Floor((float64(height) - dst.h) / 2)
+	}
+	return src, dst
+}
+
+// resize scales img to width by height. Pixels outside the image, which
+// only happen with ResizePad, are black.
+func resize(img *rgb, width, height int, mode ResizeMode, interp Interpolation) *rgb {
+	if mode == ResizeNone || (img.w == width && img.h == height) {
+		return img
+	}
+	out := &rgb{w: width, h: height, pix: make([]uint8, width*height*3)}
+	src, dst := placement(mode, img.w, img.h, width, height)
+	xs := src.w / dst.w
+	ys := src.h / dst.h
+	for y := 0; y < height; y++ {
+		if float64(y) < dst.y || float64(y) >= dst.y+dst.h {
+			continue
+		}
+		fy := src.y + (float64(y)-dst.y+0.5)*ys - 0.5
+		for x := 0; x < width; x++ {
+			if float64(x) < dst.x || float64(x) >= dst.x+dst.w {
+				continue
+			}
+			fx := src.x + (float64(x)-dst.x+0.5)*xs - 0.5
+			o := (y*width + x) * 3
+			if interp == Nearest {
+				s := (clamp(int(math.Round(fy)), img.h)*img.w + clamp(int(math.Round(fx)), img.w)) * 3
+				copy(out.pix[o:o+3], img.pix[s:s+3])
+				continue
+			}
+			bilinear(img, fx, fy, out.pix[o:o+3])
+		}
+	}
+	return out
+}
+
+// bilinear blends the four source pixels around fx, fy into out.
+func bilinear(img *rgb, fx, fy float64, out []uint8) {
+	fx = math.Max(0, math.Min(fx, float64(img.w-1)))
+	fy = math.Max(0, math.Min(fy, float64(img.h-1)))
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := clamp(x0+1, img.w), clamp(y0+1, img.h)
+	tx, ty := fx-float64(x0), fy-float64(y0)
+	p00 := (y0*img.w + x0) * 3
+	p01 := (y0*img.w + x1) * 3
+	p10 := (y1*img.w + x0) * 3
+	p11 := (y1*img.w + x1) * 3
+	for c := 0; c < 3; c++ {
+		top := float64(img.pix[p00+c])*(1-tx) + float64(img.pix[p01+c])*tx
+		bottom := float64(img.pix[p10+c])*(1-tx) + float64(img.pix[p11+c])*tx
+		out[c] = uint8(math.Round(top*(1-ty) + bottom*ty))
+	}
+}
+
+func clamp(v, n int) int {
+	if v < 0 {
+		return 0
+	}
+	if v >= n {
+		return n - 1
+	}
+	return v
+}
@@ -70,84 +70,128 @@ func MultiRemote(client *http.Client, uri string, config string, ins []interface
 // for requests that need optimal performance and do not need to
 // be converted into native go types.
 func MultiRemoteRaw(client *http.Client, uri string, config string, inputs []*NativeTensor, inputNames, outputNames []string) ([]*NativeTensor, error) {
-	b := fb.NewBuilder(1024)
-
-	inStrs := make([]fb.UOffsetT, len(inputNames))
-	outStrs := make([]fb.UOffsetT, len(outputNames))
+	outputs, _, err := multiRemoteRaw(client, uri, config, inputs, inputNames, outputNames)
+	return outputs, err
+}
 
-	for i := range inStrs {
-		inStrs[i] = b.CreateString(inputNames[i])
+// MultiRemoteMap is like MultiRemote, but it returns the outputs keyed by
+// name. If outputNames is empty, the names of the server default outputs
+// are resolved from the response or, for older servers, the metadata.
+func MultiRemoteMap(client *http.Client, uri string, config string, ins []interface{}, inputNames, outputNames []string) (map[string]interface{}, error) {
+	inputs := make([]*NativeTensor, len(ins))
+	for i := range ins {
+		nt := &NativeTensor{}
+		if err := nt.InitSimple(ins[i]); err != nil {
+			logrus.Errorf("Failed to convert input %d: %v", i, err)
+			return nil, err
+		}
+		inputs[i] = nt
 	}
 
-	for i := range outStrs {
-		outStrs[i] = b.CreateString(outputNames[i])
+	outputs, err := MultiRemoteRawMap(client, uri, config, inputs, inputNames, outputNames)
+	if err != nil {
+		return nil, err
 	}
-
-	graphpipefb.InferRequestStartInputNamesVector(b, len(inStrs))
-	for i := len(inStrs) - 1; i >= 0; i-- {
-		offset := inStrs[i]
-		b.PrependUOffsetT(offset)
+	natives := make(map[string]interface{}, len(outputs))
+	for name, output := range outputs {
+		natives[name], err = NativeTensorToNative(output)
+		if err != nil {
+			logrus.Errorf("Failed to convert output '%s': %v", name, err)
+			return nil, err
+		}
 	}
+	return natives, nil
+}
 
-	inputNamesOffset := b.EndVector(len(inStrs))
-
-	graphpipefb.InferRequestStartOutputNamesVector(b, len(outStrs))
-	for i := len(outStrs) - 1; i >= 0; i-- {
-		offset := outStrs[i]
-		b.PrependUOffsetT(offset)
+// MultiRemoteRawMap is like MultiRemoteRaw, but it returns the outputs
+// keyed by name. If outputNames is empty, the names of the server default
+// outputs are resolved from the response or, for older servers, the
+// metadata.
+func MultiRemoteRawMap(client *http.Client, uri string, config string, inputs []*NativeTensor, inputNames, outputNames []string) (map[string]*NativeTensor, error) {
+	outputs, names, err := multiRemoteRaw(client, uri, config, inputs, inputNames, outputNames)
+	if err != nil {
+		logrus.Errorf("Failed to MultiRemoteRaw: %v", err)
+		return nil, err
 	}
-	outputNamesOffset := b.EndVector(len(outStrs))
+	return nameOutputs(client, uri, outputs, names, outputNames)
+}
 
-	inputOffsets := make([]fb.UOffsetT, len(inputs))
-	for i := 0; i < len(inputs); i++ {
-		inputOffsets[i] = inputs[i].Build(b)
+// nameOutputs keys outputs by the names from the response, falling back to
+// the requested names and then the metadata.
+func nameOutputs(client *http.Client, uri string, outputs []*NativeTensor, names, outputNames []string) (map[string]*NativeTensor, error) {
+	var err error
+	if len(names) != len(outputs) {
+		names = outputNames
 	}
-
-	graphpipefb.InferRequestStartInputTensorsVector(b, len(inputs))
-	for i := len(inputOffsets) - 1; i >= 0; i-- {
-		offset := inputOffsets[i]
-		b.PrependUOffsetT(offset)
+	if len(names) != len(outputs) {
+		names, err = defaultOutputNames(client, uri, len(outputs))
+		if err != nil {
+			return nil, err
+		}
 	}
-	inputTensors := b.EndVector(len(inputs))
+	rval := make(map[string]*NativeTensor, len(outputs))
+	for i := range outputs {
+		rval[names[i]] = outputs[i]
+	}
+	return rval, nil
+}
 
-	configString := b.CreateString(config)
+// defaultOutputNames uses the metadata to name the outputs of servers that
+// do not name them in the response. This only works if the server returns
+// every output in the metadata by default.
+func defaultOutputNames(client *http.Client, uri string, num int) ([]string, error) {
+	meta, err := Metadata(client, uri)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get metadata to name outputs: %v", err)
+	}
+	if len(meta.Outputs) != num {
+		return nil, fmt.Errorf("Could not name %d outputs from metadata with %d outputs - please specify output names", num, len(meta.Outputs))
+	}
+	names := make([]string, num)
+	for i := range meta.Outputs {
+		names[i] = meta.Outputs[i].Name
+	}
+	return names, nil
+}
 
-	graphpipefb.InferRequestStart(b)
-	graphpipefb.InferRequestAddInputNames(b, inputNamesOffset)
-	graphpipefb.InferRequestAddOutputNames(b, outputNamesOffset)
-	graphpipefb.InferRequestAddInputTensors(b, inputTensors)
-	graphpipefb.InferRequestAddConfig(b, configString)
-	inferRequestOffset := graphpipefb.InferRequestEnd(b)
+func multiRemoteRaw(client *http.Client, uri string, config string, inputs []*NativeTensor, inputNames, outputNames []string) ([]*NativeTensor, []string, error) {
+	b := fb.NewBuilder(1024)
+	inferRequestOffset := buildInferRequest(b, config, inputs, inputNames, outputNames)
 	graphpipefb.RequestStart(b)
 	graphpipefb.RequestAddReqType(b, graphpipefb.ReqInferRequest)
 	graphpipefb.RequestAddReq(b, inferRequestOffset)
 	requestOffset := graphpipefb.RequestEnd(b)
 
-	buf := Serialize(b, requestOffset)
+	return sendInferRequest(client, uri, Serialize(b, requestOffset))
+}
 
+// sendInferRequest posts a serialized infer request and returns the output
+// tensors along with any output names in the response.
+func sendInferRequest(client *http.Client, uri string, buf []byte) (_ []*NativeTensor, _ []string, err error) {
 	rq, err := http.NewRequest("POST", uri, bytes.NewReader(buf))
 	if err != nil {
 		logrus.Errorf("Failed to create request: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// send the request
 	rs, err := client.Do(rq)
 	if err != nil {
 		logrus.Errorf("Failed to send request: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 	defer rs.Body.Close()
 
 	body, err := ioutil.ReadAll(rs.Body)
 	if err != nil {
 		logrus.Errorf("Failed to read body: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 	if rs.StatusCode != 200 {
-		return nil, fmt.Errorf("Remote failed with %d: %s", rs.StatusCode, string(body))
+		return nil, nil, fmt.Errorf("Remote failed with %d: %s", rs.StatusCode, string(body))
 	}
 
+	defer recoverMalformed(&err)
 	res := graphpipefb.GetRootAsInferResponse(body, 0)
 
 	rval := make([]*NativeTensor, res.OutputTensorsLength())
@@ -156,11 +200,58 @@ func MultiRemoteRaw(client *http.Client, uri string, config string, inputs []*Na
 		tensor := &graphpipefb.Tensor{}
 		if !res.OutputTensors(tensor, i) {
 			err := fmt.Errorf("Bad input tensor")
-			return nil, err
+			return nil, nil, err
+		}
+		nt, err := TensorToNativeTensor(tensor)
+		if err != nil {
+			return nil, nil, err
 		}
-		nt := TensorToNativeTensor(tensor)
 		rval[i] = nt
 	}
 
-	return rval, nil
+	names := make([]string, res.OutputNamesLength())
+	for i := range names {
+		names[i] = string(res.OutputNames(i))
+	}
+
+	return rval, names, nil
+}
+
+// Metadata requests the metadata from a remote model server and converts
+// it into a NativeMetadataResponse.
+func Metadata(client *http.Client, uri string) (*NativeMetadataResponse, error) {
+	b := fb.NewBuilder(1024)
+	graphpipefb.MetadataRequestStart(b)
+	metadataRequestOffset := graphpipefb.MetadataRequestEnd(b)
+	graphpipefb.RequestStart(b)
+	graphpipefb.RequestAddReqType(b, graphpipefb.ReqMetadataRequest)
+	graphpipefb.RequestAddReq(b, metadataRequestOffset)
+	requestOffset := graphpipefb.RequestEnd(b)
+
+	buf := Serialize(b, requestOffset)
+
+	rq, err := http.NewRequest("POST", uri, bytes.NewReader(buf))
+	if err != nil {
+		logrus.Errorf("Failed to create request: %v", err)
+		return nil, err
+	}
+
+	rs, err := client.Do(rq)
+	if err != nil {
+		logrus.Errorf("Failed to send request: %v", err)
+		return nil, err
+	}
+	defer rs.Body.Close()
+
+	body, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		logrus.Errorf("Failed to read body: %v", err)
+		return nil, err
+	}
+	if rs.StatusCode != 200 {
+		return nil, fmt.Errorf("Remote failed with %d: %s", rs.StatusCode, string(body))
+	}
+
+	res := graphpipefb.GetRootAsMetadataResponse(body, 0)
+	return MetadataResponseToNative(res), nil
 }
@@ -0,0 +1,118 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// namedApply returns each requested output as the input scaled by its
+// position in the default outputs.
+func namedApply(_ *RequestContext, config string, inputs map[string]*NativeTensor, outputNames []string) ([]*NativeTensor, error) {
+	in, err := NativeTensorToNative(inputs["x"])
+	if err != nil {
+		return nil, err
+	}
+	scale := map[string]float32{"a": 1, "b": 2}
+	outputs := make([]*NativeTensor, len(outputNames))
+	for i, name := range outputNames {
+		vals := in.([]float32)
+		out := make([]float32, len(vals))
+		for j := range vals {
+			out[j] = vals[j] * scale[name]
+		}
+		outputs[i] = &NativeTensor{}
+		if err := outputs[i].InitSimple(out); err != nil {
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+func newNamedServer() *httptest.Server {
+	c := &appContext{
+		meta: &NativeMetadataResponse{
+			Inputs:  []NativeIOMetadata{{Name: "x"}},
+			Outputs: []NativeIOMetadata{{Name: "a"}, {Name: "b"}},
+		},
+		apply:          namedApply,
+		defaultInputs:  []string{"x"},
+		defaultOutputs: []string{"a", "b"},
+		isReady:        1,
+		isAlive:        1,
+	}
+	return httptest.NewServer(appHandler{c, Handler})
+}
+
+func TestMultiRemoteMap(t *testing.T) {
+	ts := newNamedServer()
+	defer ts.Close()
+
+	in := []interface{}{[]float32{1, 2, 3}}
+	res, err := MultiRemoteMap(http.DefaultClient, ts.URL, "", in, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a": []float32{1, 2, 3},
+		"b": []float32{2, 4, 6},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected %v, got %v", expected, res)
+	}
+
+	res, err = MultiRemoteMap(http.DefaultClient, ts.URL, "", in, nil, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"b": []float32{2, 4, 6}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected %v, got %v", expected, res)
+	}
+}
+
+func TestInferRequestSend(t *testing.T) {
+	ts := newNamedServer()
+	defer ts.Close()
+
+	x := &NativeTensor{}
+	x.InitSimple([]float32{1, 2, 3})
+	res, err := NewInferRequest().Input("x", x).Output("b").Send(http.DefaultClient, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NativeTensorToNative(res["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, []float32{2, 4, 6}) {
+		t.Errorf("Expected [2 4 6], got %v", out)
+	}
+}
+
+func TestHandlerRejectsInvalidTensors(t *testing.T) {
+	ts := newNamedServer()
+	defer ts.Close()
+
+	bad := &NativeTensor{Type: graphpipefb.TypeFloat32, Shape: []int64{3}, Data: make([]byte, 5)}
+	_, _, err := multiRemoteRaw(http.DefaultClient, ts.URL, "", []*NativeTensor{bad}, []string{"x"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected 400 for invalid tensor, got %v", err)
+	}
+
+	for _, body := range [][]byte{{}, {1, 2}, {0xff, 0xff, 0xff, 0x7f}} {
+		_, _, err := sendInferRequest(http.DefaultClient, ts.URL, body)
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("Expected 400 for malformed request, got %v", err)
+		}
+	}
+}
@@ -11,7 +11,8 @@ import (
 	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
 )
 
-func getOutputNames(c *appContext, req *graphpipefb.InferRequest) ([]string, error) {
+func getOutputNames(c *appContext, req *graphpipefb.InferRequest) (_ []string, err error) {
+	defer recoverMalformed(&err)
 	if req.OutputNamesLength() == 0 {
 		if len(c.defaultOutputs) == 0 {
 			return nil, fmt.Errorf("no default outputs available -  please specify one or more outputs")
@@ -29,7 +30,8 @@ func getOutputNames(c *appContext, req *graphpipefb.InferRequest) ([]string, err
 	return outputNames, nil
 }
 
-func getInputMap(c *appContext, req *graphpipefb.InferRequest) (map[string]*NativeTensor, error) {
+func getInputMap(c *appContext, req *graphpipefb.InferRequest) (_ map[string]*NativeTensor, err error) {
+	defer recoverMalformed(&err)
 	inputMap := map[string]*NativeTensor{}
 	for i := 0; i < req.InputTensorsLength(); i++ {
 		name := ""
@@ -37,13 +39,20 @@ func getInputMap(c *appContext, req *graphpipefb.InferRequest) (map[string]*Nati
 			name = string(req.InputNames(i))
 		}
 		if name == "" {
+			if i >= len(c.defaultInputs) {
+				return nil, fmt.Errorf("No name for input %d", i)
+			}
 			name = c.defaultInputs[i]
 		}
 		tensor := &graphpipefb.Tensor{}
 		if !req.InputTensors(tensor, i) {
 			return nil, fmt.Errorf("Could not init tensor")
 		}
-		inputMap[name] = TensorToNativeTensor(tensor)
+		nt, err := TensorToNativeTensor(tensor)
+		if err != nil {
+			return nil, withTensorName(err, name)
+		}
+		inputMap[name] = nt
 	}
 	return inputMap, nil
 }
@@ -57,5 +66,5 @@ func getResults(c *appContext, requestContext *RequestContext, req *graphpipefb.
 	if err != nil {
 		return nil, err
 	}
-	return c.apply(requestContext, string(req.Config()), inputMap, outputNames)
+	return applyCoalesced(c, requestContext, string(req.Config()), inputMap, outputNames)
 }
@@ -12,11 +12,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
-	bolt "github.com/coreos/bbolt"
-
 	fb "github.com/google/flatbuffers/go"
 	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
 )
@@ -71,45 +70,18 @@ func makeTensor(numRows int, dataLen int, dt uint8) *NativeTensor {
 }
 
 func makeRequestRaw(tp *NativeTensor) *graphpipefb.InferRequest {
-	builder := fb.NewBuilder(1024)
-	inStrs := make([]fb.UOffsetT, 2)
-	outStrs := make([]fb.UOffsetT, 2)
-	for i := 0; i < 2; i++ {
-		inStr := builder.CreateString(fmt.Sprintf("some/input/name:%d", i))
-		outStr := builder.CreateString(fmt.Sprintf("some/output/name:%d", i))
-		inStrs[i] = inStr
-		outStrs[i] = outStr
-	}
-	graphpipefb.InferRequestStartInputNamesVector(builder, 2)
-	for _, offset := range inStrs {
-		builder.PrependUOffsetT(offset)
-	}
-	inputNames := builder.EndVector(2)
-	graphpipefb.InferRequestStartOutputNamesVector(builder, 2)
-	for _, offset := range outStrs {
-		builder.PrependUOffsetT(offset)
-	}
-	outputNames := builder.EndVector(2)
-
-	inputOffsets := make([]fb.UOffsetT, 2)
+	req := NewInferRequest()
 	for i := 0; i < 2; i++ {
-		inputOffsets[i] = tp.Build(builder)
+		req.Input(fmt.Sprintf("some/input/name:%d", i), tp)
+		req.Output(fmt.Sprintf("some/output/name:%d", i))
 	}
-
-	graphpipefb.InferRequestStartInputTensorsVector(builder, 2)
-	for _, offset := range inputOffsets {
-		builder.PrependUOffsetT(offset)
+	builder := fb.NewBuilder(1024)
+	inferRequestOffset, err := req.Build(builder)
+	if err != nil {
+		panic(err)
 	}
-	inputTensors := builder.EndVector(2)
-
-	graphpipefb.InferRequestStart(builder)
-	graphpipefb.InferRequestAddInputNames(builder, inputNames)
-	graphpipefb.InferRequestAddOutputNames(builder, outputNames)
-	graphpipefb.InferRequestAddInputTensors(builder, inputTensors)
-	inferRequestOffset := graphpipefb.InferRequestEnd(builder)
 	buf := Serialize(builder, inferRequestOffset)
-	req := graphpipefb.GetRootAsInferRequest(buf, 0)
-	return req
+	return graphpipefb.GetRootAsInferRequest(buf, 0)
 }
 
 func makeRequest(numRows int, dataLen int, dt uint8) *graphpipefb.InferRequest {
@@ -125,11 +97,11 @@ func benchGetResults(b *testing.B, numRows int, dataLen int, dt uint8, cache boo
 		defer os.RemoveAll(dir)
 		dbPath := filepath.Join(dir, "test.db")
 		var err error
-		c.db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		c.cache, err = NewBoltCache(dbPath, nil)
 		if err != nil {
 			b.Fatal(err)
 		}
-		defer c.db.Close()
+		defer c.cache.Close()
 	}
 
 	c.apply = func(*RequestContext, string, map[string]*NativeTensor, []string) ([]*NativeTensor, error) {
@@ -154,11 +126,11 @@ func testGetResults(t *testing.T, numRows int, dataLen int, dt uint8, cache bool
 		defer os.RemoveAll(dir)
 		dbPath := filepath.Join(dir, "test.db")
 		var err error
-		c.db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		c.cache, err = NewBoltCache(dbPath, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer c.db.Close()
+		defer c.cache.Close()
 	}
 
 	c.apply = func(*RequestContext, string, map[string]*NativeTensor, []string) ([]*NativeTensor, error) {
@@ -187,11 +159,11 @@ func TestCachedGetResultsInterleavedFloat32(t *testing.T) {
 		defer os.RemoveAll(dir)
 		dbPath := filepath.Join(dir, "test.db")
 		var err error
-		c.db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		c.cache, err = NewBoltCache(dbPath, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer c.db.Close()
+		defer c.cache.Close()
 	}
 
 	c.apply = func(b *RequestContext, c string, inputs map[string]*NativeTensor, d []string) ([]*NativeTensor, error) {
@@ -230,3 +202,79 @@ func TestCachedGetResultsInterleavedFloat32(t *testing.T) {
 		t.Fatalf("Results are not the same as input \na: %v\nb: %v", results[0].Shape, tp2.Shape)
 	}
 }
+
+func TestCachedGetResultsInterleavedString(t *testing.T) {
+	dt := uint8(graphpipefb.TypeString)
+	c := &appContext{cache: NewMemoryCache(1 << 20)}
+	numRows := 10
+	dataLen := 1024
+
+	tp1 := makeTensor(numRows, dataLen, dt)
+	tp2 := makeTensor(numRows, dataLen, dt)
+	tp3 := makeTensor(numRows, dataLen, dt)
+
+	applied := [][]string{}
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		in := inputs["some/input/name:0"]
+		applied = append(applied, in.StringVals)
+		return []*NativeTensor{in, in}, nil
+	}
+
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	results, err := getResultsCached(c, rc, makeRequestRaw(tp2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results[0].StringVals, tp2.StringVals) {
+		t.Fatalf("Results are not the same as input")
+	}
+	waitForDups(t, &c.flights, 0)
+
+	// Create a new tensor that includes cached rows in the middle
+	all, err := Concat([]*NativeTensor{tp1, tp2, tp3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = getResultsCached(c, rc, makeRequestRaw(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results[1].StringVals, all.StringVals) || results[1].Shape[0] != 30 {
+		t.Fatalf("Results are not the same as input")
+	}
+	uncached := append(append([]string{}, tp1.StringVals...), tp3.StringVals...)
+	if len(applied) != 2 || !reflect.DeepEqual(applied[1], uncached) {
+		t.Errorf("Expected only the uncached rows to be applied, got %d applies", len(applied))
+	}
+}
+
+func TestCachedGetResultsStringRank2(t *testing.T) {
+	c := &appContext{cache: NewMemoryCache(1 << 20)}
+	applied := []int64{}
+	c.apply = func(_ *RequestContext, _ string, inputs map[string]*NativeTensor, _ []string) ([]*NativeTensor, error) {
+		in := inputs["some/input/name:0"]
+		applied = append(applied, in.Shape[0])
+		return []*NativeTensor{in, in}, nil
+	}
+	tp := &NativeTensor{}
+	tp.InitWithStringVals([]string{"a", "b", "c", "d", "e", "f"}, []int64{3, 2})
+	rc := &RequestContext{builder: fb.NewBuilder(1024)}
+	if _, err := getResultsCached(c, rc, makeRequestRaw(tp)); err != nil {
+		t.Fatal(err)
+	}
+	waitForDups(t, &c.flights, 0)
+
+	// the middle row is new
+	tp2 := &NativeTensor{}
+	tp2.InitWithStringVals([]string{"a", "b", "x", "y", "e", "f"}, []int64{3, 2})
+	results, err := getResultsCached(c, rc, makeRequestRaw(tp2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results[0].StringVals, tp2.StringVals) || !reflect.DeepEqual(results[0].Shape, tp2.Shape) {
+		t.Errorf("Expected %v %v, got %v %v", tp2.StringVals, tp2.Shape, results[0].StringVals, results[0].Shape)
+	}
+	if !reflect.DeepEqual(applied, []int64{3, 1}) {
+		t.Errorf("Expected apply on [3 1] rows, got %v", applied)
+	}
+}
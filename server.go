@@ -7,17 +7,20 @@ package graphpipe
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"reflect"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	bolt "github.com/coreos/bbolt"
 	fb "github.com/google/flatbuffers/go"
 	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
 )
@@ -51,6 +54,7 @@ func setupLifecycleRoutes(c *appContext) {
 	http.Handle("/control/is_alive", appHandler{c, isAliveHandler})
 	http.Handle("/control/shutdown", appHandler{c, shutdownHandler})
 	http.Handle("/control/client_count", appHandler{c, clientCountHandler})
+	setupCacheRoutes(c)
 }
 
 // ListenAndServe is like robocop but for servers (listens on a
@@ -98,16 +102,36 @@ func (l *counterListenerConn) Close() error {
 // Serve offers multiple inputs and outputs and converts tensors
 // into native datatypes based on the shapes passed in to this function
 // plus any additional shapes implied by your apply function.
-// If cache is true, will attempt to cache using cache.db as cacheFile
+// If cache is true, will attempt to cache using cache.db as cacheFile. The
+// cache is cleared when the apply function or the shapes change. Use
+// ServeVersion to also clear it when the model behind apply changes.
 func Serve(listen string, cache bool, apply interface{}, inShapes, outShapes [][]int64) error {
+	return ServeVersion(listen, cache, "", apply, inShapes, outShapes)
+}
+
+// ServeVersion is like Serve, but cached results are also tied to version,
+// so changing it clears the cache.
+func ServeVersion(listen string, cache bool, version string, apply interface{}, inShapes, outShapes [][]int64) error {
 	opts := BuildSimpleApply(apply, inShapes, outShapes)
 	opts.Listen = listen
 	if cache {
 		opts.CacheFile = "cache.db"
+		opts.ModelID = serveModelID(apply, version, inShapes, outShapes)
 	}
 	return ServeRaw(opts)
 }
 
+// serveModelID identifies what Serve is serving by the name of the apply
+// function, the version and the shapes.
+func serveModelID(apply interface{}, version string, inShapes, outShapes [][]int64) string {
+	h := sha256.New()
+	if fn := runtime.FuncForPC(reflect.ValueOf(apply).Pointer()); fn != nil {
+		h.Write([]byte(fn.Name()))
+	}
+	fmt.Fprintf(h, " %q %v %v", version, inShapes, outShapes)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 // GetHandlerFunc is an indirection to return the handler.
 type GetHandlerFunc func(http.ResponseWriter, *http.Request, []byte) error
 
@@ -115,6 +139,13 @@ type GetHandlerFunc func(http.ResponseWriter, *http.Request, []byte) error
 type ServeRawOptions struct {
 	Listen         string
 	CacheFile      string
+	CacheOptions   *BoltCacheOptions
+	Cache          Cache
+	CacheQueue     int
+	Peers          *PeerCacheOptions
+	FastCacheKeys  bool
+	ModelID        string
+	AdminToken     string
 	Meta           *NativeMetadataResponse
 	DefaultInputs  []string
 	DefaultOutputs []string
@@ -123,8 +154,17 @@ type ServeRawOptions struct {
 }
 
 // ServeRaw starts the model server. The listen address and port can be specified
-// with the listen parameter. If cacheFile is not "" then caches will be stored
-// using it. context will be passed back to the handler
+// with the listen parameter. If Cache is set, results are cached in it, and
+// otherwise if CacheFile is not "" then caches will be stored in a BoltCache
+// using it, bounded by CacheOptions. Cached results are keyed by ModelID as
+// well as the config and inputs, and a cache file written for another
+// ModelID is cleared. Results are written to the cache in the background,
+// and up to CacheQueue of them can wait before new ones are dropped. If
+// Peers is set the cache is shared with them in a PeerCache. Rows are keyed
+// with sha512, or with FastCacheKeys a faster non-cryptographic hash that
+// should only be used if inputs can not be crafted to collide. The cache can
+// be inspected and managed under /control/cache with AdminToken as a
+// bearer token. context will be passed back to the handler
 func ServeRaw(opts *ServeRawOptions) error {
 	var err error
 	c := &appContext{
@@ -133,16 +173,40 @@ func ServeRaw(opts *ServeRawOptions) error {
 		getHandler:     opts.GetHandler,
 		defaultInputs:  opts.DefaultInputs,
 		defaultOutputs: opts.DefaultOutputs,
+		cache:          opts.Cache,
+		modelID:        opts.ModelID,
+		fastCacheKeys:  opts.FastCacheKeys,
+		adminToken:     opts.AdminToken,
 		isReady:        1,
 		isAlive:        1,
 	}
-	if opts.CacheFile != "" {
-		c.db, err = bolt.Open(opts.CacheFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if c.cache == nil && opts.CacheFile != "" {
+		cacheOpts := BoltCacheOptions{}
+		if opts.CacheOptions != nil {
+			cacheOpts = *opts.CacheOptions
+		}
+		cacheOpts.ModelID = opts.ModelID
+		c.cache, err = NewBoltCache(opts.CacheFile, &cacheOpts)
 		if err != nil {
 			logrus.Errorf("Could not open db at '%s': %v", opts.CacheFile, err)
 			return err
 		}
-		defer c.db.Close()
+	}
+	if c.cache != nil && opts.Peers != nil {
+		peerOpts := *opts.Peers
+		if peerOpts.Token == "" {
+			peerOpts.Token = opts.AdminToken
+		}
+		c.cache, err = NewPeerCache(c.cache, &peerOpts)
+		if err != nil {
+			logrus.Errorf("Could not share the cache with peers: %v", err)
+			return err
+		}
+	}
+	if c.cache != nil {
+		defer c.cache.Close()
+		c.writer = newCacheWriter(c.cache, opts.CacheQueue)
+		defer c.writer.close()
 	}
 	setupLifecycleRoutes(c)
 	http.Handle("/", appHandler{c, Handler})
@@ -162,12 +226,30 @@ type appContext struct {
 	getHandler     GetHandlerFunc
 	defaultInputs  []string
 	defaultOutputs []string
-	cacheFile      string
-	db             *bolt.DB
+	cache          Cache
+	modelID        string
+	fastCacheKeys  bool
+	adminToken     string
+	cacheHits      int64
+	cacheMisses    int64
+	flights        flightGroup
+	writer         *cacheWriter
+	writerOnce     sync.Once
 	isReady        int64
 	isAlive        int64
 }
 
+// cacheWriter returns the writer for the cache, which is started on first
+// use if ServeRaw did not start it.
+func (c *appContext) cacheWriter() *cacheWriter {
+	c.writerOnce.Do(func() {
+		if c.writer == nil {
+			c.writer = newCacheWriter(c.cache, defaultCacheQueue)
+		}
+	})
+	return c.writer
+}
+
 type appHandler struct {
 	*appContext
 	H func(*appContext, http.ResponseWriter, *http.Request) error
@@ -182,7 +264,7 @@ type RequestContext struct {
 
 // IsAlive tells you if it isn't dead.
 func (ctx *RequestContext) IsAlive() bool {
-	return ctx.hasDied == 0
+	return atomic.LoadInt32(&ctx.hasDied) == 0
 }
 
 // SetDead makes sure it isn't alive.
@@ -232,12 +314,11 @@ func Handler(c *appContext, w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	request := graphpipefb.GetRootAsRequest(body, 0)
-	if request.ReqType() == graphpipefb.ReqInferRequest {
-		inferRequest := &graphpipefb.InferRequest{}
-		table := inferRequest.Table()
-		request.Req(&table)
-		inferRequest.Init(table.Bytes, table.Pos)
+	inferRequest, err := parseRequest(body)
+	if err != nil {
+		return StatusError{400, err}
+	}
+	if inferRequest != nil {
 
 		requestContext := &RequestContext{
 			builder: fb.NewBuilder(1024),
@@ -258,7 +339,7 @@ func Handler(c *appContext, w http.ResponseWriter, r *http.Request) error {
 		}()
 
 		var outputs []*NativeTensor
-		if c.db == nil {
+		if c.cache == nil {
 			outputs, err = getResults(c, requestContext, inferRequest)
 		} else {
 			outputs, err = getResultsCached(c, requestContext, inferRequest)
@@ -282,8 +363,27 @@ func Handler(c *appContext, w http.ResponseWriter, r *http.Request) error {
 			b.PrependUOffsetT(offset)
 		}
 		tensors := b.EndVector(len(outputOffsets))
+
+		// name the outputs so clients can tell the defaults apart
+		var outputNamesOffset fb.UOffsetT
+		outputNames, _ := getOutputNames(c, inferRequest)
+		if len(outputNames) == len(outputs) {
+			outStrs := make([]fb.UOffsetT, len(outputNames))
+			for i := range outStrs {
+				outStrs[i] = b.CreateString(outputNames[i])
+			}
+			graphpipefb.InferResponseStartOutputNamesVector(b, len(outStrs))
+			for i := len(outStrs) - 1; i >= 0; i-- {
+				b.PrependUOffsetT(outStrs[i])
+			}
+			outputNamesOffset = b.EndVector(len(outStrs))
+		}
+
 		graphpipefb.InferResponseStart(b)
 		graphpipefb.InferResponseAddOutputTensors(b, tensors)
+		if outputNamesOffset != 0 {
+			graphpipefb.InferResponseAddOutputNames(b, outputNamesOffset)
+		}
 
 		inferResponseOffset := graphpipefb.InferResponseEnd(b)
 		tmp := Serialize(b, inferResponseOffset)
@@ -300,6 +400,26 @@ func Handler(c *appContext, w http.ResponseWriter, r *http.Request) error {
 	// return errors.New("Unhandled request type")
 }
 
+// parseRequest reads the request type from body, returning the
+// InferRequest for infer requests and nil for metadata requests.
+func parseRequest(body []byte) (_ *graphpipefb.InferRequest, err error) {
+	defer recoverMalformed(&err)
+	if len(body) < fb.SizeUOffsetT {
+		return nil, errors.New("Request is too short")
+	}
+	request := graphpipefb.GetRootAsRequest(body, 0)
+	if request.ReqType() != graphpipefb.ReqInferRequest {
+		return nil, nil
+	}
+	inferRequest := &graphpipefb.InferRequest{}
+	table := inferRequest.Table()
+	if !request.Req(&table) {
+		return nil, errors.New("Request is missing its body")
+	}
+	inferRequest.Init(table.Bytes, table.Pos)
+	return inferRequest, nil
+}
+
 func isReadyHandler(c *appContext, w http.ResponseWriter, r *http.Request) error {
 	if c.isReady == 1 {
 		fmt.Fprintf(w, "ok\n")
@@ -325,6 +445,9 @@ func shutdownHandler(c *appContext, w http.ResponseWriter, r *http.Request) erro
 		time.Sleep(time.Second / 10)
 	}
 	time.Sleep(time.Second * 5) // sleep also, to give enough time to leave pool if behind proxy
+	if c.cache != nil {
+		c.cacheWriter().flush()
+	}
 	atomic.AddInt64(&c.isAlive, -1)
 	fmt.Fprintf(w, "shutdown\n")
 	return nil
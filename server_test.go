@@ -0,0 +1,28 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"testing"
+)
+
+func TestServeModelID(t *testing.T) {
+	shapes := [][]int64{{-1, 3}}
+	id := serveModelID(applyFloat, "", shapes, nil)
+	if serveModelID(applyFloat, "", [][]int64{{-1, 3}}, nil) != id {
+		t.Errorf("Expected the model ID to be stable")
+	}
+	for i, other := range []string{
+		serveModelID(applyString, "", shapes, nil),
+		serveModelID(applyFloat, "2", shapes, nil),
+		serveModelID(applyFloat, "", nil, shapes),
+		serveModelID(applyFloat, "", [][]int64{{-1, 4}}, nil),
+	} {
+		if other == id {
+			t.Errorf("Test %d: expected a different model ID", i)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// Structs map to named tensors through field tags. Each field tagged with
+// `graphpipe:"name"` is the tensor called name:
+//
+//	type Request struct {
+//		Image  [][][]float32 `graphpipe:"input_1"`
+//		Scale  []float32     `graphpipe:"scale"`
+//	}
+//
+// Fields may be nested slices or arrays of any tensor type, including named
+// types like `type Score float32`, or *NativeTensor to pass tensors through
+// untouched. Untagged fields and fields tagged "-" are skipped.
+
+var nativeTensorPtr = reflect.TypeOf((*NativeTensor)(nil))
+
+type structField struct {
+	name  string
+	index int
+}
+
+// structFields returns the tagged fields of a struct type in order.
+func structFields(typ reflect.Type) ([]structField, error) {
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Expected a struct, got %v", typ)
+	}
+	fields := []structField{}
+	seen := map[string]bool{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("graphpipe"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if f.PkgPath != "" {
+			return nil, fmt.Errorf("Field %s tagged '%s' is not exported", f.Name, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Tensor '%s' is tagged more than once", name)
+		}
+		seen[name] = true
+		fields = append(fields, structField{name, i})
+	}
+	return fields, nil
+}
+
+// StructNames returns the tensor names tagged on the fields of v, which is
+// a struct or a pointer to one, in field order.
+func StructNames(v interface{}) ([]string, error) {
+	typ := reflect.TypeOf(v)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil {
+		return nil, fmt.Errorf("Expected a struct, got nil")
+	}
+	fields, err := structFields(typ)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return names, nil
+}
+
+// MarshalStruct converts the tagged fields of v, which is a struct or a
+// pointer to one, into tensors. The names and tensors are in field order.
+func MarshalStruct(v interface{}) ([]string, []*NativeTensor, error) {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return nil, nil, fmt.Errorf("Expected a struct, got nil")
+	}
+	fields, err := structFields(val.Type())
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, len(fields))
+	tensors := make([]*NativeTensor, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+		fv := val.Field(f.index)
+		if fv.Type() == nativeTensorPtr {
+			if fv.IsNil() {
+				return nil, nil, fmt.Errorf("Tensor '%s' is nil", f.name)
+			}
+			tensors[i] = fv.Interface().(*NativeTensor)
+			continue
+		}
+		nt := &NativeTensor{}
+		if err := nt.InitSimple(fv.Interface()); err != nil {
+			return nil, nil, fmt.Errorf("Tensor '%s': %v", f.name, err)
+		}
+		tensors[i] = nt
+	}
+	return names, tensors, nil
+}
+
+// UnmarshalStruct stores tensors into the tagged fields of the struct that
+// v points to. Every tagged field needs a tensor, and numeric tensors are
+// cast to the element type of the field if needed. Slices are allocated to
+// fit the tensor, while arrays must match its shape. A field that is not a
+// slice or array takes a tensor with a single element.
+func UnmarshalStruct(tensors map[string]*NativeTensor, v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Expected a pointer to a struct, got %T", v)
+	}
+	val = val.Elem()
+	fields, err := structFields(val.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		nt, ok := tensors[f.name]
+		if !ok {
+			return fmt.Errorf("Tensor '%s' is missing", f.name)
+		}
+		if err := NativeTensorInto(nt, val.Field(f.index).Addr().Interface()); err != nil {
+			return fmt.Errorf("Tensor '%s': %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// NativeTensorInto stores a tensor in the value ptr points to, which can
+// be a nested slice or array of any tensor type, a single element, a
+// *NativeTensor or an interface{}. Unlike NativeTensorToNative it handles
+// named element types and arrays.
+func NativeTensorInto(nt *NativeTensor, ptr interface{}) error {
+	dst := reflect.ValueOf(ptr)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("Expected a pointer, got %T", ptr)
+	}
+	dst = dst.Elem()
+	switch {
+	case dst.Type() == nativeTensorPtr:
+		dst.Set(reflect.ValueOf(nt))
+		return nil
+	case dst.Kind() == reflect.Interface:
+		native, err := NativeTensorToNative(nt)
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(native))
+		return nil
+	}
+	if err := nt.Validate(); err != nil {
+		return err
+	}
+
+	// find the element type and check the dimensions
+	elem := dst.Type()
+	dims := 0
+	for elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array {
+		if dims >= len(nt.Shape) {
+			return fmt.Errorf("Can not store shape %v in %v", nt.Shape, dst.Type())
+		}
+		if elem.Kind() == reflect.Array && int64(elem.Len()) != nt.Shape[dims] {
+			return fmt.Errorf("Can not store shape %v in %v", nt.Shape, dst.Type())
+		}
+		elem = elem.Elem()
+		dims++
+	}
+	if dims != len(nt.Shape) && !(dims == 0 && numElements(nt.Shape) == 1) {
+		return fmt.Errorf("Can not store shape %v in %v", nt.Shape, dst.Type())
+	}
+	_, _, _, dt, err := ShapeType(reflect.Zero(elem))
+	if err != nil {
+		return err
+	}
+	if dt != nt.Type {
+		if nt, err = nt.Cast(dt); err != nil {
+			return err
+		}
+	}
+
+	// view the tensor data as a flat slice of the element type
+	n := int(numElements(nt.Shape))
+	if n == 0 {
+		fillInto(dst, reflect.MakeSlice(reflect.SliceOf(elem), 0, 0), nt.Shape[:dims])
+		return nil
+	}
+	var p unsafe.Pointer
+	if dt == graphpipefb.TypeString {
+		p = unsafe.Pointer(&nt.StringVals[0])
+	} else {
+		p = unsafe.Pointer(&nt.Data[0])
+	}
+	flat := reflect.NewAt(reflect.ArrayOf(n, elem), p).Elem().Slice(0, n)
+	if dims == 0 {
+		dst.Set(flat.Index(0))
+		return nil
+	}
+	fillInto(dst, flat, nt.Shape)
+	return nil
+}
+
+// fillInto copies flat row major data into a nested slice or array.
+func fillInto(dst reflect.Value, flat reflect.Value, shape []int64) {
+	if dst.Kind() == reflect.Slice {
+		dst.Set(reflect.MakeSlice(dst.Type(), int(shape[0]), int(shape[0])))
+	}
+	if len(shape) <= 1 {
+		reflect.Copy(dst, flat)
+		return
+	}
+	rows := int(shape[0])
+	if rows == 0 {
+		return
+	}
+	size := flat.Len() / rows
+	for i := 0; i < rows; i++ {
+		fillInto(dst.Index(i), flat.Slice(i*size, (i+1)*size), shape[1:])
+	}
+}
+
+// InputStruct adds an input for each tagged field of v, which is a struct
+// or a pointer to one.
+func (r *InferRequest) InputStruct(v interface{}) *InferRequest {
+	if r.err != nil {
+		return r
+	}
+	names, tensors, err := MarshalStruct(v)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	for i := range names {
+		r.Input(names[i], tensors[i])
+	}
+	return r
+}
+
+// MultiRemoteStruct is like MultiRemote, but sends the tagged fields of in
+// as named inputs and asks for the outputs tagged on out, which must be a
+// pointer to a struct. The outputs are stored in out.
+func MultiRemoteStruct(client *http.Client, uri string, config string, in, out interface{}) error {
+	outputNames, err := StructNames(out)
+	if err != nil {
+		return err
+	}
+	named, err := NewInferRequest().Config(config).InputStruct(in).Output(outputNames...).Send(client, uri)
+	if err != nil {
+		return err
+	}
+	return UnmarshalStruct(named, out)
+}
@@ -0,0 +1,155 @@
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+type score float32
+
+type structIn struct {
+	Points  [][3]float32  `graphpipe:"points"`
+	Scores  []score       `graphpipe:"scores"`
+	Words   [][]string    `graphpipe:"words"`
+	Raw     *NativeTensor `graphpipe:"raw"`
+	Skipped []int32       `graphpipe:"-"`
+	Ignored []int32
+}
+
+func TestShapeTypeNamedAndArrays(t *testing.T) {
+	shape, num, size, dt, err := ShapeType(reflect.ValueOf([][3]score{{1, 2, 3}, {4, 5, 6}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shape, []int64{2, 3}) || num != 6 || size != 4 || dt != graphpipefb.TypeFloat32 {
+		t.Errorf("Got shape %v, num %d, size %d, dt %d", shape, num, size, dt)
+	}
+}
+
+func TestInitSimpleArrays(t *testing.T) {
+	nt := &NativeTensor{}
+	if err := nt.InitSimple([][3]float32{{1, 2, 3}, {4, 5, 6}}); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := nt.Float32s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []float32{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Expected [1 2 3 4 5 6], got %v", vals)
+	}
+	if err := nt.InitSimple([]interface{}{[]int32{1, 2}, [2]int32{3, 4}}); err != nil {
+		t.Fatal(err)
+	}
+	ints, _ := nt.Int32s()
+	if !reflect.DeepEqual(ints, []int32{1, 2, 3, 4}) {
+		t.Errorf("Expected [1 2 3 4], got %v", ints)
+	}
+}
+
+func TestMarshalStruct(t *testing.T) {
+	raw := &NativeTensor{}
+	raw.InitSimple([]int64{7, 8})
+	in := structIn{
+		Points:  [][3]float32{{1, 2, 3}, {4, 5, 6}},
+		Scores:  []score{0.5, 0.25},
+		Words:   [][]string{{"a", "b"}, {"c", "d"}},
+		Raw:     raw,
+		Skipped: []int32{1},
+	}
+	names, tensors, err := MarshalStruct(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"points", "scores", "words", "raw"}) {
+		t.Errorf("Unexpected names %v", names)
+	}
+	if tensors[3] != raw {
+		t.Errorf("Expected the raw tensor to be passed through")
+	}
+	if !reflect.DeepEqual(tensors[1].Shape, []int64{2}) || tensors[1].Type != graphpipefb.TypeFloat32 {
+		t.Errorf("Unexpected scores tensor %v", tensors[1])
+	}
+
+	named := map[string]*NativeTensor{}
+	for i := range names {
+		named[names[i]] = tensors[i]
+	}
+	out := structIn{}
+	if err := UnmarshalStruct(named, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Skipped = nil
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("Expected %v, got %v", in, out)
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	ints := &NativeTensor{}
+	ints.InitSimple([][]int32{{1, 2}, {3, 4}})
+	one := &NativeTensor{}
+	one.InitSimple([]float64{2.5})
+	var out struct {
+		Floats [][]score   `graphpipe:"ints"`
+		Arr    [2][2]int64 `graphpipe:"ints2"`
+		Scalar float32     `graphpipe:"one"`
+		Any    interface{} `graphpipe:"any"`
+	}
+	named := map[string]*NativeTensor{"ints": ints, "ints2": ints, "one": one, "any": ints}
+	if err := UnmarshalStruct(named, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.Floats, [][]score{{1, 2}, {3, 4}}) {
+		t.Errorf("Unexpected floats %v", out.Floats)
+	}
+	if out.Arr != [2][2]int64{{1, 2}, {3, 4}} {
+		t.Errorf("Unexpected array %v", out.Arr)
+	}
+	if out.Scalar != 2.5 {
+		t.Errorf("Expected 2.5, got %v", out.Scalar)
+	}
+	if !reflect.DeepEqual(out.Any, [][]int32{{1, 2}, {3, 4}}) {
+		t.Errorf("Unexpected any %v", out.Any)
+	}
+
+	delete(named, "any")
+	if err := UnmarshalStruct(named, &out); err == nil {
+		t.Errorf("Expected an error for a missing tensor")
+	}
+	var bad struct {
+		Arr [3][2]int32 `graphpipe:"ints"`
+	}
+	if err := UnmarshalStruct(named, &bad); err == nil {
+		t.Errorf("Expected an error for a mismatched array")
+	}
+	if err := UnmarshalStruct(named, out); err == nil {
+		t.Errorf("Expected an error for a non pointer")
+	}
+}
+
+func TestMultiRemoteStruct(t *testing.T) {
+	ts := newNamedServer()
+	defer ts.Close()
+
+	in := struct {
+		X []score `graphpipe:"x"`
+	}{[]score{1, 2, 3}}
+	var out struct {
+		B []float64 `graphpipe:"b"`
+	}
+	if err := MultiRemoteStruct(http.DefaultClient, ts.URL, "", in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.B, []float64{2, 4, 6}) {
+		t.Errorf("Expected [2 4 6], got %v", out.B)
+	}
+}
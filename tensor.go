@@ -0,0 +1,140 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"fmt"
+	"unsafe"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+// Element is the set of go types a Tensor can hold, one for each tensor
+// type.
+type Element interface {
+	uint8 | int8 | uint16 | int16 | uint32 | int32 | uint64 | int64 |
+		Float16 | BFloat16 | float32 | float64 | bool | complex64 | complex128 |
+		string
+}
+
+// Tensor is a typed tensor with row major Data. It converts to and from
+// NativeTensor without copying or reflection:
+//
+//	t, err := TensorOf[float32](nt)
+//	x := t.At(0, 3)
+type Tensor[T Element] struct {
+	Shape []int64
+	Data  []T
+}
+
+// ElementType returns the tensor type, such as graphpipefb.TypeFloat32, of
+// the element type T.
+func ElementType[T Element]() uint8 {
+	var zero T
+	switch any(zero).(type) {
+	case uint8:
+		return graphpipefb.TypeUint8
+	case int8:
+		return graphpipefb.TypeInt8
+	case uint16:
+		return graphpipefb.TypeUint16
+	case int16:
+		return graphpipefb.TypeInt16
+	case uint32:
+		return graphpipefb.TypeUint32
+	case int32:
+		return graphpipefb.TypeInt32
+	case uint64:
+		return graphpipefb.TypeUint64
+	case int64:
+		return graphpipefb.TypeInt64
+	case Float16:
+		return graphpipefb.TypeFloat16
+	case BFloat16:
+		return graphpipefb.TypeBFloat16
+	case float32:
+		return graphpipefb.TypeFloat32
+	case float64:
+		return graphpipefb.TypeFloat64
+	case bool:
+		return graphpipefb.TypeBool
+	case complex64:
+		return graphpipefb.TypeComplex64
+	case complex128:
+		return graphpipefb.TypeComplex128
+	case string:
+		return graphpipefb.TypeString
+	}
+	return graphpipefb.TypeNull
+}
+
+// NewTensor wraps data in a Tensor of the given shape. The length of data
+// must match the shape.
+func NewTensor[T Element](data []T, shape ...int64) (*Tensor[T], error) {
+	for _, d := range shape {
+		if d < 0 {
+			return nil, fmt.Errorf("Invalid shape %v", shape)
+		}
+	}
+	if int64(len(data)) != numElements(shape) {
+		return nil, fmt.Errorf("Shape %v needs %d elements but there are %d", shape, numElements(shape), len(data))
+	}
+	return &Tensor[T]{Shape: shape, Data: data}, nil
+}
+
+// TensorOf returns a Tensor that shares its data with nt. It returns an
+// error if nt does not hold elements of type T.
+func TensorOf[T Element](nt *NativeTensor) (*Tensor[T], error) {
+	dt := ElementType[T]()
+	if err := nt.checkView(dt); err != nil {
+		return nil, err
+	}
+	t := &Tensor[T]{Shape: nt.Shape}
+	if dt == graphpipefb.TypeString {
+		t.Data = any(nt.StringVals).([]T)
+	} else if len(nt.Data) > 0 {
+		var zero T
+		t.Data = unsafe.Slice((*T)(unsafe.Pointer(&nt.Data[0])), len(nt.Data)/int(unsafe.Sizeof(zero)))
+	}
+	return t, nil
+}
+
+// Native returns a NativeTensor that shares its data with t.
+func (t *Tensor[T]) Native() *NativeTensor {
+	dt := ElementType[T]()
+	nt := &NativeTensor{Type: dt, Shape: t.Shape}
+	if dt == graphpipefb.TypeString {
+		nt.StringVals = any(t.Data).([]string)
+	} else if len(t.Data) > 0 {
+		var zero T
+		nt.Data = unsafe.Slice((*byte)(unsafe.Pointer(&t.Data[0])), len(t.Data)*int(unsafe.Sizeof(zero)))
+	} else {
+		nt.Data = []byte{}
+	}
+	return nt
+}
+
+// At returns the element at idx, with one index per dimension. Like slice
+// indexing it panics if idx is out of range.
+func (t *Tensor[T]) At(idx ...int) T {
+	off, err := offset(t.Shape, idx)
+	if err != nil {
+		panic(err)
+	}
+	return t.Data[off]
+}
+
+// Set changes the element at idx to v. It panics if idx is out of range.
+func (t *Tensor[T]) Set(v T, idx ...int) {
+	off, err := offset(t.Shape, idx)
+	if err != nil {
+		panic(err)
+	}
+	t.Data[off] = v
+}
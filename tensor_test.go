@@ -0,0 +1,70 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+** Copyright © 2018, Oracle and/or its affiliates. All rights reserved.
+** Licensed under the Universal Permissive License v 1.0 as shown at http://oss.oracle.com/licenses/upl.
+*/
+
+package graphpipe
+
+import (
+	"reflect"
+	"testing"
+
+	graphpipefb "github.com/oracle/graphpipe-go/graphpipefb"
+)
+
+func TestTensorOf(t *testing.T) {
+	nt := mustTensor(t, [][]int64{{1, 2}, {3, 4}, {5, 6}})
+	tt, err := TensorOf[int64](nt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt.At(2, 1) != 6 {
+		t.Fatalf("Expected 6, got %d", tt.At(2, 1))
+	}
+	tt.Set(40, 1, 1)
+	checkNative(t, nt, nil, [][]int64{{1, 2}, {3, 40}, {5, 6}})
+
+	if _, err := TensorOf[float32](nt); err == nil {
+		t.Errorf("Expected error reading int64 tensor as float32")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected panic for index out of range")
+			}
+		}()
+		tt.At(3, 0)
+	}()
+}
+
+func TestTensorNative(t *testing.T) {
+	tt, err := NewTensor([]Float16{0x3c00, 0x4000, 0x4200, 0x4400}, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt := tt.Native()
+	if nt.Type != graphpipefb.TypeFloat16 {
+		t.Fatalf("Expected Float16 tensor, got %d", nt.Type)
+	}
+	checkNative(t, nt, nil, [][]Float16{{0x3c00, 0x4000}, {0x4200, 0x4400}})
+
+	s, err := NewTensor([]string{"a", "b", "c"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := TensorOf[string](s.Native())
+	if err != nil || !reflect.DeepEqual(back.Data, s.Data) {
+		t.Fatalf("Unexpected strings %v (%v)", back, err)
+	}
+
+	if _, err := NewTensor([]float32{1, 2, 3}, 2, 2); err == nil {
+		t.Errorf("Expected error for mismatched shape")
+	}
+	if ElementType[complex64]() != graphpipefb.TypeComplex64 {
+		t.Errorf("Unexpected element type for complex64")
+	}
+}